@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fergusn/muzeum/internal/config"
+	"github.com/fergusn/muzeum/pkg/backup"
+)
+
+func init() {
+	configFile := "config.yaml"
+	var repository, output, since string
+
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Write the files of the repositories to a tar archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(configFile)
+
+			var previous *backup.Manifest
+			if len(since) > 0 {
+				f, err := os.Open(since)
+				if err != nil {
+					log.Fatal(err)
+				}
+				previous, err = backup.ReadManifest(f)
+				f.Close()
+				if err != nil {
+					log.Fatalf("Unable to read the manifest of %s: %v", since, err)
+				}
+			}
+
+			out := os.Stdout
+			if len(output) > 0 && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				out = f
+			}
+
+			manifest, err := backup.Backup(context.Background(), out, repositories(cfg, repository), previous)
+			if err != nil {
+				log.Fatalf("Unable to back up: %v", err)
+			}
+			archived := 0
+			for _, f := range manifest.Files {
+				if f.Archived {
+					archived++
+				}
+			}
+			log.Printf("Archived %d of %d files", archived, len(manifest.Files))
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
+	cmd.PersistentFlags().StringVarP(&repository, "repository", "r", "", "--repository nuget, defaults to all repositories")
+	cmd.PersistentFlags().StringVarP(&output, "output", "o", "", "--output backup.tar, defaults to stdout")
+	cmd.PersistentFlags().StringVar(&since, "since", "", "--since previous.tar only archive the files that changed since a previous backup")
+
+	cli.AddCommand(cmd)
+
+	restoreConfigFile := "config.yaml"
+	var restoreRepository, input string
+
+	restore := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the files of the repositories from a backup",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(restoreConfigFile)
+
+			in := os.Stdin
+			if len(input) > 0 && input != "-" {
+				f, err := os.Open(input)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				in = f
+			}
+
+			manifest, err := backup.Restore(context.Background(), in, repositories(cfg, restoreRepository))
+			if err != nil {
+				log.Fatalf("Unable to restore: %v", err)
+			}
+			log.Printf("Restored the backup of %s", manifest.Created.Format("2006-01-02 15:04:05"))
+		},
+	}
+
+	restore.PersistentFlags().StringVarP(&restoreConfigFile, "config", "c", "config.yaml", "--config config.yaml")
+	restore.PersistentFlags().StringVarP(&restoreRepository, "repository", "r", "", "--repository nuget, defaults to all repositories")
+	restore.PersistentFlags().StringVarP(&input, "input", "i", "", "--input backup.tar, defaults to stdin")
+
+	cli.AddCommand(restore)
+}
+
+// repositories of the configuration, or only the named repository
+func repositories(cfg *config.Configuration, name string) []backup.Repository {
+	bucket, _ := buckets(cfg, global(cfg, false))
+
+	repos := []backup.Repository{}
+	for _, repo := range cfg.Repositories {
+		if len(name) == 0 || repo.Name == name {
+			repos = append(repos, backup.Repository{Name: repo.Name, Storage: bucket(repo)})
+		}
+	}
+	if len(repos) == 0 {
+		log.Fatalf("No repository %s", name)
+	}
+	return repos
+}
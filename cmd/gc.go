@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/spf13/cobra"
+
+	"github.com/fergusn/muzeum/internal/config"
+	"github.com/fergusn/muzeum/pkg/plugins"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+var errCollect = errors.New("garbage collection failed")
+
+func init() {
+	configFile := "config.yaml"
+	var repository string
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete the orphaned files of the repositories in storage",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(configFile)
+			bucket, blobs := buckets(cfg, global(cfg, false))
+
+			if err := collect(context.Background(), cfg, bucket, blobs, repository, dryRun); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
+	cmd.PersistentFlags().StringVarP(&repository, "repository", "r", "", "--repository archive.ubuntu.com, defaults to all repositories")
+	cmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "--dry-run only report the orphaned files")
+
+	cli.AddCommand(cmd)
+}
+
+// collect the orphaned files of the repositories, or of a single repository, and the blobs that are no longer referenced
+func collect(ctx context.Context, cfg *config.Configuration, bucket func(repo config.Repository) driver.StorageDriver, blobs *storage.Blobs, repository string, dryRun bool) error {
+	action := "Deleted"
+	if dryRun {
+		action = "Orphaned"
+	}
+
+	failed := false
+	for _, repo := range cfg.Repositories {
+		if len(repository) > 0 && repo.Name != repository {
+			continue
+		}
+		for name := range repo.Plugin {
+			if collector, ok := plugins.Collectors[name]; ok {
+				removed, err := collector(ctx, repo.Name, bucket(repo), dryRun)
+				for _, path := range removed {
+					log.Printf("%s %s%s", action, repo.Name, path)
+				}
+				if err != nil {
+					log.Printf("Unable to collect %s: %v", repo.Name, err)
+					failed = true
+				}
+			}
+		}
+	}
+
+	// blobs are shared, they are only collected with all repositories
+	if blobs != nil && len(repository) == 0 {
+		removed, err := blobs.Collect(ctx, dryRun)
+		for _, digest := range removed {
+			log.Printf("%s blob sha256:%s", action, digest)
+		}
+		if errors.Is(err, storage.ErrBlobsLocked) {
+			log.Printf("Unable to collect blobs, they are collected by the running server with gc.interval or when it is stopped: %v", err)
+			failed = true
+		} else if err != nil {
+			log.Printf("Unable to collect blobs: %v", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return errCollect
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fergusn/muzeum/internal/config"
+	"github.com/fergusn/muzeum/pkg/plugins"
+	"github.com/fergusn/muzeum/pkg/upstream"
+)
+
+func init() {
+	configFile := "config.yaml"
+	var repository string
+
+	cmd := &cobra.Command{
+		Use:   "mirror",
+		Short: "Mirror the configured upstream content into storage",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(configFile)
+			bucket, _ := buckets(cfg, global(cfg, false))
+
+			failed := false
+			for _, repo := range cfg.Repositories {
+				if len(repository) > 0 && repo.Name != repository {
+					continue
+				}
+				for name, pcfg := range repo.Plugin {
+					if _, ok := pcfg["mirror"]; !ok {
+						continue
+					}
+					if mirror, ok := plugins.Mirrors[name]; ok {
+						client, err := upstream.NewClient(repo.Name, repo.Upstream)
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						log.Printf("Mirroring %s ...", repo.Name)
+						err = mirror(context.Background(), repo.Name, pcfg, bucket(repo), client)
+						if err != nil {
+							log.Println(err)
+							failed = true
+						}
+					}
+				}
+			}
+
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
+	cmd.PersistentFlags().StringVarP(&repository, "repository", "r", "", "--repository archive.ubuntu.com")
+
+	cli.AddCommand(cmd)
+}
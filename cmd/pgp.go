@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/fergusn/muzeum/internal/pgp"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var name, email string
+
+	cmd := &cobra.Command{
+		Use:   "pgp",
+		Short: "Generate OpenPGP key to sign repositories",
+
+		Run: func(c *cobra.Command, args []string) {
+			if err := pgp.Generate(os.Stdout, name, email); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&name, "name", "", "muzeum", "--name muzeum")
+	cmd.PersistentFlags().StringVarP(&email, "email", "", "", "--email muzeum@example.com")
+
+	cli.AddCommand(cmd)
+}
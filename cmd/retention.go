@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fergusn/muzeum/internal/config"
+	"github.com/fergusn/muzeum/pkg/plugins"
+)
+
+func init() {
+	configFile := "config.yaml"
+	var repository string
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "retention",
+		Short: "Delete the packages of hosted repositories that are not retained by their retention policy",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(configFile)
+			bucket, _ := buckets(cfg, global(cfg, false))
+
+			action := "Deleted"
+			if dryRun {
+				action = "Expired"
+			}
+
+			failed := false
+			for _, repo := range cfg.Repositories {
+				if len(repository) > 0 && repo.Name != repository {
+					continue
+				}
+				for name, pcfg := range repo.Plugin {
+					if _, ok := pcfg["retention"]; !ok {
+						continue
+					}
+					retain, ok := plugins.Retainers[name]
+					if !ok {
+						log.Printf("Unable to apply the retention of %s: the %s plugin has no retention", repo.Name, name)
+						failed = true
+						continue
+					}
+					expired, err := retain(context.Background(), repo.Name, pcfg, bucket(repo), dryRun)
+					for _, artifact := range expired {
+						log.Printf("%s %s/%s", action, repo.Name, artifact)
+					}
+					if err != nil {
+						log.Printf("Unable to apply the retention of %s: %v", repo.Name, err)
+						failed = true
+					}
+				}
+			}
+
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
+	cmd.PersistentFlags().StringVarP(&repository, "repository", "r", "", "--repository nuget, defaults to all repositories")
+	cmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "--dry-run only report the expired packages")
+
+	cli.AddCommand(cmd)
+}
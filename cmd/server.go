@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
+	"sync"
+	"time"
 
+	registry "github.com/docker/distribution/configuration"
 	_ "github.com/docker/distribution/registry/auth/token"
 	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
@@ -17,20 +22,25 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/spf13/cobra"
 
+	"github.com/fergusn/muzeum/internal/admin"
 	"github.com/fergusn/muzeum/internal/config"
 	"github.com/fergusn/muzeum/internal/pki"
 	_ "github.com/fergusn/muzeum/pkg/debian"
 	_ "github.com/fergusn/muzeum/pkg/docker"
+	"github.com/fergusn/muzeum/pkg/events"
 	_ "github.com/fergusn/muzeum/pkg/nuget"
 	"github.com/fergusn/muzeum/pkg/plugins"
 	"github.com/fergusn/muzeum/pkg/proxy"
+	"github.com/fergusn/muzeum/pkg/replication"
 	"github.com/fergusn/muzeum/pkg/storage"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
 func init() {
 	httpsAddr := ":8443"
 	httpAddr := ":8080"
 	configFile := "config.yaml"
+	rotateKeys := false
 
 	cmd := &cobra.Command{
 		Use:   "server",
@@ -40,17 +50,28 @@ func init() {
 			log.Printf("Listening on %s ...\n (HTTP)", httpAddr)
 
 			cfg := config.Parse(configFile)
-
-			driver.PathRegexp = regexp.MustCompile(`^(/[\+\:A-Za-z0-9~._-]+)+$`)
-			s, err := factory.Create(cfg.Storage.Type(), cfg.Storage.Parameters())
-			if err != nil {
-				log.Fatal(err)
+			s := global(cfg, true)
+			bucket, blobs := buckets(cfg, s)
+			if blobs != nil {
+				// the server count the references of the blob store while it runs
+				if err := blobs.Lock(context.Background()); err != nil {
+					log.Fatal(err)
+				}
 			}
 
 			router := mux.NewRouter()
 			router.Use(handlers.ProxyHeaders)
 
+			upstream.SetGlobalOffline(cfg.Offline)
+
 			for _, repo := range cfg.Repositories {
+				upstream.SetOffline(repo.Name, repo.Offline)
+
+				client, err := upstream.NewClient(repo.Name, repo.Upstream)
+				if err != nil {
+					log.Fatal(err)
+				}
+
 				if len(repo.Plugin) == 1 {
 					for name, cfg := range repo.Plugin {
 						if register, ok := plugins.Plugins[name]; ok {
@@ -62,13 +83,35 @@ func init() {
 								route = route.Host(repo.Host)
 							}
 
-							register(route, repo.Name, cfg, storage.NewDirectoryDriver(repo.Name, s))
+							if err := register(route, repo.Name, cfg, bucket(repo), client); err != nil {
+								log.Fatalf("repository %s: %v", repo.Name, err)
+							}
 						}
 					}
 				}
 			}
 
+			// rotation walk the storage, it run when a previous key is configured or it is requested
+			if len(cfg.Encryption.Keys) > 1 || (rotateKeys && len(cfg.Encryption.Keys) > 0) {
+				go rotate(context.Background(), cfg, s)
+			}
+
+			if cfg.GC.Interval > 0 {
+				go func() {
+					for range time.Tick(cfg.GC.Interval) {
+						if err := collect(context.Background(), cfg, bucket, blobs, "", false); err != nil {
+							log.Println(err)
+						}
+					}
+				}()
+			}
+
+			replicate(context.Background(), cfg, bucket, router)
+
 			router.Handle("/metrics", promhttp.Handler())
+			if token := os.ExpandEnv(cfg.Admin.Token); len(token) > 0 {
+				admin.Mount(router.PathPrefix("/admin"), token)
+			}
 
 			ca, err := pki.NewCertificateAuthority(cat(cfg.Certificate.Crt, cfg.Certificate.Key))
 			if err != nil {
@@ -90,10 +133,159 @@ func init() {
 	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
 	cmd.PersistentFlags().StringVar(&httpsAddr, "https", ":8443", "--https :8443")
 	cmd.PersistentFlags().StringVar(&httpAddr, "http", ":8080", "--http :8080")
+	cmd.PersistentFlags().BoolVar(&rotateKeys, "rotate", false, "--rotate re-encrypt the files that are not encrypted with the first key, e.g. stored before encryption was enabled")
 
 	cli.AddCommand(cmd)
 }
 
+// open a storage driver of the configuration
+func open(cfg registry.Storage) driver.StorageDriver {
+	driver.PathRegexp = regexp.MustCompile(`^(/[\+\:A-Za-z0-9~._-]+)+$`)
+	s, err := factory.Create(cfg.Type(), cfg.Parameters())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// global open the global storage. It is cached on local disk when cached, below the encryption, so that the cache
+// only hold encrypted files. The cache is only used by the server, other commands must not write to the cache of a
+// running server, and use the storage directly.
+func global(cfg *config.Configuration, cached bool) driver.StorageDriver {
+	s := open(cfg.Storage)
+	if cached && len(cfg.Cache.Path) > 0 {
+		cache := open(registry.Storage{"filesystem": registry.Parameters{"rootdirectory": cfg.Cache.Path}})
+		s = storage.NewTieredDriver(s, cache, cfg.Cache.Size)
+	}
+	return encrypt(cfg, s)
+}
+
+// buckets return the storage of the repositories. A repository is stored in a directory of its own storage, when it
+// is configured, or of the global storage s, where the repositories share a blob store when deduplicate is configured.
+// The driver of a repository is opened once.
+func buckets(cfg *config.Configuration, s driver.StorageDriver) (func(repo config.Repository) driver.StorageDriver, *storage.Blobs) {
+	var blobs *storage.Blobs
+	if cfg.Deduplicate {
+		blobs = storage.NewBlobs(s)
+	}
+
+	var mu sync.Mutex
+	opened := map[string]driver.StorageDriver{}
+	return func(repo config.Repository) driver.StorageDriver {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if bucket, ok := opened[repo.Name]; ok {
+			return bucket
+		}
+		var bucket driver.StorageDriver
+		switch {
+		case len(repo.Storage) > 0:
+			// blobs are moved within a driver, a repository with its own storage is not deduplicated
+			bucket = storage.NewDirectoryDriver(repo.Name, encrypt(cfg, open(repo.Storage)))
+		case blobs != nil:
+			bucket = blobs.Repository(repo.Name)
+		default:
+			bucket = storage.NewDirectoryDriver(repo.Name, s)
+		}
+		opened[repo.Name] = bucket
+		return bucket
+	}, blobs
+}
+
+// encrypt a storage with the keys of the configuration
+func encrypt(cfg *config.Configuration, s driver.StorageDriver) driver.StorageDriver {
+	if len(cfg.Encryption.Keys) == 0 {
+		return s
+	}
+	keys := [][]byte{}
+	for _, k := range cfg.Encryption.Keys {
+		// a key is read from a file, or is the value of an environment variable
+		value := os.ExpandEnv(k)
+		buf, err := ioutil.ReadFile(value)
+		if err != nil {
+			buf = []byte(value)
+		}
+		key, err := storage.ParseKey(buf)
+		if err != nil {
+			log.Fatalf("encryption key %s: %v", k, err)
+		}
+		keys = append(keys, key)
+	}
+	d, err := storage.NewEncryptedDriver(s, keys...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+// rotate re-encrypt the files of the storages that are not encrypted with the first key, i.e. files encrypted with the
+// other keys, which are readable while they are rotated, and files stored before encryption was enabled. The global
+// storage s is rotated through the driver of the server, so that the files it re-encrypt are replaced in the cache.
+func rotate(ctx context.Context, cfg *config.Configuration, s driver.StorageDriver) {
+	storages := map[string]driver.StorageDriver{cfg.Storage.Type(): s}
+	for _, repo := range cfg.Repositories {
+		if len(repo.Storage) > 0 {
+			storages[repo.Name+" "+repo.Storage.Type()] = encrypt(cfg, open(repo.Storage))
+		}
+	}
+	for name, s := range storages {
+		n, err := s.(*storage.EncryptedDriver).Rotate(ctx)
+		if err != nil {
+			log.Printf("Unable to rotate the encryption key of %s storage: %v", name, err)
+			continue
+		}
+		log.Printf("Rotated the encryption key of %d files in %s storage", n, name)
+	}
+}
+
+// replicate mount the replication endpoint of the repositories, and replicate the repositories that have a peer
+func replicate(ctx context.Context, cfg *config.Configuration, bucket func(repo config.Repository) driver.StorageDriver, router *mux.Router) {
+	token := os.ExpandEnv(cfg.Replication.Token)
+	if len(token) == 0 {
+		return
+	}
+
+	repos := map[string]config.Repository{}
+	for _, repo := range cfg.Repositories {
+		repos[repo.Name] = repo
+	}
+	router.PathPrefix("/replication/").Handler(http.StripPrefix("/replication", replication.Handler(token, func(name string) (driver.StorageDriver, bool) {
+		repo, ok := repos[name]
+		if !ok {
+			return nil, false
+		}
+		return plugins.Storage(repo.Name, bucket(repo)), true
+	})))
+
+	path := cfg.Replication.Queue
+	if len(path) == 0 {
+		path = "replication.json"
+	}
+	queue, err := replication.OpenQueue(os.ExpandEnv(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := upstream.NewClient("replication", cfg.Replication.Upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replicators := map[string]*replication.Replicator{}
+	for _, repo := range cfg.Repositories {
+		if len(repo.Replicate.Peer) == 0 {
+			continue
+		}
+		r := replication.NewReplicator(repo.Name, plugins.Storage(repo.Name, bucket(repo)), repo.Replicate.Peer, token, repo.Replicate.Pull, queue, client)
+		replicators[repo.Name] = r
+		go r.Run(ctx, repo.Replicate.Interval)
+	}
+	if len(replicators) > 0 {
+		go replication.Dispatch(events.Package.Pushed.Receive(), replicators)
+	}
+}
+
 func cat(files ...string) (buf []byte) {
 	for _, f := range files {
 		if c, err := ioutil.ReadFile(os.ExpandEnv(f)); err == nil {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fergusn/muzeum/internal/config"
+	"github.com/fergusn/muzeum/pkg/plugins"
+)
+
+func init() {
+	configFile := "config.yaml"
+	var repository, name string
+
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Create a point-in-time snapshot of the repository metadata",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := config.Parse(configFile)
+			bucket, _ := buckets(cfg, global(cfg, false))
+
+			created := false
+			for _, repo := range cfg.Repositories {
+				if repo.Name != repository {
+					continue
+				}
+				for plugin := range repo.Plugin {
+					if snapshot, ok := plugins.Snapshots[plugin]; ok {
+						snapshot, err := snapshot(context.Background(), repo.Name, bucket(repo), name)
+						if err != nil {
+							log.Fatal(err)
+						}
+						log.Printf("Created snapshot %s of %s", snapshot, repo.Name)
+						created = true
+					}
+				}
+			}
+
+			if !created {
+				log.Printf("Repository %s does not support snapshots", repository)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yaml", "--config config.yaml")
+	cmd.PersistentFlags().StringVarP(&repository, "repository", "r", "", "--repository archive.ubuntu.com")
+	cmd.PersistentFlags().StringVarP(&name, "name", "n", "", "--name release-1.0, defaults to the creation time")
+	cmd.MarkPersistentFlagRequired("repository")
+
+	cli.AddCommand(cmd)
+}
@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/fergusn/muzeum/pkg/upstream"
+	"github.com/gorilla/mux"
+)
+
+// Mount the admin API routes, authenticated by a bearer token
+func Mount(route *mux.Route, token string) {
+	router := route.Subrouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(token) == 0 || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	router.HandleFunc("/offline", offline).Methods(http.MethodGet)
+	router.HandleFunc("/offline", global(true)).Methods(http.MethodPut)
+	router.HandleFunc("/offline", global(false)).Methods(http.MethodDelete)
+	router.HandleFunc("/repositories/{name}/offline", repository(true)).Methods(http.MethodPut)
+	router.HandleFunc("/repositories/{name}/offline", repository(false)).Methods(http.MethodDelete)
+	router.HandleFunc("/repositories/{name}/notfound", purge).Methods(http.MethodDelete)
+	router.HandleFunc("/upstreams", health).Methods(http.MethodGet)
+}
+
+func offline(w http.ResponseWriter, r *http.Request) {
+	global, repos := upstream.Status()
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Global       bool            `json:"global"`
+		Repositories map[string]bool `json:"repositories"`
+	}{global, repos})
+}
+
+func global(value bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upstream.SetGlobalOffline(value)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func repository(value bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upstream.SetOffline(mux.Vars(r)["name"], value)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// purge the cached upstream 404 responses of a repository, optionally only for paths starting with the prefix query parameter
+func purge(w http.ResponseWriter, r *http.Request) {
+	n := upstream.Purge(mux.Vars(r)["name"], r.URL.Query().Get("prefix"))
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{n})
+}
+
+// health of the upstream repositories, including the circuit breaker state
+func health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upstream.Circuits())
+}
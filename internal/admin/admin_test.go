@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fergusn/muzeum/pkg/upstream"
+	"github.com/gorilla/mux"
+)
+
+func TestAdminUnauthorized(t *testing.T) {
+	router := mux.NewRouter()
+	Mount(router.PathPrefix("/admin"), "secret")
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		req := httptest.NewRequest(http.MethodPut, "/admin/offline", nil)
+		req.Header.Set("Authorization", auth)
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, req)
+		if rsp.Code != http.StatusUnauthorized || upstream.Offline("any") {
+			t.Errorf("expected unauthorized with %q, got %d", auth, rsp.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/offline", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusOK {
+		t.Errorf("expected the status with the token, got %d", rsp.Code)
+	}
+}
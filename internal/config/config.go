@@ -3,25 +3,73 @@ package config
 import (
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
 	registry "github.com/docker/distribution/configuration"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
 // Configuration root
 type Configuration struct {
 	Repositories []Repository
 	Storage      registry.Storage
+	Cache        Cache       // a local cache of a slow storage
+	Encryption   Encryption  // encrypt the files in storage
 	Certificate  Certificate `json:"certificate"`
+	Offline      bool
+	Deduplicate  bool // store identical files of all repositories once
+	GC           GC
+	Replication  Replication // replicate repositories with peers
+	Admin        Admin       // the admin API
 }
 
 // Repository configuration
 type Repository struct {
-	Name   string
-	Path   string
-	Host   string
-	Plugin map[string]map[string]interface{} `yaml:",inline"`
+	Name      string
+	Path      string
+	Host      string
+	Offline   bool
+	Upstream  upstream.Config
+	Storage   registry.Storage                  // the storage of the repository, defaults to the global storage
+	Replicate Replicate                         // replicate the repository with a peer
+	Plugin    map[string]map[string]interface{} `yaml:",inline"`
+}
+
+// Cache configuration
+type Cache struct {
+	Path string // a directory on local disk, disabled when empty
+	Size int64  // bytes
+}
+
+// Encryption configuration
+type Encryption struct {
+	Keys []string // files or environment variables of 256-bit keys, the first key encrypt new files
+}
+
+// GC configuration
+type GC struct {
+	Interval time.Duration // delete orphaned files periodically, disabled when 0
+}
+
+// Admin configuration
+type Admin struct {
+	Token string // the bearer token of the admin API, disabled when empty
+}
+
+// Replication configuration
+type Replication struct {
+	Token    string          // the bearer token of the replication endpoint and of the peers, disabled when empty
+	Queue    string          // the file of the queue of files that are not replicated yet
+	Upstream upstream.Config // the requests to the peers, e.g. timeouts and the CA of the peers
+}
+
+// Replicate configuration of a repository
+type Replicate struct {
+	Peer     string        // the base URL of the replication endpoint of the peer, disabled when empty
+	Pull     bool          // catch up from the peer instead of pushing to the peer
+	Interval time.Duration // compare with the peer periodically, disabled when 0
 }
 
 // Certificate configuration
@@ -0,0 +1,95 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var (
+	bits = 4096
+
+	// apt reject signatures with SHA1
+	config = &packet.Config{DefaultHash: crypto.SHA256}
+)
+
+// Signer sign repository metadata with an OpenPGP private key
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// NewSigner creates a Signer from an armored private key, as written by Generate
+func NewSigner(data []byte) (*Signer, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil && !entity.PrivateKey.Encrypted {
+			return &Signer{entity}, nil
+		}
+	}
+	return nil, errors.New("data must include an unencrypted private key")
+}
+
+// ClearSign write msg as a clearsigned document, e.g. an InRelease file
+func (s *Signer) ClearSign(w io.Writer, msg []byte) error {
+	wr, err := clearsign.Encode(w, s.entity.PrivateKey, config)
+	if err != nil {
+		return err
+	}
+	if _, err = wr.Write(msg); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+// DetachSign write an armored detached signature of msg, e.g. a Release.gpg file
+func (s *Signer) DetachSign(w io.Writer, msg []byte) error {
+	return openpgp.ArmoredDetachSign(w, s.entity, bytes.NewReader(msg), config)
+}
+
+// PublicKey write the public key, armored or binary
+func (s *Signer) PublicKey(w io.Writer, armored bool) error {
+	if !armored {
+		return s.entity.Serialize(w)
+	}
+
+	wr, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err = s.entity.Serialize(wr); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+// Generate an OpenPGP signing key with user id name <email> and write the armored private and public key to w
+func Generate(w io.Writer, name, email string) error {
+	entity, err := openpgp.NewEntity(name, "repository signing key", email, &packet.Config{DefaultHash: crypto.SHA256, RSABits: bits})
+	if err != nil {
+		return err
+	}
+
+	wr, err := armor.Encode(w, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err = entity.SerializePrivate(wr, config); err != nil {
+		return err
+	}
+	if err = wr.Close(); err != nil {
+		return err
+	}
+	io.WriteString(w, "\n")
+
+	return (&Signer{entity}).PublicKey(w, true)
+}
@@ -0,0 +1,71 @@
+package pgp
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+var msg = []byte("Origin: Ubuntu\nSuite: bionic\n- dash\n")
+
+func signer(t *testing.T) (*Signer, openpgp.EntityList) {
+	bits = 1024
+	buf := &bytes.Buffer{}
+	if err := Generate(buf, "muzeum", "muzeum@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := &bytes.Buffer{}
+	s.PublicKey(pub, true)
+	keyring, err := openpgp.ReadArmoredKeyRing(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, keyring
+}
+
+func TestClearSign(t *testing.T) {
+	s, keyring := signer(t)
+
+	buf := &bytes.Buffer{}
+	if err := s.ClearSign(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	blk, _ := clearsign.Decode(buf.Bytes())
+	if blk == nil || !bytes.Contains(blk.Bytes, []byte("bionic\r\n- dash")) {
+		t.Fatalf("expected clearsigned message, got %q", blk.Bytes)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(blk.Bytes), blk.ArmoredSignature.Body); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDetachSign(t *testing.T) {
+	s, keyring := signer(t)
+
+	sig := &bytes.Buffer{}
+	if err := s.DetachSign(sig, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(msg), sig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrivateKeyRequired(t *testing.T) {
+	s, _ := signer(t)
+
+	pub := &bytes.Buffer{}
+	s.PublicKey(pub, true)
+	if _, err := NewSigner(pub.Bytes()); err == nil {
+		t.Error("signer require a private key")
+	}
+}
@@ -0,0 +1,98 @@
+package artifact
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+// QuotaStatus return the HTTP status of a quota error, uploads larger than the quota are too large (413) and uploads to
+// a full repository are rejected with insufficient storage (507). Other errors return 0.
+func QuotaStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrQuotaTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return 0
+}
+
+// Limit reject the uploads to a repository that would exceed its quota before they are stored, for handlers that do
+// not report the quota errors of storage. The Content-Length of an upload is checked when it is known, and the body is
+// checked as it is read, e.g. chunked docker uploads. A handler that fail because the body exceeded the quota respond
+// with the status of the quota error.
+func Limit(quota *storage.QuotaDriver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodPatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		size := r.ContentLength
+		if size < 0 {
+			size = 0
+		}
+		if err := quota.Check(size); err != nil {
+			http.Error(w, err.Error(), QuotaStatus(err))
+			return
+		}
+
+		body := &quotaBody{ReadCloser: r.Body, quota: quota}
+		r.Body = body
+		next.ServeHTTP(&quotaResponse{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// quotaBody fail a read of the body when storing it would exceed the quota, the bytes read before are already counted
+// by the storage
+type quotaBody struct {
+	io.ReadCloser
+	quota *storage.QuotaDriver
+	err   error
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if e := b.quota.Check(int64(n)); e != nil {
+			b.err = e
+			return 0, e
+		}
+	}
+	return n, err
+}
+
+// quotaResponse replace the error response of a handler when the body exceeded the quota
+type quotaResponse struct {
+	http.ResponseWriter
+	body     *quotaBody
+	replaced bool
+}
+
+func (w *quotaResponse) WriteHeader(status int) {
+	if w.body.err != nil && status >= http.StatusInternalServerError {
+		w.replaced = true
+		http.Error(w.ResponseWriter, w.body.err.Error(), QuotaStatus(w.body.err))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *quotaResponse) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *quotaResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
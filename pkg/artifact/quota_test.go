@@ -0,0 +1,53 @@
+package artifact
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+func TestLimitChunkedUpload(t *testing.T) {
+	quota, err := storage.NewQuotaDriver(context.TODO(), "docker", inmemory.New(), storage.Quota{Bytes: 100}, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the registry report storage errors as 500
+	handler := Limit(quota, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wr, err := quota.Writer(r.Context(), "/_uploads/layer", true)
+		if err == nil {
+			_, err = io.Copy(wr, r.Body)
+			wr.Commit()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":[{"code":"UNKNOWN"}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	upload := func(size int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPatch, "/v2/a/blobs/uploads/1", ioutil.NopCloser(bytes.NewReader(make([]byte, size))))
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := upload(60); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the chunk within the quota to be accepted, got %d", w.Code)
+	}
+	if w := upload(60); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("expected insufficient storage, got %d %s", w.Code, w.Body.String())
+	}
+	if bytes, _ := quota.Usage(); bytes > 100 {
+		t.Errorf("expected usage within the quota, got %d", bytes)
+	}
+}
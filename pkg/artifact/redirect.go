@@ -0,0 +1,36 @@
+package artifact
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+// Redirect answer a request for an artifact in storage with a redirect to the URL of the storage driver, e.g. a signed
+// URL of a cloud bucket. It return the number of bytes the client will download, true when the client will download
+// the complete artifact, i.e. not a HEAD or range request, and true when the request is redirected. Artifacts that are
+// not in storage, or that the driver can not provide a URL for, are not redirected and must be served.
+func Redirect(w http.ResponseWriter, r *http.Request, rd io.ReadCloser) (int64, bool, bool) {
+	f, ok := rd.(*storage.File)
+	if !ok {
+		return 0, false, false
+	}
+
+	url, err := f.URLFor(map[string]interface{}{"method": r.Method})
+	if err != nil {
+		if _, ok := err.(driver.ErrUnsupportedMethod); !ok {
+			log.Printf("unable to redirect %s: %v", r.URL.Path, err)
+		}
+		return 0, false, false
+	}
+	f.Close()
+
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	if r.Method == http.MethodHead {
+		return 0, false, true
+	}
+	return f.Size(), len(r.Header.Get("Range")) == 0, true
+}
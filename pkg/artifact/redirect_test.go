@@ -0,0 +1,67 @@
+package artifact
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+// signing is a stand-in for a cloud storage driver that return signed URLs
+type signing struct {
+	driver.StorageDriver
+}
+
+func (d signing) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "https://bucket.example.com" + path + "?method=" + options["method"].(string) + "&signature=abcd", nil
+}
+
+func TestRedirect(t *testing.T) {
+	f, err := storage.Open(context.TODO(), signing{mem}, "/a/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	n, complete, ok := Redirect(w, httptest.NewRequest(http.MethodGet, "/b.deb", nil), f)
+
+	if !ok || !complete || n != int64(len(content)) || w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected redirect, got %v %v %d %d", ok, complete, n, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://bucket.example.com/a/b_1.0_amd64.deb?method=GET&signature=abcd" {
+		t.Errorf("expected signed url, got %s", loc)
+	}
+}
+
+func TestRedirectUnsupported(t *testing.T) {
+	f, err := storage.Open(context.TODO(), mem, "/a/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := httptest.NewRecorder()
+	if _, _, ok := Redirect(w, httptest.NewRequest(http.MethodGet, "/b.deb", nil), f); ok {
+		t.Error("expected no redirect when the driver does not support URLs")
+	}
+
+	if n, complete := Serve(w, httptest.NewRequest(http.MethodGet, "/b.deb", nil), f.Path(), f); !complete || n != int64(len(content)) || w.Code != http.StatusOK {
+		t.Errorf("expected file to be served, got %d %d", w.Code, n)
+	}
+}
+
+func TestRedirectRange(t *testing.T) {
+	f, err := storage.Open(context.TODO(), signing{mem}, "/a/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/b.deb", nil)
+	r.Header.Set("Range", "bytes=4-")
+	if _, complete, ok := Redirect(httptest.NewRecorder(), r, f); !ok || complete {
+		t.Errorf("expected a redirected range to not be complete, got %v %v", ok, complete)
+	}
+}
@@ -0,0 +1,91 @@
+package artifact
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+// Serve write an artifact to the response. It return the number of bytes written to the response, which include the
+// body of an error response, and true when the complete artifact was served, i.e. not a HEAD, range, not modified or
+// failed request.
+// A storage.File is served with Content-Length, ETag and Last-Modified, and support HEAD, conditional and range requests.
+// Other seekable artifacts support range requests, and the rest is streamed. The response is aborted when the
+// artifact fail after the headers are written, so that clients do not mistake a truncated body for the artifact.
+func Serve(w http.ResponseWriter, r *http.Request, name string, rd io.ReadCloser) (int64, bool) {
+	defer rd.Close()
+	cw := &counter{ResponseWriter: w}
+
+	if len(w.Header().Get("Content-Type")) == 0 {
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if len(ctype) == 0 {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		modified := time.Time{}
+		if f, ok := rd.(*storage.File); ok {
+			w.Header().Set("Etag", f.ETag())
+			modified = f.ModTime()
+		}
+
+		sr := &seeker{ReadSeeker: rs}
+		http.ServeContent(cw, r, name, modified, sr)
+		if sr.err != nil {
+			abort(r, sr.err)
+		}
+		return cw.n, r.Method != http.MethodHead && (cw.status == 0 || cw.status == http.StatusOK)
+	}
+
+	if r.Method == http.MethodHead {
+		return 0, false
+	}
+	if _, err := io.Copy(cw, rd); err != nil {
+		abort(r, err)
+	}
+	return cw.n, true
+}
+
+func abort(r *http.Request, err error) {
+	log.Printf("unable to write %s: %v", r.URL.Path, err)
+	panic(http.ErrAbortHandler)
+}
+
+// counter count the bytes written to the body of a response, and record its status
+type counter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (w *counter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *counter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// seeker record the read error, http.ServeContent ignore it
+type seeker struct {
+	io.ReadSeeker
+	err error
+}
+
+func (s *seeker) Read(p []byte) (int, error) {
+	n, err := s.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
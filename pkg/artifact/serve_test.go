@@ -0,0 +1,101 @@
+package artifact
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+var (
+	content = []byte("0123456789")
+	mem     = inmemory.New()
+)
+
+func init() {
+	mem.PutContent(context.TODO(), "/a/b_1.0_amd64.deb", content)
+}
+
+func serve(t *testing.T, r *http.Request) (*httptest.ResponseRecorder, int64, bool) {
+	f, err := storage.Open(context.TODO(), mem, "/a/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	n, complete := Serve(w, r, f.Path(), f)
+	return w, n, complete
+}
+
+func TestServeFile(t *testing.T) {
+	w, n, complete := serve(t, httptest.NewRequest(http.MethodGet, "/b.deb", nil))
+
+	if w.Code != http.StatusOK || !complete || n != int64(len(content)) || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("expected complete file, got %d %d %q", w.Code, n, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected Content-Length 10, got %s", w.Header().Get("Content-Length"))
+	}
+	if len(w.Header().Get("Etag")) == 0 || len(w.Header().Get("Last-Modified")) == 0 {
+		t.Error("expected ETag and Last-Modified")
+	}
+}
+
+func TestServeHead(t *testing.T) {
+	w, n, complete := serve(t, httptest.NewRequest(http.MethodHead, "/b.deb", nil))
+
+	if w.Code != http.StatusOK || complete || n != 0 || w.Body.Len() != 0 {
+		t.Errorf("expected headers only, got %d %d", w.Code, n)
+	}
+	if w.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected Content-Length 10, got %s", w.Header().Get("Content-Length"))
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/b.deb", nil)
+	r.Header.Set("Range", "bytes=4-")
+	w, n, complete := serve(t, r)
+
+	if w.Code != http.StatusPartialContent || complete || n != 6 || w.Body.String() != "456789" {
+		t.Errorf("expected partial content, got %d %d %q", w.Code, n, w.Body.String())
+	}
+}
+
+func TestServeUnsatisfiableRange(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/b.deb", nil)
+	r.Header.Set("Range", "bytes=20-")
+	w, n, complete := serve(t, r)
+
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || complete || n == 0 {
+		t.Errorf("expected range not satisfiable with an error body, got %d %d", w.Code, n)
+	}
+}
+
+func TestServeNotModified(t *testing.T) {
+	w, _, _ := serve(t, httptest.NewRequest(http.MethodGet, "/b.deb", nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/b.deb", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("Etag"))
+	w, n, complete := serve(t, r)
+
+	if w.Code != http.StatusNotModified || complete || n != 0 {
+		t.Errorf("expected not modified, got %d %d", w.Code, n)
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	w := httptest.NewRecorder()
+	n, complete := Serve(w, httptest.NewRequest(http.MethodGet, "/index", nil), "index", ioutil.NopCloser(bytes.NewReader(content)))
+
+	if w.Code != http.StatusOK || !complete || n != int64(len(content)) {
+		t.Errorf("expected streamed content, got %d %d", w.Code, n)
+	}
+	if w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("expected default content type, got %s", w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+// the files of the repositories are archived in files/<repository>/<path>, followed by the manifest
+const (
+	filesDir     = "files/"
+	manifestFile = "manifest.json"
+)
+
+// Repository to back up or restore
+type Repository struct {
+	Name    string
+	Storage driver.StorageDriver
+}
+
+// Manifest of a backup, it list all files of the repositories, including the files of an incremental backup that did
+// not change since the previous backup and are not archived
+type Manifest struct {
+	Created  time.Time
+	Previous time.Time `json:",omitempty"` // the previous backup of an incremental backup
+	Files    []File
+}
+
+// File of a repository in a backup
+type File struct {
+	Repository string
+	Path       string
+	Size       int64
+	ModTime    time.Time
+	SHA256     string
+	Archived   bool // false when the file is in a previous backup
+}
+
+// Backup write the files of the repositories to a tar archive, which end with the manifest. An incremental backup only
+// archive the files that changed since the previous manifest, files are unchanged when their size and modification
+// time are the same.
+func Backup(ctx context.Context, w io.Writer, repos []Repository, previous *Manifest) (*Manifest, error) {
+	unchanged := map[string]File{}
+	manifest := &Manifest{Created: time.Now().UTC(), Files: []File{}}
+	if previous != nil {
+		manifest.Previous = previous.Created
+		for _, f := range previous.Files {
+			unchanged[f.Repository+f.Path] = f
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, repo := range repos {
+		files, err := walk(ctx, repo.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", repo.Name, err)
+		}
+		for _, fi := range files {
+			f := File{Repository: repo.Name, Path: fi.Path(), Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+			if p, ok := unchanged[f.Repository+f.Path]; ok && p.Size == f.Size && p.ModTime.Equal(f.ModTime) {
+				f.SHA256 = p.SHA256
+				manifest.Files = append(manifest.Files, f)
+				continue
+			}
+
+			f.Archived = true
+			if f.SHA256, err = archive(ctx, tw, repo.Storage, f); err != nil {
+				return nil, fmt.Errorf("%s%s: %w", f.Repository, f.Path, err)
+			}
+			manifest.Files = append(manifest.Files, f)
+		}
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: manifestFile, Mode: 0644, Size: int64(len(buf)), ModTime: manifest.Created}); err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(buf); err != nil {
+		return nil, err
+	}
+	return manifest, tw.Close()
+}
+
+// archive a file and return its checksum
+func archive(ctx context.Context, tw *tar.Writer, storage driver.StorageDriver, f File) (string, error) {
+	rd, err := storage.Reader(ctx, f.Path, 0)
+	if err != nil {
+		return "", err
+	}
+	defer rd.Close()
+
+	err = tw.WriteHeader(&tar.Header{Name: filesDir + f.Repository + f.Path, Mode: 0644, Size: f.Size, ModTime: f.ModTime})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, hash), rd)
+	if err != nil {
+		return "", err
+	}
+	if n != f.Size {
+		return "", errors.New("changed during the backup")
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReadManifest of a backup archive
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("backup without a manifest")
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestFile {
+			manifest := &Manifest{}
+			return manifest, json.NewDecoder(tr).Decode(manifest)
+		}
+	}
+}
+
+// Restore the files of a backup archive to the repositories, other repositories in the backup are skipped. The
+// checksums of the restored files are verified with the manifest, and files that do not match are deleted. The files
+// of an incremental backup that are not archived must be restored from the previous backups first. Files are
+// restored with the time of the restore, and files that were deleted since a previous backup are not deleted.
+func Restore(ctx context.Context, r io.Reader, repos []Repository) (*Manifest, error) {
+	storages := map[string]driver.StorageDriver{}
+	for _, repo := range repos {
+		storages[repo.Name] = repo.Storage
+	}
+
+	restored := map[string]string{}
+	var manifest *Manifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == manifestFile {
+			manifest = &Manifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name := strings.TrimPrefix(hdr.Name, filesDir)
+		i := strings.Index(name, "/")
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, filesDir) || i < 1 {
+			continue
+		}
+		storage, ok := storages[name[:i]]
+		if !ok {
+			continue
+		}
+		if path := name[i:]; pathpkg.Clean(path) != path || strings.Contains(path+"/", "/../") {
+			return nil, fmt.Errorf("%s: invalid path", name)
+		}
+		if restored[name], err = restore(ctx, storage, name[i:], tr); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("backup without a manifest")
+	}
+
+	// verify the restored files, and the files of the previous backups
+	invalid := []string{}
+	for _, f := range manifest.Files {
+		storage, ok := storages[f.Repository]
+		if !ok {
+			continue
+		}
+		if !f.Archived {
+			if fi, err := storage.Stat(ctx, f.Path); err != nil || fi.Size() != f.Size {
+				invalid = append(invalid, f.Repository+f.Path+" is not restored from the previous backup")
+			}
+		} else if sum, ok := restored[f.Repository+f.Path]; !ok {
+			invalid = append(invalid, f.Repository+f.Path+" is missing")
+		} else if sum != f.SHA256 {
+			storage.Delete(ctx, f.Path)
+			invalid = append(invalid, f.Repository+f.Path+" checksum mismatch")
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return manifest, fmt.Errorf("invalid backup: %s", strings.Join(invalid, ", "))
+	}
+	return manifest, nil
+}
+
+// restore a file and return its checksum
+func restore(ctx context.Context, storage driver.StorageDriver, path string, r io.Reader) (string, error) {
+	wr, err := storage.Writer(ctx, path, false)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(wr, hash), r); err != nil {
+		wr.Cancel()
+		return "", err
+	}
+	if err = wr.Commit(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), wr.Close()
+}
+
+// walk return the files in storage, sorted by path
+func walk(ctx context.Context, storage driver.StorageDriver) ([]driver.FileInfo, error) {
+	files := []driver.FileInfo{}
+	err := storage.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			files = append(files, fi)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path() < files[j].Path()
+	})
+	return files, nil
+}
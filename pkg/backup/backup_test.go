@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.TODO()
+	nuget, debian := inmemory.New(), inmemory.New()
+	nuget.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+	nuget.PutContent(ctx, "/a/1.0.0/.pulled", []byte{})
+	debian.PutContent(ctx, "/pool/main/b.deb", []byte("b"))
+
+	buf := &bytes.Buffer{}
+	manifest, err := Backup(ctx, buf, []Repository{{"nuget", nuget}, {"debian", debian}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 3 || !manifest.Files[0].Archived || len(manifest.Files[0].SHA256) != 64 {
+		t.Errorf("expected 3 archived files, got %v", manifest.Files)
+	}
+
+	restored := inmemory.New()
+	if _, err := Restore(ctx, bytes.NewReader(buf.Bytes()), []Repository{{"nuget", restored}}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := restored.GetContent(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err != nil || string(content) != "a1" {
+		t.Errorf("expected package restored, got %q %v", content, err)
+	}
+	if _, err := restored.Stat(ctx, "/a/1.0.0/.pulled"); err != nil {
+		t.Errorf("expected metadata restored, got %v", err)
+	}
+	if _, err := restored.Stat(ctx, "/pool/main/b.deb"); err == nil {
+		t.Error("expected other repositories skipped")
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	ctx := context.TODO()
+	nuget := inmemory.New()
+	nuget.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+
+	full := &bytes.Buffer{}
+	Backup(ctx, full, []Repository{{"nuget", nuget}}, nil)
+	previous, err := ReadManifest(bytes.NewReader(full.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	nuget.PutContent(ctx, "/a/2.0.0/a.2.0.0.nupkg", []byte("a2"))
+	incremental := &bytes.Buffer{}
+	manifest, err := Backup(ctx, incremental, []Repository{{"nuget", nuget}}, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 2 || manifest.Files[0].Archived || !manifest.Files[1].Archived || !manifest.Previous.Equal(previous.Created) {
+		t.Errorf("expected only the new version archived, got %v", manifest.Files)
+	}
+	if manifest.Files[0].SHA256 != previous.Files[0].SHA256 {
+		t.Error("expected checksum of the unchanged file")
+	}
+
+	restored := inmemory.New()
+	if _, err := Restore(ctx, bytes.NewReader(incremental.Bytes()), []Repository{{"nuget", restored}}); err == nil || !strings.Contains(err.Error(), "previous backup") {
+		t.Errorf("expected previous backup required, got %v", err)
+	}
+	for _, b := range []*bytes.Buffer{full, incremental} {
+		if _, err := Restore(ctx, bytes.NewReader(b.Bytes()), []Repository{{"nuget", restored}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, _ := restored.GetContent(ctx, "/a/2.0.0/a.2.0.0.nupkg"); string(content) != "a2" {
+		t.Errorf("expected new version restored, got %q", content)
+	}
+}
+
+func TestRestoreChecksumMismatch(t *testing.T) {
+	ctx := context.TODO()
+	nuget := inmemory.New()
+	nuget.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+
+	buf := &bytes.Buffer{}
+	Backup(ctx, buf, []Repository{{"nuget", nuget}}, nil)
+
+	// corrupt the archived file
+	corrupted := &bytes.Buffer{}
+	tr, tw := tar.NewReader(buf), tar.NewWriter(corrupted)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		tw.WriteHeader(hdr)
+		if strings.HasPrefix(hdr.Name, filesDir) {
+			tw.Write([]byte("xx"))
+		} else {
+			io.Copy(tw, tr)
+		}
+	}
+	tw.Close()
+
+	restored := inmemory.New()
+	if _, err := Restore(ctx, corrupted, []Repository{{"nuget", restored}}); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := restored.Stat(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err == nil {
+		t.Error("expected corrupted file deleted")
+	}
+}
+
+func TestRestorePathTraversalRejected(t *testing.T) {
+	for _, name := range []string{"files/nuget/../../../etc/x", "files/nuget/a/../../x", "files/nuget//x"} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		restored := inmemory.New()
+		if _, err := Restore(context.TODO(), buf, []Repository{{"nuget", restored}}); err == nil || !strings.Contains(err.Error(), "invalid path") {
+			t.Errorf("%s: expected invalid path, got %v", name, err)
+		}
+		if files, _ := walk(context.TODO(), restored); len(files) != 0 {
+			t.Errorf("%s: expected nothing restored, got %v", name, files)
+		}
+	}
+}
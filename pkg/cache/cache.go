@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/storage"
 )
 
 // Cache is a read-through cache that cache packages locally
@@ -27,16 +28,16 @@ type cache struct {
 	mu       sync.Mutex
 }
 
-
-// Read an file from the cache. If it does not exists, read it from loader and prime the cache
+// Read an file from the cache. If it does not exists, read it from loader and prime the cache. Cached files are
+// returned as a storage.File, so that they can be served with byte ranges.
 func (c *cache) Read(ctx context.Context, path string, loader func() (io.ReadCloser, error)) (io.ReadCloser, error) {
-	if rd, err := c.storage.Reader(ctx, path, 0); err == nil {
-		return rd, nil
+	if f, err := storage.Open(ctx, c.storage, path); err == nil {
+		return f, nil
 	}
 
 	// if we have an in-flight request for package, send another request and don't handle cache for this one
 	c.mu.Lock()
-	if _, ok := c.inflight[path]; ok {	
+	if _, ok := c.inflight[path]; ok {
 		c.mu.Unlock()
 		return loader()
 	}
@@ -53,21 +54,28 @@ func (c *cache) Read(ctx context.Context, path string, loader func() (io.ReadClo
 	if err != nil {
 		return nil, err
 	}
+	defer rd.Close()
 
 	wr, err := c.storage.Writer(ctx, path, false)
 	if err != nil {
 		return nil, err
 	}
 
+	// an incomplete or invalid file must not be served from the cache
 	_, err = io.Copy(wr, rd)
 	if err != nil {
+		wr.Cancel()
 		return nil, err
 	}
 
 	err = wr.Commit()
 	if err != nil {
+		wr.Close()
+		return nil, err
+	}
+	if err = wr.Close(); err != nil {
 		return nil, err
 	}
 
-	return c.storage.Reader(ctx, path, 0)
+	return storage.Open(ctx, c.storage, path)
 }
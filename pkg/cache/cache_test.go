@@ -8,6 +8,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/testdriver"
 )
 
@@ -68,3 +69,39 @@ func TestWhenInflightLoaderThenLoad(t *testing.T) {
 		return ioutil.NopCloser(bytes.NewBufferString("123456")), nil
 	})
 }
+
+type closeDriver struct {
+	driver.StorageDriver
+	closed int
+}
+
+func (d *closeDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	wr, err := d.StorageDriver.Writer(ctx, path, append)
+	return &closeWriter{wr, d}, err
+}
+
+type closeWriter struct {
+	driver.FileWriter
+	storage *closeDriver
+}
+
+func (w *closeWriter) Close() error {
+	w.storage.closed++
+	return w.FileWriter.Close()
+}
+
+func TestCachedWriterClosed(t *testing.T) {
+	s := &closeDriver{StorageDriver: testdriver.New()}
+	c := NewCache(s)
+
+	rd, err := c.Read(context.TODO(), "/abcdef", func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("123456")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if s.closed != 1 {
+		t.Errorf("expected the writer closed after commit, got %d closes", s.closed)
+	}
+}
@@ -1,12 +1,17 @@
 package cache
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/sirupsen/logrus"
 )
 
 // ErrHTTP is typically a 4xx and 5xx HTTP response.
@@ -19,82 +24,199 @@ func (e ErrHTTP) Error() string {
 	return e.Status
 }
 
-// Resource is a HTTP resource that cache responses. It currently only support ETag and does not support Cache-Control yet.
+// Resource is a HTTP resource that cache responses. It revalidates with ETag and Last-Modified and does not support Cache-Control yet.
 type Resource interface {
 	Get(ctx context.Context) (io.ReadCloser, bool, error)
-}
 
-// NewResource created a Resource for url that will use HTTP caching policy
-func NewResource(url string) Resource {
-	return &resource{
-		client: http.DefaultClient,
-		url:    url,
-	}
+	// GetFrom get the resource from the first of the equivalent urls that respond, and return the url used.
+	// The stored resource is only served when all urls fail.
+	GetFrom(ctx context.Context, urls []string) (io.ReadCloser, bool, string, error)
 }
 
 // NewResourceWithHTTPClient created a Resource for url that will use HTTP caching policy. It uses the provided http client.
+// The cached response is only kept in memory, use NewStoredResource to persist it.
 func NewResourceWithHTTPClient(client *http.Client, url string) Resource {
+	return NewStoredResource(client, url, inmemory.New(), "/resource")
+}
+
+// NewStoredResource created a Resource for url that persist the response body at path in storage, and the validators
+// (ETag, Last-Modified and fetch time) next to it. A stored resource is revalidated and served from a cold start.
+func NewStoredResource(client *http.Client, url string, storage driver.StorageDriver, path string) Resource {
 	return &resource{
-		client: client,
-		url:    url,
+		client:  client,
+		url:     url,
+		storage: storage,
+		path:    path,
 	}
 }
 
 var (
-	httpHeaderETag        = "Etag"
-	httpHeaderIfNoneMatch = "If-None-Match"
+	httpHeaderETag            = "Etag"
+	httpHeaderIfNoneMatch     = "If-None-Match"
+	httpHeaderLastModified    = "Last-Modified"
+	httpHeaderIfModifiedSince = "If-Modified-Since"
 )
 
+// validators are stored with the resource body to revalidate it after a restart
+type validators struct {
+	URL          string    `json:"url,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
 type resource struct {
-	client *http.Client
-	url    string
-	etag   string
-	cache  []byte
-	mu     sync.RWMutex
+	client     *http.Client
+	url        string
+	storage    driver.StorageDriver
+	path       string
+	validators *validators
+	mu         sync.Mutex
 }
 
 func (r *resource) Get(ctx context.Context) (io.ReadCloser, bool, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
-	if err != nil {
-		return nil, false, err
+	rd, updated, _, err := r.GetFrom(ctx, []string{r.url})
+	return rd, updated, err
+}
+
+// GetFrom is not serialized, concurrent requests download to their own temporary file. r.mu is only held to read the
+// validators and to move a response in place, with its validators.
+func (r *resource) GetFrom(ctx context.Context, urls []string) (io.ReadCloser, bool, string, error) {
+	var err error
+	for _, url := range urls {
+		var rsp *http.Response
+		if rsp, err = r.request(ctx, url); err != nil {
+			continue
+		}
+
+		rd, updated, err := r.store(ctx, url, rsp)
+		return rd, updated, url, err
 	}
 
-	r.mu.RLock()
-	etag := r.etag
-	cache := r.cache
-	r.mu.RUnlock()
+	rd, updated, err := r.stale(ctx, err)
+	return rd, updated, "", err
+}
 
-	if len(r.etag) > 0 {
-		req.Header.Add(httpHeaderIfNoneMatch, etag)
+// request send a conditional request, network errors and 5xx responses are returned as errors
+func (r *resource) request(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	rsp, err := r.client.Do(req)
+	r.mu.Lock()
+	v := *r.load(ctx)
+	r.mu.Unlock()
+
+	// validators of another mirror are not valid
+	if len(v.URL) == 0 || v.URL == url {
+		if len(v.ETag) > 0 {
+			req.Header.Add(httpHeaderIfNoneMatch, v.ETag)
+		}
+		if len(v.LastModified) > 0 {
+			req.Header.Add(httpHeaderIfModifiedSince, v.LastModified)
+		}
+	}
 
+	rsp, err := r.client.Do(req)
 	if err != nil {
-		return nil, false, err
+		return nil, err
+	}
+
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		rsp.Body.Close()
+		return nil, ErrHTTP{rsp.StatusCode, rsp.Status}
 	}
+	return rsp, nil
+}
+
+// store the response body and validators
+func (r *resource) store(ctx context.Context, url string, rsp *http.Response) (io.ReadCloser, bool, error) {
+	defer rsp.Body.Close()
 
 	if rsp.StatusCode == http.StatusNotModified {
-		return ioutil.NopCloser(bytes.NewReader(cache)), false, nil
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		v := *r.load(ctx)
+		v.Fetched = time.Now()
+		r.save(ctx, &v)
+		rd, err := r.storage.Reader(ctx, r.path, 0)
+		return rd, false, err
 	}
 
 	if rsp.StatusCode != http.StatusOK {
 		return nil, false, ErrHTTP{rsp.StatusCode, rsp.Status}
 	}
 
+	// write to a temporary file and move it in place, so that readers of the previous body are not truncated
+	tmp := fmt.Sprintf("%s.%d.download", r.path, time.Now().UnixNano())
+	wr, err := r.storage.Writer(ctx, tmp, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = io.Copy(wr, rsp.Body); err != nil {
+		wr.Cancel()
+		return nil, false, err
+	}
+	if err = wr.Commit(); err != nil {
+		return nil, false, err
+	}
+	wr.Close()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.etag = rsp.Header.Get(httpHeaderETag)
-
-	if len(r.etag) == 0 {
-		return rsp.Body, true, nil
+	if err = r.storage.Move(ctx, tmp, r.path); err != nil {
+		return nil, false, err
 	}
 
-	r.cache, err = ioutil.ReadAll(rsp.Body)
-	if err != nil {
+	r.save(ctx, &validators{
+		URL:          url,
+		ETag:         rsp.Header.Get(httpHeaderETag),
+		LastModified: rsp.Header.Get(httpHeaderLastModified),
+		Fetched:      time.Now(),
+	})
+
+	rd, err := r.storage.Reader(ctx, r.path, 0)
+	return rd, true, err
+}
+
+// stale serve the stored body when upstream is unavailable, or return err if nothing is stored
+func (r *resource) stale(ctx context.Context, err error) (io.ReadCloser, bool, error) {
+	rd, e := r.storage.Reader(ctx, r.path, 0)
+	if e != nil {
 		return nil, false, err
 	}
+	logrus.Warnf("serving stale %s: %v", r.path, err)
+	return rd, false, nil
+}
+
+// load the validators, from storage after a restart. Validators without a stored body are ignored. r.mu must be held.
+func (r *resource) load(ctx context.Context) *validators {
+	if r.validators != nil {
+		return r.validators
+	}
 
-	return ioutil.NopCloser(bytes.NewReader(r.cache)), true, nil
+	v := &validators{}
+	if _, err := r.storage.Stat(ctx, r.path); err == nil {
+		if buf, err := r.storage.GetContent(ctx, r.path+".meta"); err == nil {
+			json.Unmarshal(buf, v)
+		}
+	}
+	r.validators = v
+	return v
+}
+
+// save the validators, r.mu must be held
+func (r *resource) save(ctx context.Context, v *validators) {
+	r.validators = v
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err = r.storage.PutContent(ctx, r.path+".meta", buf); err != nil {
+		logrus.Errorf("unable to store validators for %s: %v", r.path, err)
+	}
 }
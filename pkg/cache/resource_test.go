@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
-	"github.com/fergusn/muzeum/internal/test"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver/testdriver"
+	"github.com/fergusn/muzeum/internal/test"
 )
 
 func TestNotModifiedReturnCacheddResource(t *testing.T) {
@@ -101,3 +104,99 @@ func TestModifiedUpdatesCache(t *testing.T) {
 		t.Errorf("expected cached resource %v, got %v", body, actual)
 	}
 }
+
+func TestStoredResourceRevalidatedAfterRestart(t *testing.T) {
+	etag := "abcdef"
+	body := []byte{1, 2, 3, 4}
+	s := testdriver.New()
+
+	client := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get(httpHeaderIfNoneMatch) == etag {
+			return &http.Response{StatusCode: http.StatusNotModified, Body: http.NoBody}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{httpHeaderETag: []string{etag}},
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+
+	url := "http://archive.ubuntu.com/ubuntu/dists/xenial/InRelease"
+	rsp1, updated, err := NewStoredResource(client, url, s, "/dists/xenial/InRelease").Get(context.TODO())
+	if err != nil || !updated {
+		t.Fatalf("first request should update the resource, got %v", err)
+	}
+	rsp1.Close()
+
+	rsp2, updated, err := NewStoredResource(client, url, s, "/dists/xenial/InRelease").Get(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp2.Close()
+
+	if updated {
+		t.Error("resource should be revalidated with the stored etag")
+	}
+	actual, err := ioutil.ReadAll(rsp2)
+	if err != nil || bytes.Compare(body, actual) != 0 {
+		t.Errorf("expected stored resource %v, got %v", body, actual)
+	}
+}
+
+func TestStoredResourceServedWhenUpstreamUnavailable(t *testing.T) {
+	s := testdriver.New()
+	s.PutContent(context.TODO(), "/dists/xenial/InRelease", []byte{1, 2, 3})
+
+	client := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	rsp, _, err := NewStoredResource(client, "http://archive.ubuntu.com/ubuntu/dists/xenial/InRelease", s, "/dists/xenial/InRelease").Get(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Close()
+
+	actual, _ := ioutil.ReadAll(rsp)
+	if bytes.Compare([]byte{1, 2, 3}, actual) != 0 {
+		t.Errorf("expected stale resource [1 2 3], got %v", actual)
+	}
+}
+
+func TestSlowUpstreamDoesNotBlockRequests(t *testing.T) {
+	blocked, release := make(chan struct{}), make(chan struct{})
+	first := true
+	client := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "slow.example.com" && first {
+			first = false
+			close(blocked)
+			<-release
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString(r.URL.Host))}, nil
+	})
+	res := NewResourceWithHTTPClient(client, "http://slow.example.com/InRelease")
+
+	done := make(chan error)
+	go func() {
+		rd, _, _, err := res.GetFrom(context.TODO(), []string{"http://slow.example.com/InRelease"})
+		if err == nil {
+			rd.Close()
+		}
+		done <- err
+	}()
+	<-blocked
+
+	rd, _, _, err := res.GetFrom(context.TODO(), []string{"http://fast.example.com/InRelease"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadAll(rd); string(buf) != "fast.example.com" {
+		t.Errorf("expected the response of the fast mirror, got %q", buf)
+	}
+	rd.Close()
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
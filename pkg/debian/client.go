@@ -2,81 +2,133 @@ package debian
 
 import (
 	"bytes"
-	"strings"
 	"context"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	pathpkg "path"
+	"strings"
 	"sync"
 
+	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/fergusn/muzeum/pkg/cache"
 	"github.com/fergusn/muzeum/pkg/model"
-)
-
-var (
-	httpClient = http.DefaultClient
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
 type client struct {
-	url      string
-	releases map[string]cache.Resource
-	indices  map[id]cache.Resource
-	packages map[string]*model.Package
+	http      *http.Client
+	endpoints *upstream.Endpoints
+	storage   driver.StorageDriver
+	resources map[string]cache.Resource // distribution metadata by path
+	mirrors   map[string]string         // the mirror that served the release of a distribution
+	packages  map[string]*model.Package // packages of all indices by filename
+	parsed    map[string]bool           // indices parsed since start
 
 	mu sync.RWMutex
 }
 
-type id struct {
-	name, version, arch string
+// NewClient initialize a new Debian client repository that use the http client of the upstream, see upstream.NewClient.
+// Release and index files are stored in storage, to revalidate them after a restart.
+func NewClient(hc *http.Client, url string, storage driver.StorageDriver) Repository {
+	return NewClientWithHTTPClient(hc, upstream.NewEndpoints([]string{url}, false), storage)
+}
+
+// NewClientWithHTTPClient initialize a new Debian client repository for equivalent mirrors that use the provided http client.
+// The indices of a distribution are read from the mirror that served its release, to avoid mismatched hashes.
+func NewClientWithHTTPClient(hc *http.Client, endpoints *upstream.Endpoints, storage driver.StorageDriver) Repository {
+	return newClient(hc, endpoints, storage)
 }
 
-// NewClient initialize a new Debian client repository
-func NewClient(url string) Repository {
+func newClient(hc *http.Client, endpoints *upstream.Endpoints, storage driver.StorageDriver) *client {
 	return &client{
-		url:      url,
-		releases: map[string]cache.Resource{},
-		indices:  map[id]cache.Resource{},
-		packages: map[string]*model.Package{},
+		http:      hc,
+		endpoints: endpoints,
+		storage:   storage,
+		resources: map[string]cache.Resource{},
+		mirrors:   map[string]string{},
+		packages:  map[string]*model.Package{},
+		parsed:    map[string]bool{},
 	}
 }
 
 // Release get the InRelease file for the distrubution, using etag to optimize
 func (c *client) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	return c.pin(ctx, dist, concat("dists", dist, "InRelease"))
+}
+
+// Metadata get a file of the distribution from the mirror that served the release, using etag to optimize
+func (c *client) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	path := concat("dists", dist, file)
+	if file == "Release" {
+		return c.pin(ctx, dist, path)
+	}
+
+	rd, _, _, err := c.resource(path).GetFrom(ctx, urls(c.release(dist), path))
+	return rd, err
+}
+
+// resource return the stored resource for a distribution metadata path
+func (c *client) resource(path string) cache.Resource {
 	c.mu.RLock()
-	r, ok := c.releases[dist]
+	r, ok := c.resources[path]
 	c.mu.RUnlock()
 
 	if !ok {
-		r = cache.NewResourceWithHTTPClient(httpClient, concat(c.url, "dists", dist, "InRelease"))
-
 		c.mu.Lock()
-		c.releases[dist] = r
+		if r, ok = c.resources[path]; !ok {
+			r = cache.NewStoredResource(c.http, concat(c.endpoints.Primary(), path), c.storage, "/"+path)
+			c.resources[path] = r
+		}
 		c.mu.Unlock()
 	}
+	return r
+}
+
+// pin get a release file from the first mirror that respond, and read the distribution metadata from that mirror
+func (c *client) pin(ctx context.Context, dist, path string) (io.ReadCloser, error) {
+	mirrors := c.endpoints.URLs()
+	rd, _, url, err := c.resource(path).GetFrom(ctx, urls(mirrors, path))
+
+	for _, mirror := range mirrors {
+		if url == concat(mirror, path) {
+			c.mu.Lock()
+			c.mirrors[dist] = mirror
+			c.mu.Unlock()
+			break
+		}
+		if len(url) > 0 {
+			c.endpoints.Failed(mirror)
+		}
+	}
 
-	rd, _, err := r.Get(context.TODO())
 	return rd, err
 }
 
-// Index get the package index for the distribution/component/architecture, using etag to optimize
+// Index get the package index for the distribution/component/architecture, using etag to optimize.
+// The packages of the index are added to the packages of all other indices when it changed or was not parsed since start.
 func (c *client) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
-	c.mu.RLock()
-	rc, exist := c.indices[id{dist, comp, arch}]
-	c.mu.RUnlock()
+	return c.index(ctx, dist, concat("dists", dist, comp, "binary-"+arch, "Packages."+compression), compression, binaryFiles)
+}
 
-	if !exist {
-		c.mu.Lock()
-		rc = cache.NewResourceWithHTTPClient(httpClient, concat(c.url, "dists", dist, comp, "binary-"+arch, "Packages."+compression))
-		c.indices[id{dist, comp, arch}] = rc
-		c.mu.Unlock()
-	}
+// Sources get the source package index for the distribution/component, using etag to optimize.
+// The files of every source package (.dsc, .orig.tar.*, .debian.tar.*) are added to the packages like binary packages.
+func (c *client) Sources(ctx context.Context, dist, comp, compression string) (io.ReadCloser, error) {
+	return c.index(ctx, dist, concat("dists", dist, comp, "source", "Sources."+compression), compression, sourceFiles)
+}
 
-	r, updated, err := rc.Get(ctx)
+// index read an index from the release mirror, and parse the files of each paragraph into the packages
+func (c *client) index(ctx context.Context, dist, path, compression string, files func(Paragraph) map[string]*model.Package) (io.ReadCloser, error) {
+	r, updated, _, err := c.resource(path).GetFrom(ctx, urls(c.release(dist), path))
 	if err != nil {
 		return nil, err
 	}
-	if !updated {
+
+	c.mu.RLock()
+	parsed := c.parsed[path]
+	c.mu.RUnlock()
+	if !updated && parsed {
 		return r, nil
 	}
 
@@ -84,42 +136,148 @@ func (c *client) Index(ctx context.Context, dist, comp, arch, compression string
 	r.Close()
 
 	gz, err := decompress(bytes.NewReader(buf), compression)
+	if err != nil {
+		log.Printf("unable to read package index %s: %v", path, err)
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
 
 	rd := NewControlFileReader(gz)
 
 	px := map[string]*model.Package{}
 	for {
-		if pkg, more := rd.Read(); more {
-			px[pkg.Filename()] = &model.Package{
-				Type:    "debian",
-				Name:    pkg.Package(),
-				Version: pkg.Version(),
+		if par, more := rd.Read(); more {
+			for filename, pkg := range files(par) {
+				px[filename] = pkg
 			}
 		} else {
 			break
 		}
 	}
 	c.mu.Lock()
-	c.packages = px
+	for filename, pkg := range px {
+		c.packages[filename] = pkg
+	}
+	c.parsed[path] = true
 	c.mu.Unlock()
 
 	return ioutil.NopCloser(bytes.NewReader(buf)), nil
 }
 
+// File read a pool file from the first mirror that has it. Pool files are verified by apt, so any mirror can serve it.
 func (c *client) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
-	rsp, err := httpClient.Get(concat(c.url, path))
-
+	var (
+		rsp *http.Response
+		err error
+	)
+	for _, mirror := range c.endpoints.URLs() {
+		if rsp, err = c.get(ctx, concat(mirror, path)); err != nil {
+			c.endpoints.Failed(mirror)
+			continue
+		}
+		if rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			err = cache.ErrHTTP{StatusCode: rsp.StatusCode, Status: rsp.Status}
+			if rsp.StatusCode >= http.StatusInternalServerError {
+				c.endpoints.Failed(mirror)
+			}
+			continue
+		}
+		break
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return rsp.Body, c.Package(path), nil
+}
+
+// Package return the package of a pool file from the parsed indices, or from the file name when no index lists it
+func (c *client) Package(path string) *model.Package {
+	c.mu.RLock()
+	pkg, ok := c.packages[strings.TrimLeft(path, "/")]
+	c.mu.RUnlock()
+
+	if ok {
+		return pkg
+	}
+	if pkg = parseFilename(path); pkg == nil {
+		log.Printf("no package index for path %s", path)
+	}
+	return pkg
+}
+
+// release return the mirror that served the release of dist, or all mirrors if the release was not read yet
+func (c *client) release(dist string) []string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if pkg, ok := c.packages[strings.TrimLeft(path, "/")]; ok {
-		return rsp.Body, pkg, nil
+	if mirror, ok := c.mirrors[dist]; ok {
+		return []string{mirror}
+	}
+	return c.endpoints.URLs()
+}
+
+// get a file from upstream, the request is canceled with the request of the client
+func (c *client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+func urls(mirrors []string, path string) []string {
+	xs := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		xs[i] = concat(mirror, path)
+	}
+	return xs
+}
+
+// Snapshot read a file of a distribution from a snapshot in storage, snapshots are never read from upstream
+func (c *client) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	return readSnapshot(ctx, c.storage, snapshot, dist, file)
+}
+
+// Upload is not supported by proxy repositories
+func (c *client) Upload(ctx context.Context, filename string, rd io.Reader) (*model.Package, error) {
+	return nil, errReadOnly
+}
+
+// ByHash resolve the hash from the stored InRelease, and read the file from the by-hash path of the release mirror.
+// When upstream does not support by-hash, the file is read by its name. The content is verified with the hash.
+func (c *client) ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error) {
+	if algorithm != "SHA256" && algorithm != "SHA512" {
+		return nil, errAlgorithm
+	}
+
+	buf, err := c.storage.GetContent(ctx, "/"+concat("dists", dist, "InRelease"))
+	if err != nil {
+		return nil, cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "no release for " + dist}
 	}
 
-	log.Printf("no package index for path %s", path)
-	return rsp.Body, nil, nil
+	var name string
+	for _, sum := range ParseRelease(buf).Checksums(algorithm) {
+		if sum.Hash == hash && pathpkg.Dir(sum.Path) == strings.Trim(dir, "/") {
+			name = sum.Path
+			break
+		}
+	}
+	if len(name) == 0 {
+		return nil, cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "hash not in release of " + dist}
+	}
+
+	var rsp *http.Response
+	for _, path := range []string{concat("dists", dist, dir, "by-hash", algorithm, hash), concat("dists", dist, name)} {
+		for _, mirror := range c.release(dist) {
+			if rsp, err = c.get(ctx, concat(mirror, path)); err == nil && rsp.StatusCode == http.StatusOK {
+				return verify(rsp.Body, algorithm, hash)
+			}
+			if err == nil {
+				rsp.Body.Close()
+				err = cache.ErrHTTP{StatusCode: rsp.StatusCode, Status: rsp.Status}
+			}
+		}
+	}
+	return nil, err
 }
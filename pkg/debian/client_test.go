@@ -2,7 +2,11 @@ package debian
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,13 +14,15 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
 	"github.com/fergusn/muzeum/internal/test"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
 func TestReleaseGetFromUpstreamHttpRepository(t *testing.T) {
 	inrelease := []byte{1, 2, 3, 4, 5}
 
-	httpClient = test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
 		if r.URL.Path == "/ubuntu/dists/bionic/InRelease" {
 			return &http.Response{
 				StatusCode: http.StatusOK,
@@ -26,7 +32,7 @@ func TestReleaseGetFromUpstreamHttpRepository(t *testing.T) {
 		return &http.Response{StatusCode: http.StatusNotFound}, nil
 	})
 
-	c := NewClient("http://archive.ubuntu.com/ubuntu")
+	c := NewClient(httpClient, "http://archive.ubuntu.com/ubuntu", inmemory.New())
 
 	rd, err := c.Release(context.TODO(), "bionic")
 
@@ -45,7 +51,7 @@ func TestReleaseGetFromUpstreamHttpRepository(t *testing.T) {
 }
 
 func TestIndexReadsPackageMetadata(t *testing.T) {
-	httpClient = test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
 		if r.URL.Path == "/apt/dists/kubernetes-xenial/main/binary-amd64/Packages.gz" {
 			return &http.Response{
 				StatusCode: http.StatusOK,
@@ -55,7 +61,7 @@ func TestIndexReadsPackageMetadata(t *testing.T) {
 		return &http.Response{StatusCode: http.StatusNotFound}, nil
 	})
 
-	c := NewClient("https://packages.cloud.google.com/apt")
+	c := NewClient(httpClient, "https://packages.cloud.google.com/apt", inmemory.New())
 
 	_, err := c.Index(context.TODO(), "kubernetes-xenial", "main", "amd64", "gz")
 
@@ -69,6 +75,71 @@ func TestIndexReadsPackageMetadata(t *testing.T) {
 	}
 }
 
+func TestIndexKeepsPackagesOfOtherIndices(t *testing.T) {
+	arm64 := &bytes.Buffer{}
+	gz := gzip.NewWriter(arm64)
+	gz.Write([]byte("Package: kubectl\nVersion: 1.18.0-00\nArchitecture: arm64\nFilename: pool/kubectl_1.18.0-00_arm64.deb\n"))
+	gz.Close()
+
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/apt/dists/kubernetes-xenial/main/binary-amd64/Packages.gz":
+			return &http.Response{StatusCode: http.StatusOK, Body: read(t, "Packages.gz")}, nil
+		case "/apt/dists/kubernetes-xenial/main/binary-arm64/Packages.gz":
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(arm64.Bytes()))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	})
+
+	c := NewClient(httpClient, "https://packages.cloud.google.com/apt", inmemory.New())
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		if _, err := c.Index(context.TODO(), "kubernetes-xenial", "main", arch, "gz"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pkg := c.(*client).Package("/pool/cri-tools_1.11.0-00_amd64_768e5551f9badfde12b10c42c88afb45c412c1bf307a5985a4b29f4499d341bd.deb"); pkg == nil || pkg.Qualifiers["arch"] != "amd64" {
+		t.Errorf("amd64 packages should be kept, got %v", pkg)
+	}
+	if pkg := c.(*client).Package("/pool/kubectl_1.18.0-00_arm64.deb"); pkg == nil || pkg.Version != "1.18.0-00" || pkg.Qualifiers["arch"] != "arm64" {
+		t.Errorf("arm64 packages should be loaded, got %v", pkg)
+	}
+}
+
+func TestIndexParsedAfterRestart(t *testing.T) {
+	s := inmemory.New()
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("If-None-Match") == "v1" {
+			return &http.Response{StatusCode: http.StatusNotModified, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Etag": {"v1"}}, Body: read(t, "Packages.gz")}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		c := NewClient(httpClient, "https://packages.cloud.google.com/apt", s)
+
+		if _, err := c.Index(context.TODO(), "kubernetes-xenial", "main", "amd64", "gz"); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.(*client).packages) == 0 {
+			t.Errorf("packages should be loaded from the stored index on start %d", i)
+		}
+	}
+}
+
+func TestPackageFromFilename(t *testing.T) {
+	c := NewClient(http.DefaultClient, "http://archive.ubuntu.com/ubuntu", inmemory.New()).(*client)
+
+	pkg := c.Package("/pool/main/s/systemd/systemd_237-3ubuntu10%3a1_amd64.deb")
+	if pkg == nil || pkg.Name != "systemd" || pkg.Version != "237-3ubuntu10:1" || pkg.Qualifiers["arch"] != "amd64" {
+		t.Errorf("expected package from file name, got %v", pkg)
+	}
+	if pkg = c.Package("/pool/main/s/systemd/systemd_237.orig.tar.gz"); pkg != nil {
+		t.Errorf("expected no package for source files, got %v", pkg)
+	}
+}
+
 func read(t *testing.T, name string) io.ReadCloser {
 	f, err := os.Open(filepath.Join("testdata", name))
 	if err != nil {
@@ -76,3 +147,129 @@ func read(t *testing.T, name string) io.ReadCloser {
 	}
 	return f
 }
+
+func TestFileNotFoundUpstream(t *testing.T) {
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody}, nil
+	})
+
+	c := NewClient(httpClient, "http://archive.ubuntu.com/ubuntu", inmemory.New())
+
+	_, _, err := c.File(context.TODO(), "/pool/main/a/abc/abc_1.0_amd64.deb")
+
+	if status(err) != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestIndexReadFromReleaseMirror(t *testing.T) {
+	down := true
+	hosts := []string{}
+
+	client := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		if r.URL.Host == "a.example" && down {
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody}, nil
+		}
+		if r.URL.Path == "/apt/dists/kubernetes-xenial/main/binary-amd64/Packages.gz" {
+			return &http.Response{StatusCode: http.StatusOK, Body: read(t, "Packages.gz")}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte{1}))}, nil
+	})
+
+	endpoints := upstream.NewEndpoints([]string{"http://a.example/apt", "http://b.example/apt"}, false)
+	c := NewClientWithHTTPClient(client, endpoints, inmemory.New())
+
+	if _, err := c.Release(context.TODO(), "kubernetes-xenial"); err != nil {
+		t.Fatal(err)
+	}
+
+	down = false
+	hosts = []string{}
+	if _, err := c.Index(context.TODO(), "kubernetes-xenial", "main", "amd64", "gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || hosts[0] != "b.example" {
+		t.Errorf("index should be read from the release mirror b.example, got %v", hosts)
+	}
+}
+
+func TestByHashResolvedFromRelease(t *testing.T) {
+	index, _ := ioutil.ReadAll(read(t, "Packages.gz"))
+	sum := sha256.Sum256(index)
+	hash := hex.EncodeToString(sum[:])
+
+	s := inmemory.New()
+	s.PutContent(context.TODO(), "/dists/kubernetes-xenial/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hash, len(index))))
+
+	requested := []string{}
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path == "/apt/dists/kubernetes-xenial/main/binary-amd64/Packages.gz" {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(index))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	})
+	c := NewClient(httpClient, "https://packages.cloud.google.com/apt", s)
+
+	if _, err := c.ByHash(context.TODO(), "kubernetes-xenial", "main/binary-amd64", "SHA256", "0000"); status(err) != http.StatusNotFound {
+		t.Errorf("hash not in release should not be found, got %v", err)
+	}
+
+	rd, err := c.ByHash(context.TODO(), "kubernetes-xenial", "main/binary-amd64", "SHA256", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	actual, err := ioutil.ReadAll(rd)
+	if err != nil || bytes.Compare(actual, index) != 0 {
+		t.Errorf("expected index by hash, got %v", err)
+	}
+	if requested[0] != "/apt/dists/kubernetes-xenial/main/binary-amd64/by-hash/SHA256/"+hash {
+		t.Errorf("expected by-hash path requested first, got %v", requested)
+	}
+}
+
+func TestByHashChecksumMismatch(t *testing.T) {
+	s := inmemory.New()
+	s.PutContent(context.TODO(), "/dists/bionic/InRelease", []byte("SHA256:\n abcd 4 main/binary-amd64/Packages.gz\n"))
+
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte{1, 2, 3, 4}))}, nil
+	})
+	c := NewClient(httpClient, "http://archive.ubuntu.com/ubuntu", s)
+
+	rd, err := c.ByHash(context.TODO(), "bionic", "main/binary-amd64", "SHA256", "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rd); err != errChecksum {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestSourcesAttributeSourceFiles(t *testing.T) {
+	sources := &bytes.Buffer{}
+	gz := gzip.NewWriter(sources)
+	gz.Write([]byte("Package: hello\nVersion: 2.10-2\nDirectory: pool/main/h/hello\nFiles:\n 0123 1 hello_2.10-2.dsc\n 4567 2 hello_2.10.orig.tar.gz\n"))
+	gz.Close()
+
+	httpClient := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/ubuntu/dists/bionic/main/source/Sources.gz" {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(sources.Bytes()))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	})
+
+	c := NewClient(httpClient, "http://archive.ubuntu.com/ubuntu", inmemory.New())
+	if _, err := c.Sources(context.TODO(), "bionic", "main", "gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := c.(*client).Package("/pool/main/h/hello/hello_2.10.orig.tar.gz")
+	if pkg == nil || pkg.Name != "hello" || pkg.Version != "2.10-2" || pkg.Qualifiers["arch"] != "source" {
+		t.Errorf("expected source package of orig tarball, got %v", pkg)
+	}
+}
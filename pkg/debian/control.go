@@ -3,6 +3,7 @@ package debian
 import (
 	"bufio"
 	"io"
+	"sort"
 	"strings"
 )
 
@@ -19,6 +20,21 @@ func (p Paragraph) Package() string {
 	return p["Package"]
 }
 
+// Architecture return the 'Architecture' field value from the paragraph
+func (p Paragraph) Architecture() string {
+	return p["Architecture"]
+}
+
+// Source return the 'Source' field value from the paragraph, e.g. of a .dsc or .changes file
+func (p Paragraph) Source() string {
+	return p["Source"]
+}
+
+// Directory return the 'Directory' field value from a Sources paragraph
+func (p Paragraph) Directory() string {
+	return p["Directory"]
+}
+
 // Filename return the 'Filename' field value from the paragraph
 func (p Paragraph) Filename() string {
 	return p["Filename"]
@@ -43,15 +59,51 @@ func (r *ControlFileReader) Read() (par Paragraph, ok bool) {
 		if len(ln) == 0 {
 			break
 		} else if ln[0] == '#' {
-			continue	
+			continue
 		} else if ln[0] == ' ' || ln[0] == '\t' {
 			par[key] += "\n" + strings.TrimLeft(ln, " \t")
-		} else {
-			kv := strings.SplitN(ln, ":", 2)
+		} else if kv := strings.SplitN(ln, ":", 2); len(kv) == 2 {
 			key = kv[0]
 			par[key] = strings.TrimSpace(kv[1])
+		} else {
+			continue
 		}
 		ok = true
 	}
 	return
 }
+
+// WriteTo write the paragraph in control file format, the Package field first and other fields sorted by name.
+// Multiline values are continued on lines that start with a space, and empty lines are written as " .".
+func (p Paragraph) WriteTo(w io.Writer) (int64, error) {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		if key != "Package" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := p["Package"]; ok {
+		keys = append([]string{"Package"}, keys...)
+	}
+
+	var sb strings.Builder
+	for _, key := range keys {
+		lines := strings.Split(p[key], "\n")
+		sb.WriteString(key + ":")
+		if len(lines[0]) > 0 {
+			sb.WriteString(" " + lines[0])
+		}
+		sb.WriteString("\n")
+		for _, ln := range lines[1:] {
+			if len(ln) == 0 {
+				ln = "."
+			}
+			sb.WriteString(" " + ln + "\n")
+		}
+	}
+	sb.WriteString("\n")
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
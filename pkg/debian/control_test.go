@@ -1,6 +1,7 @@
 package debian
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -48,4 +49,14 @@ func TestMultilineField(t *testing.T) {
 		t.Errorf("descriptions expected 'the first line\nthe second line\nthe third line' got %v", p1["Description"])
 	}
 
-}
\ No newline at end of file
+}
+func TestParagraphWriteTo(t *testing.T) {
+	par := Paragraph{"Version": "1.0", "Package": "hello", "Files": "\n0123 1 hello.dsc\n\n4567 2 hello.tar.gz"}
+	buf := &bytes.Buffer{}
+	par.WriteTo(buf)
+
+	expected := "Package: hello\nFiles:\n 0123 1 hello.dsc\n .\n 4567 2 hello.tar.gz\nVersion: 1.0\n\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
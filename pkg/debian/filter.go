@@ -0,0 +1,374 @@
+package debian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	pathpkg "path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/cache"
+	"github.com/fergusn/muzeum/pkg/model"
+)
+
+var (
+	// packagesIndex match the path of a Packages index in a Release, e.g. main/debian-installer/binary-amd64/Packages.xz
+	packagesIndex = regexp.MustCompile(`^(.+)/binary-([^/]+)/(Packages(?:\.[a-z0-9]+)?)$`)
+
+	// filtered indices are recomputed periodically, so that versions leave quarantine
+	refresh = time.Hour
+
+	errFiltered = cache.ErrHTTP{StatusCode: http.StatusForbidden, Status: "package is filtered by the repository policy"}
+	errNoIndex  = cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "index is not available"}
+)
+
+// seen record when each pool file was listed in an index for the first time
+type seen struct {
+	Indices map[string]bool      `json:"indices"`
+	Files   map[string]time.Time `json:"files"`
+}
+
+// filteredIndex is a Packages index without the packages that are not allowed
+type filteredIndex struct {
+	upstream    string // sha256 of the upstream index
+	compression string // of the upstream index
+	created     time.Time
+	plain       []byte
+	gz          []byte
+}
+
+// indexed is implemented by repositories that know the package of a pool file from their indices
+type indexed interface {
+	Package(path string) *model.Package
+}
+
+type filtered struct {
+	Repository
+	storage driver.StorageDriver
+	policy  Policy
+	indices map[string]*filteredIndex
+	seen    *seen
+	mu      sync.Mutex
+}
+
+// NewFiltered remove the packages that are not allowed by policy from the Packages indices of repo, and rewrite the
+// checksums of the indices in the Release. The Release is not signed, repo must be signed with NewSigned.
+// Pool files of packages that are not allowed are forbidden.
+func NewFiltered(repo Repository, storage driver.StorageDriver, policy Policy) Repository {
+	return &filtered{
+		Repository: repo,
+		storage:    storage,
+		policy:     policy,
+		indices:    map[string]*filteredIndex{},
+	}
+}
+
+func (f *filtered) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	rd, err := f.Repository.Release(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+	return f.release(ctx, rd, "", dist, func(comp, arch, compression string) (io.ReadCloser, error) {
+		return f.Repository.Index(ctx, dist, comp, arch, compression)
+	})
+}
+
+func (f *filtered) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
+	return f.serve(ctx, "", dist, comp, arch, "Packages."+compression, func(comp, arch, compression string) (io.ReadCloser, error) {
+		return f.Repository.Index(ctx, dist, comp, arch, compression)
+	})
+}
+
+func (f *filtered) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	switch file {
+	case "Release":
+		return f.Release(ctx, dist)
+	case "Release.gpg":
+		return nil, errUnsigned // the upstream signature does not match the filtered release
+	}
+	if m := packagesIndex.FindStringSubmatch(file); m != nil {
+		return f.serve(ctx, "", dist, m[1], m[2], m[3], func(comp, arch, compression string) (io.ReadCloser, error) {
+			return f.Repository.Index(ctx, dist, comp, arch, compression)
+		})
+	}
+	return f.Repository.Metadata(ctx, dist, file)
+}
+
+// ByHash is not supported for the filtered indices, the Release does not enable it
+func (f *filtered) ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error) {
+	if strings.Contains(dir, "binary-") {
+		return nil, errNoIndex
+	}
+	return f.Repository.ByHash(ctx, dist, dir, algorithm, hash)
+}
+
+// Snapshot filter the indices of a snapshot like the indices of the distribution, with the current policy
+func (f *filtered) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	name, err := resolveSnapshot(ctx, f.storage, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	read := func(comp, arch, compression string) (io.ReadCloser, error) {
+		return f.Repository.Snapshot(ctx, name, dist, concat(comp, "binary-"+arch, "Packages."+compression))
+	}
+	prefix := concat("snapshot", name)
+
+	switch file {
+	case "InRelease", "Release":
+		rd, err := f.Repository.Snapshot(ctx, name, dist, file)
+		if err != nil {
+			return nil, err
+		}
+		return f.release(ctx, rd, prefix, dist, read)
+	case "Release.gpg":
+		return nil, errUnsigned
+	}
+	if m := packagesIndex.FindStringSubmatch(file); m != nil {
+		return f.serve(ctx, prefix, dist, m[1], m[2], m[3], read)
+	}
+	if strings.Contains(file, "binary-") && strings.Contains(file, "/by-hash/") {
+		return nil, errNoIndex
+	}
+	return f.Repository.Snapshot(ctx, name, dist, file)
+}
+
+// File forbid pool files of packages that are not allowed. The version of a package, with its epoch, is read from the
+// indices when the repository know them.
+func (f *filtered) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	if pkg := parseFilename(path); pkg != nil {
+		if repo, ok := f.Repository.(indexed); ok {
+			pkg = repo.Package(path)
+		}
+
+		f.mu.Lock()
+		s := f.load(ctx)
+		at := s.Files[strings.TrimLeft(path, "/")]
+		f.mu.Unlock()
+
+		if !f.policy.Allowed(pkg.Name, pkg.Version, at) {
+			return nil, nil, errFiltered
+		}
+	}
+	return f.Repository.File(ctx, path)
+}
+
+// release remove the upstream Packages indices from a release, and add the checksums of the filtered indices. Only the
+// indices that changed upstream, or were filtered more than refresh ago, are read and filtered again.
+func (f *filtered) release(ctx context.Context, rd io.ReadCloser, prefix, dist string, read func(comp, arch, compression string) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	buf, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rel := ParseRelease(buf)
+	delete(rel, "Acquire-By-Hash") // by-hash would serve the upstream indices
+
+	dirs := map[string]bool{}
+	upstream := map[string]map[string]string{} // the sha256 of the upstream indices of a directory, by compression
+	for _, field := range []string{"MD5Sum", "SHA1", "SHA256", "SHA512"} {
+		if _, ok := rel[field]; !ok {
+			continue
+		}
+		var sums strings.Builder
+		for _, sum := range rel.Checksums(field) {
+			if m := packagesIndex.FindStringSubmatch(sum.Path); m != nil {
+				dir := concat(m[1], "binary-"+m[2])
+				dirs[dir] = true
+				if field == "SHA256" {
+					if upstream[dir] == nil {
+						upstream[dir] = map[string]string{}
+					}
+					upstream[dir][strings.TrimPrefix(pathpkg.Ext(m[3]), ".")] = sum.Hash
+				}
+				continue
+			}
+			fmt.Fprintf(&sums, "\n%s %d %s", sum.Hash, sum.Size, sum.Path)
+		}
+		rel[field] = sums.String()
+	}
+
+	var sums strings.Builder
+	for _, dir := range keys(dirs) {
+		m := packagesIndex.FindStringSubmatch(concat(dir, "Packages"))
+		checksums := upstream[dir]
+		if checksums == nil {
+			checksums = map[string]string{} // no checksum to compare, filter again
+		}
+		idx, err := f.index(ctx, prefix, dist, m[1], m[2], checksums, read)
+		if err != nil {
+			log.Printf("unable to filter index %s of %s: %v", dir, dist, err)
+			continue
+		}
+		for name, content := range map[string][]byte{"Packages": idx.plain, "Packages.gz": idx.gz} {
+			sum := sha256.Sum256(content)
+			fmt.Fprintf(&sums, "\n%s %d %s", hex.EncodeToString(sum[:]), len(content), concat(dir, name))
+		}
+	}
+	rel["SHA256"] += sums.String()
+
+	msg := &bytes.Buffer{}
+	rel.WriteTo(msg)
+	return ioutil.NopCloser(msg), nil
+}
+
+// serve a filtered index, only uncompressed and gzip indices are listed in the Release. The index that was filtered for
+// the last Release is served, so that it match the checksum in the Release.
+func (f *filtered) serve(ctx context.Context, prefix, dist, comp, arch, name string, read func(comp, arch, compression string) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if name != "Packages" && name != "Packages.gz" {
+		return nil, errNoIndex
+	}
+	idx, err := f.index(ctx, prefix, dist, comp, arch, nil, read)
+	if err != nil {
+		return nil, err
+	}
+	if name == "Packages" {
+		return ioutil.NopCloser(bytes.NewReader(idx.plain)), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(idx.gz)), nil
+}
+
+// index filter the upstream index when it changed or was filtered more than refresh ago. The upstream index is not
+// read when the filtered index is recent, and upstream has the checksum of the filtered index or is nil. Indices of a
+// snapshot are cached under the prefix of the snapshot, but share the seen files with the distribution.
+func (f *filtered) index(ctx context.Context, prefix, dist, comp, arch string, upstream map[string]string, read func(comp, arch, compression string) (io.ReadCloser, error)) (*filteredIndex, error) {
+	path := concat("dists", dist, comp, "binary-"+arch, "Packages")
+	key := path
+	if len(prefix) > 0 {
+		key = concat(prefix, path)
+	}
+
+	f.mu.Lock()
+	idx, ok := f.indices[key]
+	f.mu.Unlock()
+	if ok && time.Since(idx.created) < refresh && (upstream == nil || upstream[idx.compression] == idx.upstream) {
+		return idx, nil
+	}
+
+	var (
+		rd  io.ReadCloser
+		err error
+		alg string
+	)
+	for _, alg = range []string{"xz", "gz"} {
+		if rd, err = read(comp, arch, alg); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf)
+	checksum := hex.EncodeToString(sum[:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if idx, ok := f.indices[key]; ok && idx.upstream == checksum && time.Since(idx.created) < refresh {
+		return idx, nil
+	}
+
+	data, err := decompress(bytes.NewReader(buf), alg)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = ioutil.ReadAll(data); err != nil {
+		return nil, err
+	}
+
+	idx = &filteredIndex{upstream: checksum, compression: alg, created: time.Now()}
+	idx.plain = f.filter(ctx, path, buf)
+
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	zw.Write(idx.plain)
+	zw.Close()
+	idx.gz = gz.Bytes()
+
+	f.indices[key] = idx
+	return idx, nil
+}
+
+// filter the paragraphs of an index, and record when the files are seen. The files of an index that was never seen
+// before are considered old, so that a new repository does not quarantine all packages.
+func (f *filtered) filter(ctx context.Context, path string, index []byte) []byte {
+	s := f.load(ctx)
+	known := s.Indices[path]
+	s.Indices[path] = true
+	changed := !known
+
+	out := &bytes.Buffer{}
+	for _, raw := range bytes.Split(index, []byte("\n\n")) {
+		par, ok := NewControlFileReader(bytes.NewReader(raw)).Read()
+		if !ok {
+			continue
+		}
+
+		filename := par.Filename()
+		at, ok := s.Files[filename]
+		if !ok {
+			if known {
+				at = time.Now()
+			}
+			s.Files[filename] = at
+			changed = true
+		}
+
+		if f.policy.Allowed(par.Package(), par.Version(), at) {
+			out.Write(bytes.Trim(raw, "\n"))
+			out.WriteString("\n\n")
+		}
+	}
+
+	if changed {
+		f.save(ctx)
+	}
+	return out.Bytes()
+}
+
+// load the seen files from storage once, f.mu must be held
+func (f *filtered) load(ctx context.Context) *seen {
+	if f.seen != nil {
+		return f.seen
+	}
+
+	f.seen = &seen{Indices: map[string]bool{}, Files: map[string]time.Time{}}
+	if buf, err := f.storage.GetContent(ctx, "/policy/seen.json"); err == nil {
+		if err = json.Unmarshal(buf, f.seen); err != nil {
+			log.Printf("unable to read seen packages: %v", err)
+		}
+	}
+	if f.seen.Indices == nil || f.seen.Files == nil {
+		f.seen = &seen{Indices: map[string]bool{}, Files: map[string]time.Time{}}
+	}
+	return f.seen
+}
+
+// save the seen files, f.mu must be held
+func (f *filtered) save(ctx context.Context) {
+	buf, err := json.Marshal(f.seen)
+	if err == nil {
+		err = f.storage.PutContent(ctx, "/policy/seen.json", buf)
+	}
+	if err != nil {
+		log.Printf("unable to store seen packages: %v", err)
+	}
+}
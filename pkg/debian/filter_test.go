@@ -0,0 +1,228 @@
+package debian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/model"
+)
+
+type packagesRepository struct {
+	Repository
+	index   string
+	release string
+	reads   int
+	storage driver.StorageDriver // of the snapshots
+}
+
+func (r *packagesRepository) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	if len(r.release) > 0 {
+		return ioutil.NopCloser(strings.NewReader(r.release)), nil
+	}
+	return ioutil.NopCloser(strings.NewReader("Suite: bionic\nAcquire-By-Hash: yes\nSHA256:\n" +
+		" 1111 10 main/binary-amd64/Packages.xz\n 2222 20 main/binary-amd64/Packages.gz\n 3333 30 main/i18n/Translation-en\n")), nil
+}
+
+func (r *packagesRepository) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
+	if compression != "gz" {
+		return nil, errNoIndex
+	}
+	r.reads++
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(r.index))
+	gz.Close()
+	return ioutil.NopCloser(buf), nil
+}
+
+func (r *packagesRepository) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	return ioutil.NopCloser(strings.NewReader(path)), parseFilename(path), nil
+}
+
+func (r *packagesRepository) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	return readSnapshot(ctx, r.storage, snapshot, dist, file)
+}
+
+func (r *packagesRepository) Package(path string) *model.Package {
+	rd := NewControlFileReader(strings.NewReader(r.index))
+	for par, more := rd.Read(); more; par, more = rd.Read() {
+		if pkg, ok := binaryFiles(par)[strings.TrimLeft(path, "/")]; ok {
+			return pkg
+		}
+	}
+	return parseFilename(path)
+}
+
+const packages = "Package: hello\nVersion: 2.10\nDescription: hello\n  indented\n .\nFilename: pool/main/h/hello/hello_2.10_amd64.deb\n\n" +
+	"Package: telnet\nVersion: 0.17\nFilename: pool/main/t/telnet/telnet_0.17_amd64.deb\n"
+
+func TestFilteredIndexAndRelease(t *testing.T) {
+	repo := NewFiltered(&packagesRepository{index: packages}, inmemory.New(), Policy{Deny: []string{"telnet"}})
+
+	rd, err := repo.Index(context.TODO(), "bionic", "main", "amd64", "gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, _ := ioutil.ReadAll(rd)
+	zr, _ := gzip.NewReader(bytes.NewReader(gz))
+	index, _ := ioutil.ReadAll(zr)
+	if string(index) != "Package: hello\nVersion: 2.10\nDescription: hello\n  indented\n .\nFilename: pool/main/h/hello/hello_2.10_amd64.deb\n\n" {
+		t.Errorf("expected paragraphs of allowed packages unchanged, got %q", index)
+	}
+
+	if _, err = repo.Index(context.TODO(), "bionic", "main", "amd64", "xz"); status(err) != http.StatusNotFound {
+		t.Errorf("only gzip indices are served, got %v", err)
+	}
+
+	rd, err = repo.Release(context.TODO(), "bionic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rd)
+	rel := ParseRelease(buf)
+
+	sum := sha256.Sum256(gz)
+	sums := map[string]string{}
+	for _, x := range rel.Checksums("SHA256") {
+		sums[x.Path] = x.Hash
+	}
+	if sums["main/binary-amd64/Packages.gz"] != hex.EncodeToString(sum[:]) || sums["main/i18n/Translation-en"] != "3333" {
+		t.Errorf("expected checksum of the filtered index, got %v", sums)
+	}
+	if _, ok := sums["main/binary-amd64/Packages.xz"]; ok {
+		t.Error("upstream compressions should be removed from the release")
+	}
+	if _, ok := rel["Acquire-By-Hash"]; ok {
+		t.Error("by-hash should be disabled")
+	}
+}
+
+func TestFilteredFileForbidden(t *testing.T) {
+	repo := NewFiltered(&packagesRepository{index: packages}, inmemory.New(), Policy{Deny: []string{"telnet"}})
+
+	if _, _, err := repo.File(context.TODO(), "/pool/main/t/telnet/telnet_0.17_amd64.deb"); status(err) != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %v", err)
+	}
+	if _, _, err := repo.File(context.TODO(), "/pool/main/h/hello/hello_2.10_amd64.deb"); err != nil {
+		t.Errorf("expected allowed package, got %v", err)
+	}
+}
+
+func TestFilteredQuarantine(t *testing.T) {
+	s := inmemory.New()
+	upstream := &packagesRepository{index: packages}
+	policy := Policy{Quarantine: 24 * time.Hour}
+
+	repo := NewFiltered(upstream, s, policy)
+	if _, err := repo.Index(context.TODO(), "bionic", "main", "amd64", "gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new version is published upstream after the index was seen, and Muzeum restart
+	upstream.index = packages + "\nPackage: hello\nVersion: 2.11\nFilename: pool/main/h/hello/hello_2.11_amd64.deb\n"
+	repo = NewFiltered(upstream, s, policy)
+
+	rd, err := repo.Metadata(context.TODO(), "bionic", "main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := ioutil.ReadAll(rd)
+	if strings.Contains(string(index), "2.11") || !strings.Contains(string(index), "2.10") {
+		t.Errorf("new version should be quarantined, got %s", index)
+	}
+	if _, _, err := repo.File(context.TODO(), "/pool/main/h/hello/hello_2.11_amd64.deb"); status(err) != http.StatusForbidden {
+		t.Errorf("quarantined version should be forbidden, got %v", err)
+	}
+}
+
+func TestFilteredReleaseReadChangedIndices(t *testing.T) {
+	upstream := &packagesRepository{index: packages}
+	release := func() {
+		rd, _ := upstream.Index(context.TODO(), "bionic", "main", "amd64", "gz")
+		gz, _ := ioutil.ReadAll(rd)
+		sum := sha256.Sum256(gz)
+		upstream.release = fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hex.EncodeToString(sum[:]), len(gz))
+		upstream.reads = 0
+	}
+	release()
+	repo := NewFiltered(upstream, inmemory.New(), Policy{Deny: []string{"telnet"}})
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.Release(context.TODO(), "bionic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Index(context.TODO(), "bionic", "main", "amd64", "gz"); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.reads != 1 {
+		t.Errorf("expected the unchanged index to be read once, got %d", upstream.reads)
+	}
+
+	upstream.index = packages + "\nPackage: hello\nVersion: 2.11\nFilename: pool/main/h/hello/hello_2.11_amd64.deb\n"
+	release()
+	if _, err := repo.Release(context.TODO(), "bionic"); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.reads != 1 {
+		t.Errorf("expected the changed index to be read, got %d reads", upstream.reads)
+	}
+}
+
+func TestFilteredFilePinEpoch(t *testing.T) {
+	index := "Package: hello\nVersion: 1:2.10\nFilename: pool/main/h/hello/hello_2.10_amd64.deb\n"
+	repo := NewFiltered(&packagesRepository{index: index}, inmemory.New(), Policy{Pin: map[string]string{"hello": "1:2.*"}})
+
+	if _, _, err := repo.File(context.TODO(), "/pool/main/h/hello/hello_2.10_amd64.deb"); err != nil {
+		t.Errorf("expected the version with its epoch to match the pin, got %v", err)
+	}
+}
+
+func TestFilteredSnapshot(t *testing.T) {
+	upstream := &packagesRepository{index: packages, storage: inmemory.New()}
+	rd, _ := upstream.Index(context.TODO(), "bionic", "main", "amd64", "gz")
+	gz, _ := ioutil.ReadAll(rd)
+	sum := sha256.Sum256(gz)
+	upstream.storage.PutContent(context.TODO(), "/dists/bionic/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hex.EncodeToString(sum[:]), len(gz))))
+	upstream.storage.PutContent(context.TODO(), "/dists/bionic/main/binary-amd64/Packages.gz", gz)
+	snapshot, err := CreateSnapshot(context.TODO(), upstream.storage, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewFiltered(upstream, upstream.storage, Policy{Deny: []string{"telnet"}})
+	rd, err = repo.Snapshot(context.TODO(), snapshot.Name, "bionic", "main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := ioutil.ReadAll(rd)
+	if strings.Contains(string(index), "telnet") || !strings.Contains(string(index), "hello") {
+		t.Errorf("expected the snapshot index to be filtered, got %s", index)
+	}
+
+	rd, err = repo.Snapshot(context.TODO(), snapshot.Name, "bionic", "InRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rd)
+	filtered := sha256.Sum256(index)
+	sums := map[string]string{}
+	for _, x := range ParseRelease(buf).Checksums("SHA256") {
+		sums[x.Path] = x.Hash
+	}
+	if sums["main/binary-amd64/Packages"] != hex.EncodeToString(filtered[:]) {
+		t.Errorf("expected the checksum of the filtered snapshot index, got %v", sums)
+	}
+}
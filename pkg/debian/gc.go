@@ -0,0 +1,146 @@
+package debian
+
+import (
+	"context"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+// partial downloads and uploads, and recently cached pool files, are kept for a day. They may be in progress, or the
+// index that reference a pool file may not be cached yet.
+var retain = 24 * time.Hour
+
+// Collect delete the orphaned files of a repository in storage, and return their paths. A dry run only report them.
+// Orphans are partial downloads and uploads, metadata and by-hash files that are no longer in the release of their
+// distribution, and pool files that are not referenced by a cached index or a snapshot.
+func Collect(ctx context.Context, storage driver.StorageDriver, dryRun bool) ([]string, error) {
+	files := map[string]driver.FileInfo{}
+	err := storage.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if fi.IsDir() {
+			if fi.Path() == "/snapshots" || fi.Path() == "/policy" {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		files[fi.Path()] = fi
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var (
+		old      = time.Now().Add(-retain)
+		orphans  = map[string]bool{}
+		releases = map[string]Paragraph{}
+		pool     = map[string]bool{}
+		indexed  = false
+	)
+	for path, fi := range files {
+		switch {
+		case strings.HasSuffix(path, ".download") || strings.HasPrefix(path, "/incoming/"):
+			orphans[path] = fi.ModTime().Before(old)
+		case strings.HasSuffix(path, ".meta"):
+		case strings.HasPrefix(path, "/dists/"):
+			name, ok := current(ctx, storage, releases, path)
+			if !ok {
+				orphans[path] = true
+				continue
+			}
+			base := pathpkg.Base(name)
+			if index := strings.TrimSuffix(base, pathpkg.Ext(base)); index == "Packages" || index == "Sources" {
+				indexed = true
+			}
+			if err := referenced(ctx, storage, path, base, pool); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// stored resources keep their validators next to the body
+	for path := range files {
+		if body := strings.TrimSuffix(path, ".meta"); body != path {
+			_, ok := files[body]
+			orphans[path] = !ok || orphans[body]
+		}
+	}
+
+	// without a cached index every pool file would be an orphan
+	if indexed {
+		retained, err := Retained(ctx, storage)
+		if err != nil {
+			return nil, err
+		}
+		for path, fi := range files {
+			if strings.HasPrefix(path, "/pool/") && !pool[strings.TrimLeft(path, "/")] && !retained[path] {
+				orphans[path] = fi.ModTime().Before(old)
+			}
+		}
+	}
+
+	removed := []string{}
+	for path, orphan := range orphans {
+		if orphan {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+
+	if dryRun {
+		return removed, nil
+	}
+	for _, path := range removed {
+		if err := storage.Delete(ctx, path); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// current return the name of a distribution metadata file in the stored release, by-hash files are resolved to the
+// name of the file. Files of a distribution without a stored release, i.e. of a hosted repository, are always current.
+func current(ctx context.Context, storage driver.StorageDriver, releases map[string]Paragraph, path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/dists/"), "/")
+	dist, file := parts[0], strings.Join(parts[1:], "/")
+	if isRelease(file) {
+		return file, true
+	}
+
+	rel, ok := releases[dist]
+	if !ok {
+		if buf, err := storage.GetContent(ctx, "/"+concat("dists", dist, "InRelease")); err == nil {
+			rel = ParseRelease(buf)
+		}
+		releases[dist] = rel
+	}
+	if len(rel) == 0 {
+		return file, true
+	}
+
+	if n := len(parts); n >= 5 && parts[n-3] == "by-hash" {
+		algorithm, hash, dir := parts[n-2], parts[n-1], strings.Join(parts[1:n-3], "/")
+		for _, sum := range rel.Checksums(algorithm) {
+			if sum.Hash == hash && pathpkg.Dir(sum.Path) == dir {
+				return sum.Path, true
+			}
+		}
+		return "", false
+	}
+
+	for _, field := range []string{"MD5Sum", "SHA1", "SHA256", "SHA512"} {
+		for _, sum := range rel.Checksums(field) {
+			if sum.Path == file {
+				return file, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,118 @@
+package debian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestCollect(t *testing.T) {
+	index, _ := ioutil.ReadAll(read(t, "Packages.gz"))
+	sum := sha256.Sum256(index)
+	hash := hex.EncodeToString(sum[:])
+	pool := "/pool/cri-tools_1.11.0-00_amd64_768e5551f9badfde12b10c42c88afb45c412c1bf307a5985a4b29f4499d341bd.deb"
+
+	ctx := context.TODO()
+	s := inmemory.New()
+	s.PutContent(ctx, "/dists/kubernetes-xenial/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hash, len(index))))
+	s.PutContent(ctx, "/dists/kubernetes-xenial/InRelease.meta", []byte("{}"))
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-amd64/by-hash/SHA256/"+hash, index)
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-amd64/by-hash/SHA256/abcd", index)
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-i386/Packages.gz", index)
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-i386/Packages.gz.meta", []byte("{}"))
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-amd64/Packages.xz.download", []byte{1})
+	s.PutContent(ctx, pool, []byte{1})
+	s.PutContent(ctx, "/pool/kubectl_1.0.0-00_amd64.deb", []byte{1})
+	s.PutContent(ctx, "/policy/seen.json", []byte("{}"))
+
+	defer func(d time.Duration) { retain = d }(retain)
+	retain = 0
+
+	orphans := []string{
+		"/dists/kubernetes-xenial/main/binary-amd64/Packages.xz.download",
+		"/dists/kubernetes-xenial/main/binary-amd64/by-hash/SHA256/abcd",
+		"/dists/kubernetes-xenial/main/binary-i386/Packages.gz",
+		"/dists/kubernetes-xenial/main/binary-i386/Packages.gz.meta",
+		"/pool/kubectl_1.0.0-00_amd64.deb",
+	}
+
+	removed, err := Collect(ctx, s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, orphans) {
+		t.Errorf("expected orphans %v, got %v", orphans, removed)
+	}
+	if _, err = s.Stat(ctx, orphans[0]); err != nil {
+		t.Error("dry run should not delete")
+	}
+
+	if _, err = Collect(ctx, s, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range orphans {
+		if _, err = s.Stat(ctx, path); err == nil {
+			t.Errorf("expected %s to be deleted", path)
+		}
+	}
+	for _, path := range []string{pool, "/dists/kubernetes-xenial/InRelease.meta", "/policy/seen.json"} {
+		if _, err = s.Stat(ctx, path); err != nil {
+			t.Errorf("expected %s to be kept", path)
+		}
+	}
+}
+
+func TestCollectKeepPoolWithoutIndex(t *testing.T) {
+	ctx := context.TODO()
+	s := inmemory.New()
+	s.PutContent(ctx, "/pool/kubectl_1.0.0-00_amd64.deb", []byte{1})
+
+	defer func(d time.Duration) { retain = d }(retain)
+	retain = 0
+
+	if removed, err := Collect(ctx, s, true); err != nil || len(removed) > 0 {
+		t.Errorf("expected no orphans without index, got %v %v", removed, err)
+	}
+}
+
+func TestCollectKeepSnapshotPool(t *testing.T) {
+	index, _ := ioutil.ReadAll(read(t, "Packages.gz"))
+	sum := sha256.Sum256(index)
+	pool := "/pool/cri-tools_1.11.0-00_amd64_768e5551f9badfde12b10c42c88afb45c412c1bf307a5985a4b29f4499d341bd.deb"
+
+	ctx := context.TODO()
+	s := inmemory.New()
+	s.PutContent(ctx, "/dists/kubernetes-xenial/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hex.EncodeToString(sum[:]), len(index))))
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-amd64/Packages.gz", index)
+	s.PutContent(ctx, pool, []byte{1})
+	if _, err := CreateSnapshot(ctx, s, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the package is removed from the index upstream
+	empty := &bytes.Buffer{}
+	gzip.NewWriter(empty).Close()
+	sum = sha256.Sum256(empty.Bytes())
+	s.PutContent(ctx, "/dists/kubernetes-xenial/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hex.EncodeToString(sum[:]), empty.Len())))
+	s.PutContent(ctx, "/dists/kubernetes-xenial/main/binary-amd64/Packages.gz", empty.Bytes())
+
+	defer func(d time.Duration) { retain = d }(retain)
+	retain = 0
+
+	removed, err := Collect(ctx, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Stat(ctx, pool); err != nil {
+		t.Errorf("expected the pool file of the snapshot to be kept, removed %v", removed)
+	}
+}
@@ -0,0 +1,371 @@
+package debian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathpkg "path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/cache"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+var (
+	errUnsigned     = cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "hosted repository has no signed release"}
+	errChanges      = cache.ErrHTTP{StatusCode: http.StatusBadRequest, Status: "invalid .changes file"}
+	errBinaryUpload = cache.ErrHTTP{StatusCode: http.StatusBadRequest, Status: "only source uploads are supported"}
+
+	// the names of source packages, and of distributions and components, are used in storage paths
+	sourceName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+	suiteName  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._-]*$`)
+)
+
+type local struct {
+	storage driver.StorageDriver
+	mu      sync.Mutex // uploads that update the indices are serialized
+}
+
+// NewLocal initialize a hosted repository. Files are uploaded to incoming, and a .changes file publish the upload
+// to the pool and the Sources index of its distributions. The Release is generated from the indices and is not signed.
+func NewLocal(storage driver.StorageDriver) Repository {
+	return &local{storage: storage}
+}
+
+// Release is not found, apt read the unsigned Release instead
+func (repo *local) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	return nil, errUnsigned
+}
+
+func (repo *local) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
+	return repo.read(ctx, concat("dists", dist, comp, "binary-"+arch, "Packages."+compression))
+}
+
+func (repo *local) Sources(ctx context.Context, dist, comp, compression string) (io.ReadCloser, error) {
+	return repo.read(ctx, concat("dists", dist, comp, "source", "Sources."+compression))
+}
+
+func (repo *local) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	if file == "Release" {
+		buf, err := repo.release(ctx, dist)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return repo.read(ctx, concat("dists", dist, file))
+}
+
+func (repo *local) ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error) {
+	if algorithm != "SHA256" {
+		return nil, errAlgorithm
+	}
+	buf, err := repo.release(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sum := range ParseRelease(buf).Checksums(algorithm) {
+		if sum.Hash == hash && pathpkg.Dir(sum.Path) == strings.Trim(dir, "/") {
+			rd, err := repo.read(ctx, concat("dists", dist, sum.Path))
+			if err != nil {
+				return nil, err
+			}
+			return verify(rd, algorithm, hash)
+		}
+	}
+	return nil, cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "hash not in release of " + dist}
+}
+
+func (repo *local) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	return readSnapshot(ctx, repo.storage, snapshot, dist, file)
+}
+
+func (repo *local) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	rd, err := repo.read(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rd, parseFilename(path), nil
+}
+
+// Upload store a file in incoming. A .changes file publish the files it describes, which must be uploaded first.
+func (repo *local) Upload(ctx context.Context, filename string, rd io.Reader) (*model.Package, error) {
+	name := pathpkg.Base(filename)
+	if pathpkg.Ext(name) == ".changes" {
+		buf, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return nil, err
+		}
+		return repo.publish(ctx, buf)
+	}
+
+	wr, err := repo.storage.Writer(ctx, "/"+concat("incoming", name), false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		wr.Cancel()
+		return nil, err
+	}
+	if err = wr.Commit(); err != nil {
+		return nil, err
+	}
+	return nil, wr.Close()
+}
+
+// publish move the files of a source upload from incoming to the pool, and add the source package to the Sources indices
+func (repo *local) publish(ctx context.Context, buf []byte) (*model.Package, error) {
+	changes, _ := NewControlFileReader(bytes.NewReader(clearsigned(buf))).Read()
+	dists := strings.Fields(changes["Distribution"])
+	if !sourceName.MatchString(changes.Source()) || len(changes.Version()) == 0 || len(dists) == 0 {
+		return nil, errChanges
+	}
+	for _, dist := range dists {
+		if !suiteName.MatchString(dist) {
+			return nil, errChanges
+		}
+	}
+
+	comp, dsc := "main", ""
+	for _, f := range changesFiles(changes) {
+		switch pathpkg.Ext(f.name) {
+		case ".deb", ".udeb":
+			return nil, errBinaryUpload
+		case ".dsc":
+			dsc = f.name
+			changes["Section"], changes["Priority"] = f.section, f.priority
+		}
+		if i := strings.Index(f.section, "/"); i > 0 {
+			comp = f.section[:i]
+		}
+	}
+	sums := changes.Checksums("Checksums-Sha256")
+	if !filename(dsc) || len(sums) == 0 || !suiteName.MatchString(comp) {
+		return nil, errChanges
+	}
+	for _, sum := range sums {
+		if !filename(sum.Path) {
+			return nil, errChanges
+		}
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, sum := range sums {
+		if err := repo.check(ctx, "/"+concat("incoming", sum.Path), sum); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := poolDirectory(comp, changes.Source())
+	for _, sum := range sums {
+		if err := repo.storage.Move(ctx, "/"+concat("incoming", sum.Path), "/"+concat(dir, sum.Path)); err != nil {
+			return nil, err
+		}
+	}
+
+	src, err := repo.source(ctx, dir, dsc)
+	if err != nil {
+		return nil, err
+	}
+	src["Section"], src["Priority"] = changes["Section"], changes["Priority"]
+
+	for _, dist := range dists {
+		if err := repo.addSource(ctx, dist, comp, src); err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.Package{
+		Type:       "debian",
+		Name:       src.Package(),
+		Version:    src.Version(),
+		Qualifiers: map[string]string{"arch": "source"},
+	}, nil
+}
+
+// check that an uploaded file match its checksum in the .changes file
+func (repo *local) check(ctx context.Context, path string, sum Checksum) error {
+	rd, err := repo.storage.Reader(ctx, path, 0)
+	if err != nil {
+		return cache.ErrHTTP{StatusCode: http.StatusBadRequest, Status: "missing upload " + sum.Path}
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, rd)
+	if err != nil {
+		return err
+	}
+	if n != sum.Size || hex.EncodeToString(h.Sum(nil)) != sum.Hash {
+		return cache.ErrHTTP{StatusCode: http.StatusBadRequest, Status: "checksum mismatch of upload " + sum.Path}
+	}
+	return nil
+}
+
+// source read the Sources paragraph of a .dsc file in the pool. The .dsc is listed with the other files of the package.
+func (repo *local) source(ctx context.Context, dir, dsc string) (Paragraph, error) {
+	buf, err := repo.storage.GetContent(ctx, "/"+concat(dir, dsc))
+	if err != nil {
+		return nil, err
+	}
+	src, _ := NewControlFileReader(bytes.NewReader(clearsigned(buf))).Read()
+	if len(src.Source()) == 0 {
+		return nil, errChanges
+	}
+
+	md5sum := md5.Sum(buf)
+	sha256sum := sha256.Sum256(buf)
+
+	src["Package"] = src.Source()
+	delete(src, "Source")
+	src["Directory"] = dir
+	src["Files"] += fmt.Sprintf("\n%s %d %s", hex.EncodeToString(md5sum[:]), len(buf), dsc)
+	src["Checksums-Sha256"] += fmt.Sprintf("\n%s %d %s", hex.EncodeToString(sha256sum[:]), len(buf), dsc)
+	return src, nil
+}
+
+// addSource add a source package to the Sources index of a distribution component, and replace the same version
+func (repo *local) addSource(ctx context.Context, dist, comp string, src Paragraph) error {
+	path := "/" + concat("dists", dist, comp, "source", "Sources")
+
+	sources := &bytes.Buffer{}
+	if buf, err := repo.storage.GetContent(ctx, path); err == nil {
+		rd := NewControlFileReader(bytes.NewReader(buf))
+		for {
+			par, more := rd.Read()
+			if !more {
+				break
+			}
+			if par.Package() != src.Package() || par.Version() != src.Version() {
+				par.WriteTo(sources)
+			}
+		}
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return err
+	}
+	src.WriteTo(sources)
+
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	zw.Write(sources.Bytes())
+	zw.Close()
+
+	if err := repo.storage.PutContent(ctx, path, sources.Bytes()); err != nil {
+		return err
+	}
+	return repo.storage.PutContent(ctx, path+".gz", gz.Bytes())
+}
+
+// release generate the Release file of a distribution from its indices
+func (repo *local) release(ctx context.Context, dist string) ([]byte, error) {
+	root := "/" + concat("dists", dist)
+
+	var (
+		files    []driver.FileInfo
+		comps    = map[string]bool{}
+		arches   = map[string]bool{}
+		modified time.Time
+	)
+	err := repo.storage.Walk(ctx, root, func(fi driver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		files = append(files, fi)
+		if fi.ModTime().After(modified) {
+			modified = fi.ModTime()
+		}
+
+		parts := strings.Split(strings.TrimPrefix(fi.Path(), root+"/"), "/")
+		if len(parts) > 2 {
+			comps[parts[0]] = true
+			// the sources of a component are not an architecture
+			if parts[1] != "source" {
+				arches[strings.TrimPrefix(parts[1], "binary-")] = true
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "no release for " + dist}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path() < files[j].Path() })
+
+	var sums strings.Builder
+	for _, fi := range files {
+		buf, err := repo.storage.GetContent(ctx, fi.Path())
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(buf)
+		fmt.Fprintf(&sums, "\n%s %d %s", hex.EncodeToString(sum[:]), len(buf), strings.TrimPrefix(fi.Path(), root+"/"))
+	}
+
+	rel := &bytes.Buffer{}
+	Paragraph{
+		"Suite":         dist,
+		"Codename":      dist,
+		"Date":          modified.UTC().Format(time.RFC1123),
+		"Components":    strings.Join(keys(comps), " "),
+		"Architectures": strings.Join(keys(arches), " "),
+		"SHA256":        sums.String(),
+	}.WriteTo(rel)
+	return rel.Bytes(), nil
+}
+
+func (repo *local) read(ctx context.Context, path string) (io.ReadCloser, error) {
+	f, err := storage.Open(ctx, repo.storage, "/"+strings.TrimLeft(path, "/"))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "not found " + path}
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// filename return true for the name of a file in a directory, which is not a path
+func filename(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && pathpkg.Base(name) == name
+}
+
+type changesFile struct {
+	name, section, priority string
+}
+
+// changesFiles return the Files of a .changes file, which list the section and priority of each file
+func changesFiles(changes Paragraph) []changesFile {
+	xs := []changesFile{}
+	for _, ln := range strings.Split(changes["Files"], "\n") {
+		if f := strings.Fields(ln); len(f) == 5 {
+			xs = append(xs, changesFile{f[4], f[2], f[3]})
+		}
+	}
+	return xs
+}
+
+func keys(set map[string]bool) []string {
+	xs := make([]string, 0, len(set))
+	for x := range set {
+		xs = append(xs, x)
+	}
+	sort.Strings(xs)
+	return xs
+}
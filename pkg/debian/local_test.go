@@ -0,0 +1,183 @@
+package debian
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/storage"
+)
+
+var (
+	dsc  = []byte("Format: 3.0 (quilt)\nSource: hello\nBinary: hello\nArchitecture: any\nVersion: 2.10-2\nFiles:\n 0123 3 hello_2.10.orig.tar.gz\n")
+	orig = []byte("tar")
+)
+
+// changes describe the files of a source upload
+func changes(files map[string][]byte) []byte {
+	var md5s, sha256s string
+	for name, buf := range files {
+		m, s := md5.Sum(buf), sha256.Sum256(buf)
+		md5s += fmt.Sprintf("\n %s %d contrib/devel optional %s", hex.EncodeToString(m[:]), len(buf), name)
+		sha256s += fmt.Sprintf("\n %s %d %s", hex.EncodeToString(s[:]), len(buf), name)
+	}
+	return []byte("Source: hello\nVersion: 2.10-2\nDistribution: bionic\nArchitecture: source\nFiles:" + md5s + "\nChecksums-Sha256:" + sha256s + "\n")
+}
+
+func upload(t *testing.T, repo Repository, files map[string][]byte) {
+	for name, buf := range files {
+		if _, err := repo.Upload(context.TODO(), name, bytes.NewReader(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadPublishSourcePackage(t *testing.T) {
+	repo := NewLocal(inmemory.New())
+	files := map[string][]byte{"hello_2.10-2.dsc": dsc, "hello_2.10.orig.tar.gz": orig}
+	upload(t, repo, files)
+
+	pkg, err := repo.Upload(context.TODO(), "hello_2.10-2_source.changes", bytes.NewReader(changes(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "hello" || pkg.Version != "2.10-2" || pkg.Qualifiers["arch"] != "source" {
+		t.Errorf("expected pushed source package, got %v", pkg)
+	}
+
+	rd, err := repo.Sources(context.TODO(), "bionic", "contrib", "gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, _ := decompress(rd, "gz")
+	src, _ := NewControlFileReader(gz).Read()
+	if src.Package() != "hello" || src.Directory() != "pool/contrib/h/hello" || len(src.Checksums("Files")) != 2 {
+		t.Errorf("expected source package in index, got %v", src)
+	}
+
+	rd, _, err = repo.File(context.TODO(), "/pool/contrib/h/hello/hello_2.10.orig.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadAll(rd); !bytes.Equal(buf, orig) {
+		t.Errorf("expected uploaded file in pool, got %v", buf)
+	}
+
+	rd, err = repo.Metadata(context.TODO(), "bionic", "Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rd)
+	release := ParseRelease(buf)
+	if release["Components"] != "contrib" || len(release["Architectures"]) > 0 || len(release.Checksums("SHA256")) != 2 {
+		t.Errorf("expected release of the Sources index, got %v", release)
+	}
+}
+
+// walkFailDriver fail to walk, e.g. during a storage outage
+type walkFailDriver struct {
+	driver.StorageDriver
+}
+
+func (d walkFailDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	return errors.New("storage outage")
+}
+
+func TestReleaseWalkFailed(t *testing.T) {
+	repo := NewLocal(walkFailDriver{inmemory.New()})
+	if _, err := repo.Metadata(context.TODO(), "bionic", "Release"); status(err) != http.StatusInternalServerError {
+		t.Errorf("expected storage error, got %v", err)
+	}
+
+	repo = NewLocal(inmemory.New())
+	if _, err := repo.Metadata(context.TODO(), "bionic", "Release"); status(err) != http.StatusNotFound {
+		t.Errorf("expected no release, got %v", err)
+	}
+}
+
+func TestUploadReplaceSameVersion(t *testing.T) {
+	repo := NewLocal(inmemory.New())
+	files := map[string][]byte{"hello_2.10-2.dsc": dsc, "hello_2.10.orig.tar.gz": orig}
+
+	for i := 0; i < 2; i++ {
+		upload(t, repo, files)
+		if _, err := repo.Upload(context.TODO(), "hello_2.10-2_source.changes", bytes.NewReader(changes(files))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rd, err := repo.Metadata(context.TODO(), "bionic", "contrib/source/Sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rd)
+	if n := strings.Count(string(buf), "Package: hello"); n != 1 {
+		t.Errorf("expected the version once in the index, got %d", n)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	repo := NewLocal(inmemory.New())
+	upload(t, repo, map[string][]byte{"hello_2.10-2.dsc": dsc})
+
+	uploads := map[string][]byte{
+		"missing file":    changes(map[string][]byte{"hello_2.10-2.dsc": dsc, "hello_2.10.orig.tar.gz": orig}),
+		"checksum":        changes(map[string][]byte{"hello_2.10-2.dsc": orig}),
+		"binary":          changes(map[string][]byte{"hello_2.10-2.dsc": dsc, "hello_2.10-2_amd64.deb": orig}),
+		"no distribution": []byte("Source: hello\nVersion: 2.10-2\n"),
+	}
+	for name, buf := range uploads {
+		if _, err := repo.Upload(context.TODO(), "hello_2.10-2_source.changes", bytes.NewReader(buf)); status(err) != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %v", name, err)
+		}
+	}
+}
+
+func TestUploadPathTraversalRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the filesystem driver resolve .. in paths
+	fs := filesystem.New(filesystem.DriverParameters{RootDirectory: dir, MaxThreads: 10})
+	fs.PutContent(context.TODO(), "/secret.tar.gz", orig)
+	repo := NewLocal(storage.NewDirectoryDriver("hosted", fs))
+	upload(t, repo, map[string][]byte{"hello_2.10-2.dsc": dsc})
+
+	traversal := changes(map[string][]byte{"hello_2.10-2.dsc": dsc, "../../secret.tar.gz": orig})
+	uploads := map[string][]byte{
+		"file":         traversal,
+		"source":       bytes.Replace(changes(map[string][]byte{"hello_2.10-2.dsc": dsc}), []byte("Source: hello"), []byte("Source: ../../x"), 1),
+		"distribution": bytes.Replace(changes(map[string][]byte{"hello_2.10-2.dsc": dsc}), []byte("Distribution: bionic"), []byte("Distribution: ../../x"), 1),
+	}
+	for name, buf := range uploads {
+		if _, err := repo.Upload(context.TODO(), "hello_2.10-2_source.changes", bytes.NewReader(buf)); status(err) != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %v", name, err)
+		}
+	}
+	if _, err := fs.Stat(context.TODO(), "/secret.tar.gz"); err != nil {
+		t.Errorf("expected file outside the repository not moved, got %v", err)
+	}
+}
+
+func TestUploadToProxyNotAllowed(t *testing.T) {
+	c := NewClient(http.DefaultClient, "http://archive.ubuntu.com/ubuntu", inmemory.New())
+
+	if _, err := c.Upload(context.TODO(), "hello_2.10-2.dsc", bytes.NewReader(dsc)); status(err) != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %v", err)
+	}
+}
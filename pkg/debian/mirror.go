@@ -0,0 +1,111 @@
+package debian
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/fergusn/muzeum/pkg/mirror"
+	"github.com/sirupsen/logrus"
+)
+
+// MirrorConfig select the upstream package indices to mirror
+type MirrorConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	Concurrency int           `yaml:"concurrency"`
+	Dists       []struct {
+		Dist          string   `yaml:"dist"`
+		Components    []string `yaml:"components"`
+		Architectures []string `yaml:"architectures"`
+	} `yaml:"dists"`
+}
+
+// Mirror download all packages in the configured indices into the repository
+func Mirror(ctx context.Context, name string, repo Repository, cfg MirrorConfig) error {
+	found := make(chan string)
+
+	go func() {
+		defer close(found)
+
+		for _, d := range cfg.Dists {
+			for _, comp := range d.Components {
+				for _, arch := range d.Architectures {
+					if err := filenames(ctx, repo, d.Dist, comp, arch, found); err != nil {
+						logrus.Errorf("mirror %s: index %s/%s/binary-%s: %v", name, d.Dist, comp, arch, err)
+					}
+				}
+			}
+		}
+	}()
+
+	return mirror.Run(ctx, name, cfg.Concurrency, found, func(ctx context.Context, filename string) error {
+		rd, _, err := repo.File(ctx, "/"+filename)
+		if err != nil {
+			return err
+		}
+		return rd.Close()
+	})
+}
+
+// filenames send the filename of every package in an index
+func filenames(ctx context.Context, repo Repository, dist, comp, arch string, found chan<- string) error {
+	compression, err := indexCompression(ctx, repo, dist, comp, arch)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.Index(ctx, dist, comp, arch, compression)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	var rd io.Reader
+	if rd, err = decompress(idx, compression); err != nil {
+		return err
+	}
+
+	packages := NewControlFileReader(rd)
+	for {
+		pkg, more := packages.Read()
+		if !more {
+			return nil
+		}
+		if len(pkg.Filename()) == 0 {
+			continue
+		}
+		select {
+		case found <- pkg.Filename():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// indexCompression return a compression of an index that is listed in the release of the distribution, xz is preferred
+func indexCompression(ctx context.Context, repo Repository, dist, comp, arch string) (string, error) {
+	rd, err := repo.Release(ctx, dist)
+	if err != nil {
+		// hosted repositories only have an unsigned Release
+		if rd, err = repo.Metadata(ctx, dist, "Release"); err != nil {
+			return "", err
+		}
+	}
+	buf, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return "", err
+	}
+
+	listed := map[string]bool{}
+	for _, sum := range ParseRelease(buf).Checksums("SHA256") {
+		listed[sum.Path] = true
+	}
+	for _, compression := range []string{"xz", "gz"} {
+		if listed[concat(comp, "binary-"+arch, "Packages."+compression)] {
+			return compression, nil
+		}
+	}
+	return "", fmt.Errorf("no xz or gz index of %s/binary-%s in the release", comp, arch)
+}
@@ -0,0 +1,73 @@
+package debian
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/plugins"
+)
+
+type indexRepository struct {
+	Repository
+	t     *testing.T
+	files map[string]bool
+	mu    sync.Mutex
+}
+
+func (r *indexRepository) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
+	return read(r.t, "Packages.gz"), nil
+}
+
+func (r *indexRepository) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("Suite: " + dist + "\nSHA256:\n 0123 1 main/binary-amd64/Packages.gz\n")), nil
+}
+
+func (r *indexRepository) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	r.mu.Lock()
+	r.files[path] = true
+	r.mu.Unlock()
+	return ioutil.NopCloser(strings.NewReader("")), nil, nil
+}
+
+func TestMirrorDownloadAllPackagesInIndex(t *testing.T) {
+	repo := &indexRepository{t: t, files: map[string]bool{}}
+
+	cfg := MirrorConfig{}
+	err := plugins.Decode(map[interface{}]interface{}{
+		"concurrency": 2,
+		"dists": []interface{}{
+			map[interface{}]interface{}{"dist": "kubernetes-xenial", "components": []string{"main"}, "architectures": []string{"amd64"}},
+		},
+	}, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mirror(context.TODO(), "test", repo, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !repo.files["/pool/cri-tools_1.11.0-00_amd64_768e5551f9badfde12b10c42c88afb45c412c1bf307a5985a4b29f4499d341bd.deb"] {
+		t.Errorf("package in index should be mirrored, got %d files", len(repo.files))
+	}
+}
+
+func TestMirrorIndexCompressionFromRelease(t *testing.T) {
+	release := map[string]string{
+		"xz": "SHA256:\n 0123 1 main/binary-amd64/Packages.gz\n 4567 1 main/binary-amd64/Packages.xz\n",
+		"gz": "SHA256:\n 0123 1 main/binary-amd64/Packages.gz\n 4567 1 main/binary-i386/Packages.xz\n",
+		"":   "SHA256:\n 0123 1 main/binary-amd64/Packages\n",
+	}
+	for expected, content := range release {
+		repo := &releaseRepository{inrelease: content}
+		compression, err := indexCompression(context.TODO(), repo, "bionic", "main", "amd64")
+		if compression != expected || (len(expected) == 0) != (err != nil) {
+			t.Errorf("expected %q, got %q %v", expected, compression, err)
+		}
+	}
+}
@@ -1,42 +1,177 @@
 package debian
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
+	pathpkg "path"
+	"strings"
 
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/internal/pgp"
+	"github.com/fergusn/muzeum/pkg/mirror"
 	muzeum "github.com/fergusn/muzeum/pkg/plugins"
+	"github.com/fergusn/muzeum/pkg/upstream"
 	"github.com/gorilla/mux"
 )
 
 var (
-	errConfiguration = errors.New("Debian Repository require proxy configuration")
+	errConfiguration       = errors.New("Debian mirror require proxy configuration")
+	errPolicyConfiguration = errors.New("Debian policy require sign configuration")
 )
 
 func init() {
 	muzeum.Plugins["debian"] = register
+	muzeum.Mirrors["debian"] = mirrorRepository
+	muzeum.Snapshots["debian"] = snapshotRepository
+	muzeum.Collectors["debian"] = collectRepository
 }
 
-func register(rt *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver) error {
-	proxy, ok := config["proxy"]
-	if !ok {
-		return errConfiguration
-	}
-	raw, ok := proxy.(string)
-	if !ok {
-		return errConfiguration
+func register(rt *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error {
+	if _, ok := config["proxy"]; !ok {
+		quota, err := muzeum.Quota(name, config, bucket, isPackage)
+		if err != nil {
+			return err
+		}
+		if quota != nil {
+			bucket = quota
+		}
+		repo, err := sign(NewLocal(bucket), config)
+		if err != nil {
+			return err
+		}
+		srv := NewServer(name, &url.URL{Path: "/"}, repo)
+		srv.redirect, _ = config["redirect"].(bool)
+		srv.Mount(rt)
+		return nil
 	}
 
-	url, err := url.Parse(raw)
+	endpoints, url, err := proxy(config)
 	if err != nil {
 		return err
 	}
 
-
-	repo := NewRemote(raw, bucket)
-	srv := NewServer(name, url, repo)
+	repo := NewRemote(endpoints, bucket, client)
+	filtered, err := filter(repo, bucket, config)
+	if err != nil {
+		return err
+	}
+	signed, err := sign(filtered, config)
+	if err != nil {
+		return err
+	}
+	srv := NewServer(name, url, signed)
+	srv.redirect, _ = config["redirect"].(bool)
 
 	srv.Mount(rt)
 
+	cfg, err := mirrorConfig(config)
+	if err != nil {
+		return err
+	}
+	if cfg.Interval > 0 {
+		go mirror.Schedule(context.Background(), name, cfg.Interval, func(ctx context.Context) error {
+			return Mirror(ctx, name, filtered, cfg)
+		})
+	}
+
 	return nil
 }
+
+func mirrorRepository(ctx context.Context, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error {
+	endpoints, _, err := proxy(config)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := mirrorConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// packages that are not allowed by the policy are not mirrored
+	repo, err := filter(NewRemote(endpoints, bucket, client), bucket, config)
+	if err != nil {
+		return err
+	}
+	return Mirror(ctx, name, repo, cfg)
+}
+
+func snapshotRepository(ctx context.Context, name string, bucket driver.StorageDriver, snapshot string) (string, error) {
+	s, err := CreateSnapshot(ctx, bucket, snapshot)
+	if err != nil {
+		return "", err
+	}
+	return s.Name, nil
+}
+
+func collectRepository(ctx context.Context, name string, bucket driver.StorageDriver, dryRun bool) ([]string, error) {
+	return Collect(ctx, bucket, dryRun)
+}
+
+// proxy read the upstream mirrors, the path of the first mirror is served
+func proxy(config map[string]interface{}) (*upstream.Endpoints, *url.URL, error) {
+	urls, ok := muzeum.Endpoints(config["proxy"])
+	if !ok {
+		return nil, nil, errConfiguration
+	}
+	latency, _ := config["latency"].(bool)
+
+	url, err := url.Parse(urls[0])
+	return upstream.NewEndpoints(urls, latency), url, err
+}
+
+// filter the indices of repo with the policy of the configuration, the filtered release must be signed
+func filter(repo Repository, bucket driver.StorageDriver, config map[string]interface{}) (Repository, error) {
+	p, ok := config["policy"]
+	if !ok {
+		return repo, nil
+	}
+
+	var policy Policy
+	if err := muzeum.Decode(p, &policy); err != nil {
+		return nil, err
+	}
+	if !policy.Enabled() {
+		return repo, nil
+	}
+	if _, ok := config["sign"]; !ok {
+		return nil, errPolicyConfiguration
+	}
+	return NewFiltered(repo, bucket, policy), nil
+}
+
+// sign the releases of repo with the private key in the sign file of the configuration
+func sign(repo Repository, config map[string]interface{}) (Repository, error) {
+	file, ok := config["sign"].(string)
+	if !ok {
+		return repo, nil
+	}
+
+	buf, err := ioutil.ReadFile(os.ExpandEnv(file))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := pgp.NewSigner(buf)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigned(repo, signer), nil
+}
+
+// isPackage return true for the path of a source or binary package in the pool, which count toward the quota of a
+// repository
+func isPackage(path string) bool {
+	ext := pathpkg.Ext(path)
+	return strings.HasPrefix(path, "/pool/") && (ext == ".dsc" || ext == ".deb" || ext == ".udeb")
+}
+
+func mirrorConfig(config map[string]interface{}) (cfg MirrorConfig, err error) {
+	if m, ok := config["mirror"]; ok {
+		err = muzeum.Decode(m, &cfg)
+	}
+	return
+}
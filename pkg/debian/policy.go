@@ -0,0 +1,43 @@
+package debian
+
+import (
+	"path"
+	"time"
+)
+
+// Policy select the packages that clients can install from a proxy repository
+type Policy struct {
+	Allow      []string          `yaml:"allow"`      // package name patterns, when not empty only matching packages are allowed
+	Deny       []string          `yaml:"deny"`       // package name patterns that are never allowed
+	Pin        map[string]string `yaml:"pin"`        // version pattern of a package name
+	Quarantine time.Duration     `yaml:"quarantine"` // hide versions seen for the first time within the window
+}
+
+// Enabled return true when the policy filter any package
+func (p Policy) Enabled() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0 || len(p.Pin) > 0 || p.Quarantine > 0
+}
+
+// Allowed return true when the version of a package, first seen at seen, is allowed by the policy
+func (p Policy) Allowed(name, version string, seen time.Time) bool {
+	if match(p.Deny, name) {
+		return false
+	}
+	if len(p.Allow) > 0 && !match(p.Allow, name) {
+		return false
+	}
+	if pattern, ok := p.Pin[name]; ok && !match([]string{pattern}, version) {
+		return false
+	}
+	return p.Quarantine <= 0 || time.Since(seen) >= p.Quarantine
+}
+
+// match return true if value match any of the shell patterns, e.g. python3-*
+func match(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package debian
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	policy := Policy{
+		Allow:      []string{"python3-*", "openssl", "curl"},
+		Deny:       []string{"python3-dev"},
+		Pin:        map[string]string{"openssl": "1.1.1*"},
+		Quarantine: 72 * time.Hour,
+	}
+	old := time.Now().Add(-100 * time.Hour)
+
+	cases := []struct {
+		name, version string
+		seen          time.Time
+		allowed       bool
+	}{
+		{"python3-yaml", "5.1", old, true},
+		{"python3-dev", "3.6", old, false},
+		{"telnet", "0.17", old, false},
+		{"openssl", "1.1.1-1ubuntu2", old, true},
+		{"openssl", "3.0.2-0ubuntu1", old, false},
+		{"curl", "7.58.0", time.Now(), false},
+		{"curl", "7.58.0", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		if policy.Allowed(c.name, c.version, c.seen) != c.allowed {
+			t.Errorf("%s %s seen %v should be allowed %v", c.name, c.version, c.seen, c.allowed)
+		}
+	}
+}
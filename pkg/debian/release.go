@@ -0,0 +1,62 @@
+package debian
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+var (
+	pgpSignedMessage = []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+	pgpSignature     = []byte("-----BEGIN PGP SIGNATURE-----")
+)
+
+// Checksum of a file listed in a Release file
+type Checksum struct {
+	Hash string
+	Size int64
+	Path string
+}
+
+// Checksums return the files listed in a checksum field (MD5Sum, SHA1, SHA256 or SHA512) of a Release paragraph
+func (p Paragraph) Checksums(field string) []Checksum {
+	xs := []Checksum{}
+	for _, ln := range strings.Split(p[field], "\n") {
+		f := strings.Fields(ln)
+		if len(f) != 3 {
+			continue
+		}
+		size, _ := strconv.ParseInt(f[1], 10, 64)
+		xs = append(xs, Checksum{f[0], size, f[2]})
+	}
+	return xs
+}
+
+// ParseRelease parse a Release file, or the signed message of a clearsigned InRelease file
+func ParseRelease(data []byte) Paragraph {
+	par, _ := NewControlFileReader(bytes.NewReader(clearsigned(data))).Read()
+	return par
+}
+
+// clearsigned return the message of an OpenPGP clearsigned document, other documents are returned as is
+func clearsigned(data []byte) []byte {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), pgpSignedMessage) {
+		return data
+	}
+
+	// the armor headers end with an empty line
+	start := bytes.Index(data, []byte("\n\n"))
+	if start < 0 {
+		return nil
+	}
+	msg := data[start+2:]
+	if end := bytes.Index(msg, pgpSignature); end >= 0 {
+		msg = msg[:end]
+	}
+
+	lines := bytes.Split(msg, []byte("\n"))
+	for i, ln := range lines {
+		lines[i] = bytes.TrimPrefix(ln, []byte("- ")) // dash-escaped lines
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
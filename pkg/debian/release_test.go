@@ -0,0 +1,30 @@
+package debian
+
+import "testing"
+
+var inrelease = []byte(`-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Suite: bionic
+SHA256:
+ e4d7e5b1ab3b7d54c5e0e3e3b8e0f1e1c1a3b6c4d7e5b1ab3b7d54c5e0e3e3b8 1234 main/binary-amd64/Packages.gz
+ 0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9 5678 main/source/Sources.xz
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+-----END PGP SIGNATURE-----
+`)
+
+func TestParseClearsignedRelease(t *testing.T) {
+	release := ParseRelease(inrelease)
+
+	if release["Suite"] != "bionic" {
+		t.Errorf("expected Suite bionic, got %v", release)
+	}
+
+	sums := release.Checksums("SHA256")
+	if len(sums) != 2 || sums[0].Path != "main/binary-amd64/Packages.gz" || sums[0].Size != 1234 {
+		t.Errorf("expected 2 SHA256 checksums, got %v", sums)
+	}
+}
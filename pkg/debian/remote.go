@@ -3,31 +3,52 @@ package debian
 import (
 	"context"
 	"io"
+	"net/http"
 
 	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/fergusn/muzeum/pkg/cache"
 	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
 type remote struct {
 	Repository
-	cache cache.Cache
+	client *client
+	cache  cache.Cache
 }
 
-// NewRemote initialize a remote repository
-func NewRemote(url string, storage driver.StorageDriver) Repository {
+// NewRemote initialize a remote repository for equivalent upstream mirrors that use client for upstream requests
+func NewRemote(endpoints *upstream.Endpoints, storage driver.StorageDriver, client *http.Client) Repository {
+	c := newClient(client, endpoints, storage)
 	return &remote{
-		Repository: NewClient(url),
+		Repository: c,
+		client:     c,
 		cache:      cache.NewCache(storage),
 	}
 }
 
-// File read the package from the upstream repository and cache it locally.
-func (r *remote) File(ctx context.Context, path string) (rd io.ReadCloser, pkg *model.Package, err error) {
-	// TODO: Return package metadata
-	rd, err = r.cache.Read(ctx, path, func() (rd io.ReadCloser, err error) {
+// ByHash read an index file by its checksum from the cache. By-hash files never change, so they are cached forever.
+func (r *remote) ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error) {
+	path := "/" + concat("dists", dist, dir, "by-hash", algorithm, hash)
+
+	return r.cache.Read(ctx, path, func() (io.ReadCloser, error) {
+		return r.Repository.ByHash(ctx, dist, dir, algorithm, hash)
+	})
+}
+
+// File read the package from the upstream repository and cache it locally. The package is also known for cached files.
+func (r *remote) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	rd, err := r.cache.Read(ctx, path, func() (rd io.ReadCloser, err error) {
 		rd, _, err = r.Repository.File(ctx, path)
 		return
 	})
-	return
+	if err != nil {
+		return nil, nil, err
+	}
+	return rd, r.client.Package(path), nil
+}
+
+// Package return the package of a pool file from the parsed indices
+func (r *remote) Package(path string) *model.Package {
+	return r.client.Package(path)
 }
@@ -15,6 +15,21 @@ type Repository interface {
 	// Index reads the Index file for a disttribution/component/architecture
 	Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error)
 
-	// File reads the deb package
+	// Sources reads the source package index for a distribution/component
+	Sources(ctx context.Context, dist, comp, compression string) (io.ReadCloser, error)
+
+	// Metadata reads any other file of a distribution, e.g. Release, Release.gpg, Sources, Contents or Translation files
+	Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error)
+
+	// ByHash reads an index file in directory dir of a distribution by its checksum, as listed in the InRelease file
+	ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error)
+
+	// Snapshot reads a file of a distribution in a snapshot, by snapshot name or the latest snapshot before a timestamp
+	Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error)
+
+	// File reads the deb package or a file of a source package
 	File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error)
+
+	// Upload a file of a source upload, the .changes file is uploaded last and publish the package
+	Upload(ctx context.Context, filename string, rd io.Reader) (*model.Package, error)
 }
@@ -1,63 +1,148 @@
 package debian
 
 import (
+	"bytes"
 	"io"
-	"strings"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
+	"github.com/fergusn/muzeum/pkg/artifact"
+	"github.com/fergusn/muzeum/pkg/events"
 	"github.com/gorilla/mux"
 )
 
+// publicKey is implemented by repositories that sign their releases
+type publicKey interface {
+	PublicKey(w io.Writer, armored bool) error
+}
+
 // Server is a HTTP debian repository
 type Server struct {
-	name string
-	url  *url.URL
-	repo Repository
+	name     string
+	url      *url.URL
+	repo     Repository
+	redirect bool // redirect pool downloads to the URL of the storage driver
 }
 
 // NewServer creates a new server that delegate requests to a repository
 func NewServer(name string, url *url.URL, repo Repository) *Server {
-	return &Server{name, url, repo}
+	return &Server{name: name, url: url, repo: repo}
 }
 
 // Mount the server routes
 func (srv *Server) Mount(route *mux.Route) {
 	router := route.Subrouter()
 
-	router.Methods(http.MethodGet).Path("/" + concat(srv.url.Path, "dists/{dist}/InRelease")).HandlerFunc(srv.release)
-	router.Methods(http.MethodGet).Path("/" + concat(srv.url.Path, "dists/{dist}/{comp}/binary-{arch}/Packages.{compression}")).HandlerFunc(srv.index)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("dists/{dist}/InRelease")).HandlerFunc(srv.release)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("dists/{dist}/{dir:.+}/by-hash/{algorithm}/{hash}")).HandlerFunc(srv.byhash)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("dists/{dist}/{comp}/binary-{arch}/Packages.{compression}")).HandlerFunc(srv.index)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("dists/{dist}/{comp}/source/Sources.{compression}")).HandlerFunc(srv.sources)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("dists/{dist}/{file:.+}")).HandlerFunc(srv.metadata)
+	router.Methods(http.MethodPut).Path(srv.path("upload/{file}")).HandlerFunc(srv.upload)
 
-	router.Methods(http.MethodGet).Path("/" + concat(srv.url.Path, "dists/{dist}/{comp}/binary-{arch}/by-hash/{algorithm}/{hash}")).HandlerFunc(srv.byhash)
-	
+	// snapshots share the pool, only the distribution metadata is immutable
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("snapshot/{snapshot}/dists/{dist}/{file:.+}")).HandlerFunc(srv.snapshot)
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("snapshot/{snapshot}/{path:.+}")).HandlerFunc(srv.file)
+
+	if key, ok := srv.repo.(publicKey); ok {
+		router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("muzeum.gpg")).HandlerFunc(srv.key(key, false))
+		router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("muzeum.asc")).HandlerFunc(srv.key(key, true))
+	}
+
+	router.Methods(http.MethodGet, http.MethodHead).Path(srv.path("{path:.+}")).HandlerFunc(srv.file)
+}
 
-	router.Methods(http.MethodGet).HandlerFunc(srv.file)
+// path return the route of a repository path, relative to the path of the upstream url
+func (srv *Server) path(path string) string {
+	return "/" + strings.TrimLeft(concat(srv.url.Path, path), "/")
 }
 
 func (srv *Server) release(w http.ResponseWriter, r *http.Request) {
-	write(w)(srv.repo.Release(r.Context(), mux.Vars(r)["dist"]))
+	write(w, r)(srv.repo.Release(r.Context(), mux.Vars(r)["dist"]))
 }
 
 func (srv *Server) index(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	write(w)(srv.repo.Index(r.Context(), vars["dist"], vars["comp"], vars["arch"], vars["compression"]))
+	write(w, r)(srv.repo.Index(r.Context(), vars["dist"], vars["comp"], vars["arch"], vars["compression"]))
+}
+
+func (srv *Server) sources(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	write(w, r)(srv.repo.Sources(r.Context(), vars["dist"], vars["comp"], vars["compression"]))
+}
+
+func (srv *Server) metadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	write(w, r)(srv.repo.Metadata(r.Context(), vars["dist"], vars["file"]))
+}
+
+func (srv *Server) snapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	write(w, r)(srv.repo.Snapshot(r.Context(), vars["snapshot"], vars["dist"], vars["file"]))
 }
 
 func (srv *Server) byhash(w http.ResponseWriter, r *http.Request) {
-	// TODO: we need to read the index file and get the correct index
 	vars := mux.Vars(r)
-	write(w)(srv.repo.Index(r.Context(), vars["dist"], vars["comp"], vars["arch"], "gz"))
+	write(w, r)(srv.repo.ByHash(r.Context(), vars["dist"], vars["dir"], vars["algorithm"], vars["hash"]))
 }
 
 func (srv *Server) file(w http.ResponseWriter, r *http.Request) {
-	rd, _, err := srv.repo.File(r.Context(), strings.TrimPrefix(r.URL.Path, srv.url.Path))
+	path := "/" + mux.Vars(r)["path"]
+	rd, pkg, err := srv.repo.File(r.Context(), path)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status(err))
 		return
 	}
 
-	// TODO: Emit package pulled event. This is not currenly implemented because the local repository does not return package metadata
+	n, complete, redirected := int64(0), false, false
+	if srv.redirect {
+		n, complete, redirected = artifact.Redirect(w, r, rd)
+	}
+	if !redirected {
+		n, complete = artifact.Serve(w, r, path, rd)
+	}
+
+	// HEAD, not modified, partial and failed requests are not pulls, e.g. apt resume interrupted downloads with a range
+	if pkg != nil && complete {
+		events.Package.Pulled.Emit(&events.Pulled{
+			Registry: srv.name,
+			Package:  pkg,
+			Location: r.RemoteAddr,
+			Size:     n,
+		})
+	}
+}
 
-	io.Copy(w, rd)
+func (srv *Server) upload(w http.ResponseWriter, r *http.Request) {
+	pkg, err := srv.repo.Upload(r.Context(), mux.Vars(r)["file"], r.Body)
+	if err != nil {
+		log.Printf("unable to upload %s: %v", r.URL.Path, err)
+		w.WriteHeader(status(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+
+	if pkg != nil {
+		events.Package.Pushed.Emit(&events.Pushed{
+			Registry: srv.name,
+			Package:  pkg,
+			Location: r.RemoteAddr,
+		})
+	}
+}
+
+func (srv *Server) key(key publicKey, armored bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := &bytes.Buffer{}
+		if err := key.PublicKey(buf, armored); err != nil {
+			log.Printf("unable to write public key: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		buf.WriteTo(w)
+	}
 }
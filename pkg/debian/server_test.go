@@ -0,0 +1,206 @@
+package debian
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/events"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/gorilla/mux"
+)
+
+type mockRepository struct {
+	Repository
+	requested []string
+	pkg       *model.Package
+}
+
+func (repo *mockRepository) ok(call string) (io.ReadCloser, error) {
+	repo.requested = append(repo.requested, call)
+	return ioutil.NopCloser(strings.NewReader(call)), nil
+}
+
+func (repo *mockRepository) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	return repo.ok("release " + dist)
+}
+
+func (repo *mockRepository) Index(ctx context.Context, dist, comp, arch, compression string) (io.ReadCloser, error) {
+	return repo.ok("index " + dist + " " + comp + " " + arch + " " + compression)
+}
+
+func (repo *mockRepository) Sources(ctx context.Context, dist, comp, compression string) (io.ReadCloser, error) {
+	return repo.ok("sources " + dist + " " + comp + " " + compression)
+}
+
+func (repo *mockRepository) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	return repo.ok("metadata " + dist + " " + file)
+}
+
+func (repo *mockRepository) ByHash(ctx context.Context, dist, dir, algorithm, hash string) (io.ReadCloser, error) {
+	return repo.ok("byhash " + dist + " " + dir + " " + algorithm + " " + hash)
+}
+
+func (repo *mockRepository) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	return repo.ok("snapshot " + snapshot + " " + dist + " " + file)
+}
+
+func (repo *mockRepository) File(ctx context.Context, path string) (io.ReadCloser, *model.Package, error) {
+	rd, err := repo.ok("file " + path)
+	return rd, repo.pkg, err
+}
+
+func (repo *mockRepository) request(path string) *httptest.ResponseRecorder {
+	router := &mux.Router{}
+	url, _ := url.Parse("http://archive.ubuntu.com/ubuntu")
+	NewServer("test", url, repo).Mount(router.NewRoute())
+
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, path, nil))
+	return rsp
+}
+
+func TestRoutes(t *testing.T) {
+	routes := map[string]string{
+		"/ubuntu/dists/bionic/InRelease":                                         "release bionic",
+		"/ubuntu/dists/bionic/Release.gpg":                                       "metadata bionic Release.gpg",
+		"/ubuntu/dists/bionic/main/binary-amd64/Packages.xz":                     "index bionic main amd64 xz",
+		"/ubuntu/dists/bionic/main/binary-amd64/Packages":                        "metadata bionic main/binary-amd64/Packages",
+		"/ubuntu/dists/bionic/main/source/Sources.xz":                            "sources bionic main xz",
+		"/ubuntu/dists/bionic/main/source/Sources":                               "metadata bionic main/source/Sources",
+		"/ubuntu/dists/bionic/main/i18n/Translation-en.gz":                       "metadata bionic main/i18n/Translation-en.gz",
+		"/ubuntu/dists/bionic/main/Contents-amd64.gz":                            "metadata bionic main/Contents-amd64.gz",
+		"/ubuntu/dists/bionic/main/dep11/Components-amd64.yml.gz":                "metadata bionic main/dep11/Components-amd64.yml.gz",
+		"/ubuntu/dists/bionic/main/i18n/by-hash/SHA256/abcd":                     "byhash bionic main/i18n SHA256 abcd",
+		"/ubuntu/pool/main/a/apt/apt_1.6.1_amd64.deb":                            "file /pool/main/a/apt/apt_1.6.1_amd64.deb",
+		"/ubuntu/snapshot/20200101T000000Z/dists/bionic/InRelease":               "snapshot 20200101T000000Z bionic InRelease",
+		"/ubuntu/snapshot/release-1/dists/bionic/main/binary-amd64/Packages.xz":  "snapshot release-1 bionic main/binary-amd64/Packages.xz",
+		"/ubuntu/snapshot/release-1/pool/main/a/apt/apt_1.6.1_amd64.deb":         "file /pool/main/a/apt/apt_1.6.1_amd64.deb",
+		"/ubuntu/dists/bionic/main/binary-amd64/by-hash/SHA512/0123456789abcdef": "byhash bionic main/binary-amd64 SHA512 0123456789abcdef",
+	}
+
+	for path, expected := range routes {
+		repo := &mockRepository{}
+		repo.request(path)
+
+		if len(repo.requested) != 1 || repo.requested[0] != expected {
+			t.Errorf("%s expected %s, got %v", path, expected, repo.requested)
+		}
+	}
+}
+
+func TestFileEmitPulledEvent(t *testing.T) {
+	pkg := &model.Package{Type: "debian", Name: "apt", Version: "1.6.1", Qualifiers: map[string]string{"arch": "amd64"}}
+	repo := &mockRepository{pkg: pkg}
+
+	pulled := events.Package.Pulled.Receive()
+	go repo.request("/ubuntu/pool/main/a/apt/apt_1.6.1_amd64.deb")
+
+	ev := <-pulled
+	if ev.Registry != "test" || ev.Package != pkg {
+		t.Errorf("expected pulled event for %v, got %v", pkg, ev)
+	}
+	if ev.Size != int64(len("file /pool/main/a/apt/apt_1.6.1_amd64.deb")) {
+		t.Errorf("expected size of the file, got %d", ev.Size)
+	}
+}
+
+func (repo *mockRepository) Upload(ctx context.Context, filename string, rd io.Reader) (*model.Package, error) {
+	repo.requested = append(repo.requested, "upload "+filename)
+	return repo.pkg, nil
+}
+
+func TestUploadEmitPushedEvent(t *testing.T) {
+	pkg := &model.Package{Type: "debian", Name: "hello", Version: "2.10-2", Qualifiers: map[string]string{"arch": "source"}}
+	repo := &mockRepository{pkg: pkg}
+	pushed := events.Package.Pushed.Receive()
+
+	router := &mux.Router{}
+	url, _ := url.Parse("http://archive.ubuntu.com/ubuntu")
+	NewServer("test", url, repo).Mount(router.NewRoute())
+
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, httptest.NewRequest(http.MethodPut, "/ubuntu/upload/hello_2.10-2_source.changes", strings.NewReader("")))
+
+	if rsp.Code != http.StatusCreated || len(repo.requested) != 1 || repo.requested[0] != "upload hello_2.10-2_source.changes" {
+		t.Errorf("expected upload, got %d %v", rsp.Code, repo.requested)
+	}
+	if ev := <-pushed; ev.Registry != "test" || ev.Package != pkg {
+		t.Errorf("expected pushed event for %v, got %v", pkg, ev)
+	}
+}
+
+func TestFileRelativeToRoutePrefix(t *testing.T) {
+	repo := &mockRepository{}
+
+	router := &mux.Router{}
+	NewServer("test", &url.URL{Path: "/"}, repo).Mount(router.PathPrefix("/debian"))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/debian/pool/README", nil))
+
+	if len(repo.requested) != 1 || repo.requested[0] != "file /pool/README" {
+		t.Errorf("expected file relative to the route, got %v", repo.requested)
+	}
+}
+
+func TestFileRangeAndHead(t *testing.T) {
+	mem := inmemory.New()
+	mem.PutContent(context.TODO(), "/pool/README", []byte("0123456789"))
+
+	router := &mux.Router{}
+	url, _ := url.Parse("http://localhost/")
+	NewServer("test", url, NewLocal(mem)).Mount(router.NewRoute())
+
+	head := httptest.NewRecorder()
+	router.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/pool/README", nil))
+	if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected headers of the file, got %d %v", head.Code, head.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/pool/README", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	req.Header.Set("If-Range", head.Header().Get("Etag"))
+
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, req)
+
+	if rsp.Code != http.StatusPartialContent || rsp.Body.String() != "0123" {
+		t.Errorf("expected partial content, got %d %q", rsp.Code, rsp.Body.String())
+	}
+}
+
+func TestFileRangeNotPulled(t *testing.T) {
+	mem := inmemory.New()
+	mem.PutContent(context.TODO(), "/pool/main/a/apt/apt_1.6.1_amd64.deb", []byte("0123456789"))
+
+	router := &mux.Router{}
+	url, _ := url.Parse("http://localhost/")
+	NewServer("test", url, NewLocal(mem)).Mount(router.NewRoute())
+
+	pulled := events.Package.Pulled.Receive()
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/pool/main/a/apt/apt_1.6.1_amd64.deb", nil)
+		req.Header.Set("Range", "bytes=4-")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, req)
+		done <- rsp.Code
+	}()
+
+	select {
+	case ev := <-pulled:
+		t.Errorf("expected no pulled event for a range, got %v", ev)
+	case code := <-done:
+		if code != http.StatusPartialContent {
+			t.Errorf("expected partial content, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected no pulled event for a range")
+	}
+}
@@ -0,0 +1,88 @@
+package debian
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/fergusn/muzeum/internal/pgp"
+)
+
+type signed struct {
+	Repository
+	signer *pgp.Signer
+}
+
+// NewSigned re-sign the release of every distribution in repo with signer. The InRelease, Release and Release.gpg
+// files are generated from the same release, which is read from the InRelease or the Release file of repo.
+func NewSigned(repo Repository, signer *pgp.Signer) Repository {
+	return &signed{repo, signer}
+}
+
+func (s *signed) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	return s.Metadata(ctx, dist, "InRelease")
+}
+
+func (s *signed) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	if !isRelease(file) {
+		return s.Repository.Metadata(ctx, dist, file)
+	}
+
+	return s.sign(file, func() (io.ReadCloser, error) {
+		return s.Repository.Release(ctx, dist)
+	}, func() (io.ReadCloser, error) {
+		return s.Repository.Metadata(ctx, dist, "Release")
+	})
+}
+
+func (s *signed) Snapshot(ctx context.Context, snapshot, dist, file string) (io.ReadCloser, error) {
+	if !isRelease(file) {
+		return s.Repository.Snapshot(ctx, snapshot, dist, file)
+	}
+
+	return s.sign(file, func() (io.ReadCloser, error) {
+		return s.Repository.Snapshot(ctx, snapshot, dist, "InRelease")
+	}, func() (io.ReadCloser, error) {
+		return s.Repository.Snapshot(ctx, snapshot, dist, "Release")
+	})
+}
+
+// PublicKey write the public key that clients use to verify the repository
+func (s *signed) PublicKey(w io.Writer, armored bool) error {
+	return s.signer.PublicKey(w, armored)
+}
+
+// sign read the release from the InRelease, or the Release when there is no InRelease, and write the release file
+func (s *signed) sign(file string, inrelease, release func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	rd, err := inrelease()
+	if err != nil {
+		if rd, err = release(); err != nil {
+			return nil, err
+		}
+	}
+	msg, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return nil, err
+	}
+	msg = clearsigned(msg)
+
+	buf := &bytes.Buffer{}
+	switch file {
+	case "InRelease":
+		err = s.signer.ClearSign(buf, msg)
+	case "Release.gpg":
+		err = s.signer.DetachSign(buf, msg)
+	default:
+		buf = bytes.NewBuffer(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+func isRelease(file string) bool {
+	return file == "InRelease" || file == "Release" || file == "Release.gpg"
+}
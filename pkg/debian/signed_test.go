@@ -0,0 +1,117 @@
+package debian
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fergusn/muzeum/internal/pgp"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const upstreamInRelease = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Suite: bionic
+-----BEGIN PGP SIGNATURE-----
+
+upstream
+-----END PGP SIGNATURE-----
+`
+
+type releaseRepository struct {
+	Repository
+	inrelease string
+}
+
+func (repo *releaseRepository) Release(ctx context.Context, dist string) (io.ReadCloser, error) {
+	if len(repo.inrelease) == 0 {
+		return nil, errUnsigned
+	}
+	return ioutil.NopCloser(strings.NewReader(repo.inrelease)), nil
+}
+
+func (repo *releaseRepository) Metadata(ctx context.Context, dist, file string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("Suite: " + dist + "\n")), nil
+}
+
+func signing(t *testing.T) (*pgp.Signer, openpgp.EntityList) {
+	buf, _ := ioutil.ReadAll(read(t, "signing.asc"))
+	signer, err := pgp.NewSigner(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &bytes.Buffer{}
+	signer.PublicKey(pub, false)
+	keyring, err := openpgp.ReadKeyRing(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, keyring
+}
+
+func TestSignedRelease(t *testing.T) {
+	signer, keyring := signing(t)
+	repo := NewSigned(&releaseRepository{inrelease: upstreamInRelease}, signer)
+
+	rd, err := repo.Release(context.TODO(), "bionic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inrelease, _ := ioutil.ReadAll(rd)
+	blk, _ := clearsign.Decode(inrelease)
+	if blk == nil {
+		t.Fatalf("expected clearsigned InRelease, got %s", inrelease)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(blk.Bytes), blk.ArmoredSignature.Body); err != nil {
+		t.Errorf("InRelease should be signed with the key: %v", err)
+	}
+
+	rd, _ = repo.Metadata(context.TODO(), "bionic", "Release")
+	release, _ := ioutil.ReadAll(rd)
+	rd, _ = repo.Metadata(context.TODO(), "bionic", "Release.gpg")
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(release), rd); err != nil {
+		t.Errorf("Release.gpg should sign the Release: %v", err)
+	}
+	if string(release) != "Origin: Ubuntu\nSuite: bionic\n" {
+		t.Errorf("Release should be the message of the upstream InRelease, got %q", release)
+	}
+}
+
+func TestSignedUnsignedRelease(t *testing.T) {
+	signer, _ := signing(t)
+	repo := NewSigned(&releaseRepository{}, signer)
+
+	rd, err := repo.Release(context.TODO(), "bionic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inrelease, _ := ioutil.ReadAll(rd)
+	if blk, _ := clearsign.Decode(inrelease); blk == nil || !bytes.Contains(blk.Bytes, []byte("Suite: bionic")) {
+		t.Errorf("expected signed Release, got %s", inrelease)
+	}
+}
+
+func TestPublicKeyRoute(t *testing.T) {
+	signer, _ := signing(t)
+
+	router := &mux.Router{}
+	url, _ := url.Parse("http://archive.ubuntu.com/ubuntu")
+	NewServer("test", url, NewSigned(&mockRepository{}, signer)).Mount(router.NewRoute())
+
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/ubuntu/muzeum.asc", nil))
+
+	if rsp.Code != http.StatusOK || !strings.Contains(rsp.Body.String(), "BEGIN PGP PUBLIC KEY BLOCK") {
+		t.Errorf("expected armored public key, got %d %s", rsp.Code, rsp.Body)
+	}
+}
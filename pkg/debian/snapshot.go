@@ -0,0 +1,255 @@
+package debian
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/cache"
+)
+
+const (
+	// SnapshotTime is the format of snapshot names that are created without a name, and of timestamps that select a snapshot
+	SnapshotTime = "20060102T150405Z"
+)
+
+var (
+	errSnapshotExists   = errors.New("snapshot already exists")
+	errSnapshotNotFound = cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "snapshot not found"}
+)
+
+// Snapshot is an immutable copy of the distribution metadata of a proxy repository at a point in time
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Files   int       `json:"files"` // pool files referenced by the indices of the snapshot
+}
+
+// CreateSnapshot copy the distribution metadata in storage to a snapshot, and record the pool files it reference.
+// A snapshot without name is named by its creation time.
+func CreateSnapshot(ctx context.Context, storage driver.StorageDriver, name string) (*Snapshot, error) {
+	s := &Snapshot{Name: name, Created: time.Now().UTC()}
+	if len(s.Name) == 0 {
+		s.Name = s.Created.Format(SnapshotTime)
+	}
+	if _, err := storage.Stat(ctx, snapshotPath(s.Name, "snapshot.json")); err == nil {
+		return nil, errSnapshotExists
+	}
+
+	pool := map[string]bool{}
+	err := storage.Walk(ctx, "/dists", func(fi driver.FileInfo) error {
+		path := fi.Path()
+		if fi.IsDir() {
+			if pathpkg.Base(path) == "by-hash" {
+				return driver.ErrSkipDir // by-hash files are resolved from the InRelease of the snapshot
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".meta") || strings.HasSuffix(path, ".download") {
+			return nil
+		}
+
+		if err := copyFile(ctx, storage, path, snapshotPath(s.Name, path)); err != nil {
+			return err
+		}
+		return referenced(ctx, storage, path, pathpkg.Base(path), pool)
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, errors.New("no distribution metadata to snapshot")
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(pool))
+	for filename := range pool {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	s.Files = len(files)
+
+	if err = storage.PutContent(ctx, snapshotPath(s.Name, "pool"), []byte(strings.Join(files, "\n"))); err != nil {
+		return nil, err
+	}
+
+	// the snapshot is complete when its description is stored
+	buf, _ := json.Marshal(s)
+	return s, storage.PutContent(ctx, snapshotPath(s.Name, "snapshot.json"), buf)
+}
+
+// Snapshots list the complete snapshots in storage
+func Snapshots(ctx context.Context, storage driver.StorageDriver) ([]Snapshot, error) {
+	dirs, err := storage.List(ctx, snapshotPath())
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	xs := []Snapshot{}
+	for _, dir := range dirs {
+		buf, err := storage.GetContent(ctx, dir+"/snapshot.json")
+		if err != nil {
+			continue
+		}
+		s := Snapshot{}
+		if err = json.Unmarshal(buf, &s); err == nil {
+			xs = append(xs, s)
+		}
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].Created.Before(xs[j].Created) })
+	return xs, nil
+}
+
+// Retained return the pool files referenced by any snapshot, which must not be removed from storage. Collect keep them
+// when they are no longer in a cached index, it is the only removal of pool files.
+func Retained(ctx context.Context, storage driver.StorageDriver) (map[string]bool, error) {
+	snapshots, err := Snapshots(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]bool{}
+	for _, s := range snapshots {
+		buf, err := storage.GetContent(ctx, snapshotPath(s.Name, "pool"))
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range strings.Split(string(buf), "\n") {
+			if len(filename) > 0 {
+				files["/"+filename] = true
+			}
+		}
+	}
+	return files, nil
+}
+
+// resolveSnapshot return the snapshot with the name, or the latest snapshot created at or before a timestamp
+func resolveSnapshot(ctx context.Context, storage driver.StorageDriver, name string) (string, error) {
+	snapshots, err := Snapshots(ctx, storage)
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range snapshots {
+		if s.Name == name {
+			return name, nil
+		}
+	}
+
+	at, err := time.Parse(SnapshotTime, name)
+	if err != nil {
+		return "", errSnapshotNotFound
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Created.After(at) {
+			return snapshots[i].Name, nil
+		}
+	}
+	return "", errSnapshotNotFound
+}
+
+// readSnapshot read a file of a distribution in a snapshot. By-hash files are resolved from the InRelease of the snapshot.
+func readSnapshot(ctx context.Context, storage driver.StorageDriver, snapshot, dist, file string) (io.ReadCloser, error) {
+	name, err := resolveSnapshot(ctx, storage, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(file, "/")
+	if n := len(parts); n >= 3 && parts[n-3] == "by-hash" {
+		algorithm, hash, dir := parts[n-2], parts[n-1], strings.Join(parts[:n-3], "/")
+
+		buf, err := storage.GetContent(ctx, snapshotPath(name, "dists", dist, "InRelease"))
+		if err != nil {
+			return nil, errSnapshotNotFound
+		}
+		file = ""
+		for _, sum := range ParseRelease(buf).Checksums(algorithm) {
+			if sum.Hash == hash && pathpkg.Dir(sum.Path) == dir {
+				file = sum.Path
+				break
+			}
+		}
+		if len(file) == 0 {
+			return nil, errSnapshotNotFound
+		}
+	}
+
+	rd, err := storage.Reader(ctx, snapshotPath(name, "dists", dist, file), 0)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, errSnapshotNotFound
+	}
+	return rd, err
+}
+
+// referenced add the pool files listed in a Packages or Sources index to pool, other files are ignored. The index is
+// named by base, by-hash files are named by their hash.
+func referenced(ctx context.Context, storage driver.StorageDriver, path, base string, pool map[string]bool) error {
+	name, compression := strings.TrimSuffix(base, pathpkg.Ext(base)), strings.TrimPrefix(pathpkg.Ext(base), ".")
+	if name != "Packages" && name != "Sources" {
+		return nil
+	}
+
+	rd, err := storage.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	var r io.Reader = bufio.NewReader(rd)
+	if len(compression) > 0 {
+		if r, err = decompress(r, compression); err != nil {
+			return nil // unknown compression, apt read one of the other compressions
+		}
+	}
+
+	files := binaryFiles
+	if name == "Sources" {
+		files = sourceFiles
+	}
+
+	paragraphs := NewControlFileReader(r)
+	for {
+		par, more := paragraphs.Read()
+		if !more {
+			return nil
+		}
+		for filename := range files(par) {
+			if len(filename) > 0 {
+				pool[strings.TrimLeft(filename, "/")] = true
+			}
+		}
+	}
+}
+
+func copyFile(ctx context.Context, storage driver.StorageDriver, from, to string) error {
+	rd, err := storage.Reader(ctx, from, 0)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	wr, err := storage.Writer(ctx, to, false)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		wr.Cancel()
+		return err
+	}
+	if err = wr.Commit(); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+func snapshotPath(parts ...string) string {
+	return "/" + concat(append([]string{"snapshots"}, parts...)...)
+}
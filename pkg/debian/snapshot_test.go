@@ -0,0 +1,69 @@
+package debian
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestSnapshotKeepMetadata(t *testing.T) {
+	index, _ := ioutil.ReadAll(read(t, "Packages.gz"))
+	sum := sha256.Sum256(index)
+	hash := hex.EncodeToString(sum[:])
+
+	s := inmemory.New()
+	s.PutContent(context.TODO(), "/dists/kubernetes-xenial/InRelease", []byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages.gz\n", hash, len(index))))
+	s.PutContent(context.TODO(), "/dists/kubernetes-xenial/InRelease.meta", []byte("{}"))
+	s.PutContent(context.TODO(), "/dists/kubernetes-xenial/main/binary-amd64/Packages.gz", index)
+
+	snapshot, err := CreateSnapshot(context.TODO(), s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateSnapshot(context.TODO(), s, snapshot.Name); err != errSnapshotExists {
+		t.Errorf("snapshots should be immutable, got %v", err)
+	}
+
+	s.PutContent(context.TODO(), "/dists/kubernetes-xenial/InRelease", []byte("updated"))
+	repo := NewClient(http.DefaultClient, "https://packages.cloud.google.com/apt", s)
+
+	for _, name := range []string{snapshot.Name, time.Now().UTC().Add(time.Hour).Format(SnapshotTime)} {
+		rd, err := repo.Snapshot(context.TODO(), name, "kubernetes-xenial", "InRelease")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf, _ := ioutil.ReadAll(rd); string(buf) == "updated" {
+			t.Errorf("snapshot %s should not change", name)
+		}
+	}
+
+	rd, err := repo.Snapshot(context.TODO(), snapshot.Name, "kubernetes-xenial", "main/binary-amd64/by-hash/SHA256/"+hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadAll(rd); len(buf) != len(index) {
+		t.Errorf("by-hash should be resolved from the snapshot InRelease")
+	}
+
+	if _, err = repo.Snapshot(context.TODO(), "20000101T000000Z", "kubernetes-xenial", "InRelease"); status(err) != http.StatusNotFound {
+		t.Errorf("no snapshot before the first snapshot, got %v", err)
+	}
+	if _, err = s.Stat(context.TODO(), "/snapshots/"+snapshot.Name+"/dists/kubernetes-xenial/InRelease.meta"); err == nil {
+		t.Errorf("validators should not be in a snapshot")
+	}
+
+	retained, err := Retained(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retained) != snapshot.Files || !retained["/pool/cri-tools_1.11.0-00_amd64_768e5551f9badfde12b10c42c88afb45c412c1bf307a5985a4b29f4499d341bd.deb"] {
+		t.Errorf("pool files of the snapshot should be retained, got %d", len(retained))
+	}
+}
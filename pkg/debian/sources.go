@@ -0,0 +1,44 @@
+package debian
+
+import (
+	"strings"
+
+	"github.com/fergusn/muzeum/pkg/model"
+)
+
+// binaryFiles return the pool file of a Packages paragraph
+func binaryFiles(par Paragraph) map[string]*model.Package {
+	return map[string]*model.Package{
+		par.Filename(): {
+			Type:       "debian",
+			Name:       par.Package(),
+			Version:    par.Version(),
+			Qualifiers: map[string]string{"arch": par.Architecture()},
+		},
+	}
+}
+
+// sourceFiles return the pool files of a Sources paragraph, all files are attributed to the source package
+func sourceFiles(par Paragraph) map[string]*model.Package {
+	pkg := &model.Package{
+		Type:       "debian",
+		Name:       par.Package(),
+		Version:    par.Version(),
+		Qualifiers: map[string]string{"arch": "source"},
+	}
+
+	px := map[string]*model.Package{}
+	for _, f := range par.Checksums("Files") {
+		px[concat(par.Directory(), f.Path)] = pkg
+	}
+	return px
+}
+
+// poolDirectory return the pool directory of a source package, e.g. pool/main/libc/libcap2 or pool/contrib/h/hello
+func poolDirectory(comp, source string) string {
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+	return concat("pool", comp, prefix, source)
+}
@@ -2,14 +2,30 @@ package debian
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
 	"net/http"
+	"net/url"
+	pathpkg "path"
 	"strings"
 
+	"github.com/fergusn/muzeum/pkg/artifact"
+	"github.com/fergusn/muzeum/pkg/cache"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/upstream"
 	"github.com/smira/go-xz"
 )
 
+var (
+	errAlgorithm = cache.ErrHTTP{StatusCode: http.StatusNotFound, Status: "unsupported by-hash algorithm"}
+	errChecksum  = errors.New("checksum mismatch")
+	errReadOnly  = cache.ErrHTTP{StatusCode: http.StatusMethodNotAllowed, Status: "proxy repository does not accept uploads"}
+)
+
 func concat(parts ...string) (url string) {
 	for i, x := range parts {
 		if i > 0 && !strings.HasSuffix(url, "/") {
@@ -28,14 +44,59 @@ func concat(parts ...string) (url string) {
 	return
 }
 
-func write(w http.ResponseWriter) func(io.ReadCloser, error) {
-	return func(r io.ReadCloser, err error) {
+func write(w http.ResponseWriter, r *http.Request) func(io.ReadCloser, error) {
+	return func(rd io.ReadCloser, err error) {
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(status(err))
 			return
 		}
-		io.Copy(w, r)
+		artifact.Serve(w, r, r.URL.Path, rd)
+	}
+}
+
+// status return the HTTP status for an error. Files that are not cached while offline, or missing upstream, are not found.
+// Uploads that exceed the quota are rejected, and other client errors keep their status.
+func status(err error) int {
+	var e cache.ErrHTTP
+	if status := artifact.QuotaStatus(err); status > 0 {
+		return status
+	} else if errors.Is(err, upstream.ErrOffline) {
+		return http.StatusNotFound
+	} else if errors.Is(err, upstream.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	} else if errors.As(err, &e) && e.StatusCode >= http.StatusBadRequest && e.StatusCode < http.StatusInternalServerError {
+		return e.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// verify return a reader that fail at EOF if the content does not match the hash
+func verify(r io.ReadCloser, algorithm, sum string) (io.ReadCloser, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "SHA256":
+		h = sha256.New()
+	case "SHA512":
+		h = sha512.New()
+	default:
+		return nil, errAlgorithm
+	}
+	return &verifier{r, h, sum}, nil
+}
+
+type verifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return n, errChecksum
 	}
+	return n, err
 }
 
 func decompress(r io.Reader, algo string) (io.Reader, error) {
@@ -47,3 +108,27 @@ func decompress(r io.Reader, algo string) (io.Reader, error) {
 		return nil, errors.New("unkown compression algorithm")
 	}
 }
+
+// parseFilename return the package of a pool file named <name>_<version>_<arch>.deb or <name>_<version>.dsc, or nil for other files
+func parseFilename(path string) *model.Package {
+	base := pathpkg.Base(path)
+	ext := pathpkg.Ext(base)
+
+	parts := strings.Split(strings.TrimSuffix(base, ext), "_")
+	if ext == ".dsc" && len(parts) == 2 {
+		parts = append(parts, "source")
+	} else if (ext != ".deb" && ext != ".udeb") || len(parts) != 3 {
+		return nil
+	}
+	version, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	return &model.Package{
+		Type:       "debian",
+		Name:       parts[0],
+		Version:    version,
+		Qualifiers: map[string]string{"arch": parts[2]},
+	}
+}
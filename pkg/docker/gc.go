@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// partial uploads and recently stored blobs are kept for a day, a pushed blob is referenced when its manifest is pushed
+var retain = 24 * time.Hour
+
+var errEnumerate = errors.New("registry storage can not enumerate")
+
+// Collect delete the blobs that are not referenced by a manifest of any repository in the registry, and the partial
+// uploads, and return their paths. A dry run only report them.
+func Collect(ctx context.Context, bucket driver.StorageDriver, dryRun bool) ([]string, error) {
+	registry, err := storage.NewRegistry(ctx, bucket, storage.EnableSchema1)
+	if err != nil {
+		return nil, err
+	}
+	repositories, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, errEnumerate
+	}
+
+	marked := map[digest.Digest]bool{}
+	err = repositories.Enumerate(ctx, func(name string) error {
+		named, err := reference.WithName(name)
+		if err != nil {
+			return err
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			return err
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			return err
+		}
+		enumerator, ok := manifests.(distribution.ManifestEnumerator)
+		if !ok {
+			return errEnumerate
+		}
+
+		err = enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			marked[dgst] = true
+			manifest, err := manifests.Get(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("manifest %s of %s: %v", dgst, name, err)
+			}
+			for _, ref := range manifest.References() {
+				marked[ref.Digest] = true
+			}
+			return nil
+		})
+		// a repository without manifests, e.g. of an unfinished upload
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	old := time.Now().Add(-retain)
+	unreferenced := []digest.Digest{}
+	removed := []string{}
+	err = registry.Blobs().Enumerate(ctx, func(dgst digest.Digest) error {
+		if marked[dgst] {
+			return nil
+		}
+		path := blobPath(dgst)
+		if fi, err := bucket.Stat(ctx, path); err != nil || !fi.ModTime().Before(old) {
+			return nil
+		}
+		unreferenced = append(unreferenced, dgst)
+		removed = append(removed, path)
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		vacuum := storage.NewVacuum(ctx, bucket)
+		for _, dgst := range unreferenced {
+			if err = vacuum.RemoveBlob(string(dgst)); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	// uploads are in the repositories, a registry without repositories is empty
+	if _, err = bucket.Stat(ctx, "/docker/registry/v2/repositories"); err == nil {
+		uploads, errs := storage.PurgeUploads(ctx, bucket, old, !dryRun)
+		removed = append(removed, uploads...)
+		if len(errs) > 0 {
+			return removed, errs[0]
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+func blobPath(dgst digest.Digest) string {
+	return fmt.Sprintf("/docker/registry/v2/blobs/%s/%s/%s/data", dgst.Algorithm(), dgst.Hex()[:2], dgst.Hex())
+}
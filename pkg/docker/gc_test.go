@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+
+	registry, err := storage.NewRegistry(ctx, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, _ := reference.WithName("library/alpine")
+	repo, _ := registry.Repository(ctx, named)
+	blobs := repo.Blobs(ctx)
+
+	config, _ := blobs.Put(ctx, schema2.MediaTypeImageConfig, []byte("{}"))
+	layer, _ := blobs.Put(ctx, schema2.MediaTypeLayer, []byte("layer"))
+	orphan, _ := blobs.Put(ctx, schema2.MediaTypeLayer, []byte("orphan"))
+
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, _ := repo.Manifests(ctx)
+	if _, err = manifests.Put(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d time.Duration) { retain = d }(retain)
+	retain = 0
+
+	expected := []string{blobPath(orphan.Digest)}
+	removed, err := Collect(ctx, mem, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected unreferenced blob %v, got %v", expected, removed)
+	}
+
+	if _, err = Collect(ctx, mem, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mem.Stat(ctx, blobPath(orphan.Digest)); err == nil {
+		t.Error("expected unreferenced blob to be deleted")
+	}
+	if _, err = mem.Stat(ctx, blobPath(layer.Digest)); err != nil {
+		t.Error("expected referenced blob to be kept")
+	}
+}
+
+func TestCollectEmpty(t *testing.T) {
+	if removed, err := Collect(context.TODO(), inmemory.New(), true); err != nil || len(removed) > 0 {
+		t.Errorf("expected nothing to collect, got %v %v", removed, err)
+	}
+}
@@ -2,20 +2,26 @@ package docker
 
 import (
 	"context"
+	"net/http"
+	"strings"
 
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/registry/handlers"
 
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/artifact"
 	"github.com/fergusn/muzeum/pkg/plugins"
+	"github.com/fergusn/muzeum/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
 func init() {
 	plugins.Plugins["docker"] = register
+	plugins.Collectors["docker"] = collectRepository
 }
 
-func register(r *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver) error {
+// register a docker registry. The registry proxy use its own transport, so client is not used.
+func register(r *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error {
 	cfg := &configuration.Configuration{
 		Compatibility: struct {
 			Schema1 struct {
@@ -46,14 +52,37 @@ func register(r *mux.Route, name string, config map[string]interface{}, bucket d
 			},
 		},
 	}
+	var quota *storage.QuotaDriver
 	if proxy, ok := config["proxy"]; ok {
 		cfg.Proxy = configuration.Proxy{
 			RemoteURL: proxy.(string),
 		}
+	} else {
+		var err error
+		if quota, err = plugins.Quota(name, config, bucket, isManifest); err != nil {
+			return err
+		}
+		if quota != nil {
+			cfg.Storage[muzeumFactory]["driver"] = quota
+		}
 	}
 
 	app := handlers.NewApp(context.Background(), cfg)
-	r.Handler(app)
+	if quota != nil {
+		// the registry does not report storage errors, uploads are checked before they are stored
+		r.Handler(artifact.Limit(quota, app))
+	} else {
+		r.Handler(app)
+	}
 
 	return nil
 }
+
+// isManifest return true for the path of a manifest revision, which count toward the quota of a repository
+func isManifest(path string) bool {
+	return strings.Contains(path, "/_manifests/revisions/") && strings.HasSuffix(path, "/link")
+}
+
+func collectRepository(ctx context.Context, name string, bucket driver.StorageDriver, dryRun bool) ([]string, error) {
+	return Collect(ctx, bucket, dryRun)
+}
@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	artifacts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mirror_artifacts",
+		Help: "The number of artifacts found by the current or last mirror run",
+	}, []string{"registry"})
+
+	completed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mirror_artifacts_completed",
+		Help: "The number of artifacts mirrored by the current or last mirror run",
+	}, []string{"registry", "result"})
+
+	finished = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mirror_last_run_timestamp_seconds",
+		Help: "The time the last mirror run finished",
+	}, []string{"registry"})
+)
+
+// Run fetch every artifact, with at most concurrency fetches in flight, and publish the progress as metrics of
+// registry name. Artifacts already in storage are not downloaded again by the cache, so an interrupted run is
+// resumed by running it again. Failed artifacts are logged and do not stop the run.
+func Run(ctx context.Context, name string, concurrency int, found <-chan string, fetch func(ctx context.Context, artifact string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	artifacts.WithLabelValues(name).Set(0)
+	completed.WithLabelValues(name, "success").Set(0)
+	completed.WithLabelValues(name, "failure").Set(0)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		total    int
+		failures int
+	)
+
+	sem := make(chan struct{}, concurrency)
+	for artifact := range found {
+		total++
+		artifacts.WithLabelValues(name).Inc()
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue // drain the producer
+		}
+
+		wg.Add(1)
+		go func(artifact string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := fetch(ctx, artifact); err != nil {
+				logrus.Errorf("mirror %s: %s: %v", name, artifact, err)
+				completed.WithLabelValues(name, "failure").Inc()
+
+				mu.Lock()
+				failures++
+				mu.Unlock()
+				return
+			}
+			completed.WithLabelValues(name, "success").Inc()
+		}(artifact)
+	}
+	wg.Wait()
+
+	finished.WithLabelValues(name).SetToCurrentTime()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("mirror %s: %d of %d artifacts failed", name, failures, total)
+	}
+	logrus.Infof("mirror %s: %d artifacts mirrored", name, total)
+	return nil
+}
+
+// Schedule run job now and then every interval, until ctx is done
+func Schedule(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(ctx); err != nil {
+			logrus.Errorf("mirror %s: %v", name, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func list(xs ...string) <-chan string {
+	ch := make(chan string, len(xs))
+	for _, x := range xs {
+		ch <- x
+	}
+	close(ch)
+	return ch
+}
+
+func TestRunFetchAllArtifacts(t *testing.T) {
+	fetched := map[string]bool{}
+	mu := sync.Mutex{}
+
+	err := Run(context.TODO(), "test", 2, list("a", "b", "c"), func(ctx context.Context, artifact string) error {
+		mu.Lock()
+		fetched[artifact] = true
+		mu.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 3 {
+		t.Errorf("expected 3 artifacts fetched, got %v", fetched)
+	}
+}
+
+func TestRunLimitConcurrency(t *testing.T) {
+	inflight, max := 0, 0
+	mu := sync.Mutex{}
+
+	Run(context.TODO(), "test", 2, list("a", "b", "c", "d", "e"), func(ctx context.Context, artifact string) error {
+		mu.Lock()
+		inflight++
+		if inflight > max {
+			max = inflight
+		}
+		mu.Unlock()
+
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return nil
+	})
+
+	if max > 2 {
+		t.Errorf("expected at most 2 concurrent fetches, got %d", max)
+	}
+}
+
+func TestRunContinueAfterFailure(t *testing.T) {
+	count := 0
+	mu := sync.Mutex{}
+
+	err := Run(context.TODO(), "test", 1, list("a", "b"), func(ctx context.Context, artifact string) error {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		if artifact == "a" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if err == nil {
+		t.Error("expected failed artifacts to be reported")
+	}
+	if count != 2 {
+		t.Errorf("expected all artifacts fetched, got %d", count)
+	}
+}
@@ -3,86 +3,129 @@ package nuget
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-)
+	"sync"
 
-var (
-	httpClient = http.DefaultClient
+	"github.com/fergusn/muzeum/pkg/cache"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
-// NewClient creates a client repository
-func NewClient(indexURL string) (Repository, error) {
-	rsp, err := httpClient.Get(indexURL)
-
-	if err != nil {
-		return nil, err
-	}
-	defer rsp.Body.Close()
+// NewClient creates a client repository that use the http client of the upstream, see upstream.NewClient
+func NewClient(hc *http.Client, indexURL string) (Repository, error) {
+	c := newClient(hc, cache.NewResourceWithHTTPClient(hc, indexURL))
 
-	idx := &ServiceIndex{}
-	if err = json.NewDecoder(rsp.Body).Decode(idx); err != nil {
+	if _, err := c.resource(context.Background(), PackageBaseAddress); err != nil {
 		return nil, err
 	}
+	return c, nil
+}
 
-	resources := map[ResourceType]string{}
-	for _, x := range idx.Resources {
-		resources[x.Type] = x.ID
-	}
-
-	return &client{resources}, nil
+// newClient creates a client that read the service index on first use
+func newClient(hc *http.Client, index cache.Resource) *client {
+	return &client{http: hc, index: index}
 }
 
 type client struct {
+	http      *http.Client
+	index     cache.Resource
 	resources map[ResourceType]string
+	mu        sync.Mutex
 }
 
-func (client *client) Versions(ctx context.Context, id string) Versions {
-	url := fmt.Sprintf("%s%s/index.json", client.resources[PackageBaseAddress], id)
+// resource return the URL of a resource type from the service index
+func (client *client) resource(ctx context.Context, t ResourceType) (string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.resources == nil {
+		rd, _, err := client.index.Get(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer rd.Close()
+
+		idx := &ServiceIndex{}
+		if err = json.NewDecoder(rd).Decode(idx); err != nil {
+			return "", err
+		}
+
+		client.resources = map[ResourceType]string{}
+		for _, x := range idx.Resources {
+			client.resources[x.Type] = x.ID
+		}
+	}
 
-	rsp, err := httpClient.Get(url)
+	return client.resources[t], nil
+}
+
+func (client *client) get(ctx context.Context, t ResourceType, format string, args ...interface{}) (*http.Response, error) {
+	base, err := client.resource(ctx, t)
 	if err != nil {
-		return Versions{Status: http.StatusInternalServerError}
+		return nil, unavailable(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+fmt.Sprintf(format, args...), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := client.http.Do(req)
+	if err != nil {
+		return nil, unavailable(err)
 	}
 	if rsp.StatusCode != 200 {
-		return Versions{Status: rsp.StatusCode}
+		rsp.Body.Close()
+		return nil, httpError{rsp.StatusCode, rsp.Status}
+	}
+	return rsp, nil
+}
+
+func (client *client) Versions(ctx context.Context, id string) Versions {
+	rsp, err := client.get(ctx, PackageBaseAddress, "%s/index.json", id)
+	if err, ok := err.(httpError); ok {
+		return Versions{Status: err.code}
+	}
+	if err != nil {
+		return Versions{Status: http.StatusInternalServerError}
 	}
 
 	return Versions{ReadCloser: rsp.Body}
 }
 
 func (client *client) Download(ctx context.Context, id, version string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("%s%s/%s/%s.%s.nupkg", client.resources[PackageBaseAddress], id, version, id, version)
-
-	rsp, err := httpClient.Get(url)
+	rsp, err := client.get(ctx, PackageBaseAddress, "%s/%s/%s.%s.nupkg", id, version, id, version)
 	if err != nil {
 		return nil, err
 	}
-	if rsp.StatusCode != 200 {
-		return nil, httpError{rsp.StatusCode, rsp.Status}
-	}
 
 	return rsp.Body, nil
 }
 
-func (client *client) Upload(ctx context.Context, nupkg io.Reader) error {
-	return errNotImplemented
+func (client *client) Upload(ctx context.Context, nupkg io.Reader) (*model.Package, error) {
+	return nil, errNotImplemented
 }
 func (client *client) Delete(ctx context.Context, id, version string) error {
 	return errNotImplemented
 }
 func (client *client) Search(ctx context.Context, text string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("%s?q=%s", client.resources[SearchQueryService], text)
-
-	rsp, err := httpClient.Get(url)
-
+	rsp, err := client.get(ctx, SearchQueryService, "?q=%s", text)
 	if err != nil {
 		return nil, err
 	}
-	if rsp.StatusCode != 200 {
-		return nil, httpError{rsp.StatusCode, rsp.Status}
-	}
 
 	return rsp.Body, nil
 }
+
+// unavailable map an offline upstream to a not found error and an open circuit to service unavailable, other errors are returned as is
+func unavailable(err error) error {
+	if errors.Is(err, upstream.ErrOffline) {
+		return errOffline
+	} else if errors.Is(err, upstream.ErrCircuitOpen) {
+		return errUnavailable
+	}
+	return err
+}
@@ -19,7 +19,7 @@ func mock(roundTrip func(r *http.Request) (*http.Response, error)) *http.Client
 }
 
 func TestVersions(t *testing.T) {
-	httpClient = mock(func(r *http.Request) (*http.Response, error) {
+	httpClient := mock(func(r *http.Request) (*http.Response, error) {
 		if r.URL.Path == "/v3/index.json" {
 			return &http.Response{
 				StatusCode: 200,
@@ -34,7 +34,7 @@ func TestVersions(t *testing.T) {
 		return &http.Response{StatusCode: http.StatusNotFound}, nil
 	})
 
-	client, err := NewClient("https://api.nuget.org/v3/index.json")
+	client, err := NewClient(httpClient, "https://api.nuget.org/v3/index.json")
 
 	if err != nil {
 		t.Fatal(err)
@@ -52,7 +52,7 @@ func TestVersions(t *testing.T) {
 }
 
 func TestDownLoad(t *testing.T) {
-	httpClient = mock(func(r *http.Request) (*http.Response, error) {
+	httpClient := mock(func(r *http.Request) (*http.Response, error) {
 		if r.URL.Path == "/v3/index.json" {
 			return &http.Response{
 				StatusCode: 200,
@@ -67,7 +67,7 @@ func TestDownLoad(t *testing.T) {
 		return &http.Response{StatusCode: http.StatusNotFound}, nil
 	})
 
-	client, err := NewClient("https://api.nuget.org/v3/index.json")
+	client, err := NewClient(httpClient, "https://api.nuget.org/v3/index.json")
 
 	if err != nil {
 		t.Fatal(err)
@@ -88,7 +88,17 @@ func TestDownLoad(t *testing.T) {
 }
 
 func TestSearch(t *testing.T) {
-	client, err := NewClient("https://api.nuget.org/v3/index.json")
+	httpClient := mock(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/v3/index.json" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       read(t, "index.json"),
+			}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound}, nil
+	})
+
+	client, err := NewClient(httpClient, "https://api.nuget.org/v3/index.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,65 @@
+package nuget
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/upstream"
+)
+
+// failover is a client repository for equivalent upstream mirrors. Requests are sent to the next mirror when a mirror fail.
+type failover struct {
+	endpoints *upstream.Endpoints
+	clients   map[string]Repository
+}
+
+func (f *failover) Versions(ctx context.Context, id string) (versions Versions) {
+	for _, url := range f.endpoints.URLs() {
+		if versions = f.clients[url].Versions(ctx, id); versions.Status < http.StatusInternalServerError {
+			return
+		}
+		f.endpoints.Failed(url)
+	}
+	return
+}
+
+func (f *failover) Download(ctx context.Context, id, version string) (rd io.ReadCloser, err error) {
+	for _, url := range f.endpoints.URLs() {
+		if rd, err = f.clients[url].Download(ctx, id, version); !failed(err) {
+			return
+		}
+		f.endpoints.Failed(url)
+	}
+	return
+}
+
+func (f *failover) Upload(ctx context.Context, nupkg io.Reader) (*model.Package, error) {
+	return nil, errNotImplemented
+}
+
+func (f *failover) Delete(ctx context.Context, id, version string) error {
+	return errNotImplemented
+}
+
+func (f *failover) Search(ctx context.Context, text string) (rd io.ReadCloser, err error) {
+	for _, url := range f.endpoints.URLs() {
+		if rd, err = f.clients[url].Search(ctx, text); !failed(err) {
+			return
+		}
+		f.endpoints.Failed(url)
+	}
+	return
+}
+
+// failed return true for errors that another mirror might not have, i.e. network errors and 5xx responses
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err, ok := err.(httpError); ok {
+		return err.code >= http.StatusInternalServerError
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package nuget
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+// partial downloads and packages are kept for a day, they may be in progress
+var retain = 24 * time.Hour
+
+// Collect delete the orphaned files of a repository in storage, and return their paths. A dry run only report them.
+// Orphans are version directories without a package, e.g. the .nuspec of a deleted package, packages that are not a
+// valid zip, i.e. partial or overwritten, and partial downloads and validators of the stored service indices.
+func Collect(ctx context.Context, storage driver.StorageDriver, dryRun bool) ([]string, error) {
+	files := map[string]driver.FileInfo{}
+	versions := map[string]bool{}
+	err := storage.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			files[fi.Path()] = fi
+		} else if strings.Count(fi.Path(), "/") == 2 {
+			versions[fi.Path()] = true
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	old := time.Now().Add(-retain)
+	removed := []string{}
+	for path, fi := range files {
+		if strings.HasSuffix(path, ".download") && fi.ModTime().Before(old) {
+			removed = append(removed, path)
+		} else if body := strings.TrimSuffix(path, ".meta"); body != path {
+			if _, ok := files[body]; !ok {
+				removed = append(removed, path)
+			}
+		}
+	}
+
+	for dir := range versions {
+		parts := strings.Split(strings.TrimPrefix(dir, "/"), "/")
+		nupkg := path(parts[0], parts[1])
+
+		fi, ok := files[nupkg]
+		if !ok || (fi.ModTime().Before(old) && !valid(ctx, storage, fi)) {
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(removed)
+
+	if dryRun {
+		return removed, nil
+	}
+	for _, path := range removed {
+		if err := storage.Delete(ctx, path); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// valid return true when a package is a zip, only the central directory is read
+func valid(ctx context.Context, storage driver.StorageDriver, fi driver.FileInfo) bool {
+	_, err := zip.NewReader(readerAt{ctx, storage, fi.Path()}, fi.Size())
+	return err == nil
+}
+
+type readerAt struct {
+	ctx     context.Context
+	storage driver.StorageDriver
+	path    string
+}
+
+func (r readerAt) ReadAt(p []byte, off int64) (int, error) {
+	rd, err := r.storage.Reader(r.ctx, r.path, off)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	n, err := io.ReadFull(rd, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,63 @@
+package nuget
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver/testdriver"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.TODO()
+	s := testdriver.New()
+
+	rd := read(t, "xunit.2.4.1.nupkg")
+	defer rd.Close()
+	if _, err := NewLocal(s).Upload(ctx, rd); err != nil {
+		t.Fatal(err)
+	}
+	s.PutContent(ctx, "/abcd/1.0/abcd.nuspec", []byte("<package />"))
+	s.PutContent(ctx, path("efgh", "1.0"), []byte("<package />"))
+	s.PutContent(ctx, "/index.json.download", []byte("{"))
+	s.PutContent(ctx, "/index.1.json.meta", []byte("{}"))
+
+	defer func(d time.Duration) { retain = d }(retain)
+	retain = 0
+
+	orphans := []string{"/abcd/1.0", "/efgh/1.0", "/index.1.json.meta", "/index.json.download"}
+	removed, err := Collect(ctx, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, orphans) {
+		t.Errorf("expected orphans %v, got %v", orphans, removed)
+	}
+	if _, err = s.Stat(ctx, path("xunit", "2.4.1")); err != nil {
+		t.Error("expected valid package to be kept")
+	}
+	if _, err = s.Stat(ctx, path("efgh", "1.0")); err == nil {
+		t.Error("expected invalid package to be deleted")
+	}
+}
+
+func TestDeleteVersion(t *testing.T) {
+	ctx := context.TODO()
+	s := testdriver.New()
+	repo := NewLocal(s)
+
+	rd := read(t, "xunit.2.4.1.nupkg")
+	defer rd.Close()
+	repo.Upload(ctx, rd)
+
+	if _, err := s.Stat(ctx, "/xunit/2.4.1/xunit.nuspec"); err != nil {
+		t.Errorf("expected nuspec next to the package, got %v", err)
+	}
+	if err := repo.Delete(ctx, "xunit", "2.4.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/xunit/2.4.1"); err == nil {
+		t.Error("expected version directory to be deleted")
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
 
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/storage"
 )
 
 // NewLocalRepository initialize a new local repository
@@ -22,47 +25,56 @@ type local struct {
 }
 
 func (repo *local) Versions(ctx context.Context, id string) Versions {
-	path := "/" + id
-	xs, err := repo.storage.List(context.TODO(), path)
+	xs, err := stored(ctx, repo.storage, id)
 	if err != nil {
 		return Versions{nil, http.StatusInternalServerError}
 	}
-
-	for i, x := range xs {
-		xs[i] = strings.TrimPrefix(x, path+"/")
-	}
 	return NewVersions(xs)
 }
 
 func (repo *local) Download(ctx context.Context, id, version string) (io.ReadCloser, error) {
-	return repo.storage.Reader(context.TODO(), path(id, version), 0)
+	f, err := storage.Open(ctx, repo.storage, path(id, version))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-func (repo *local) Upload(ctx context.Context, nupkg io.Reader) error {
+func (repo *local) Upload(ctx context.Context, nupkg io.Reader) (*model.Package, error) {
 	buf, err := ioutil.ReadAll(nupkg) // nupkg files are generally smallish, so we sacrafice memory for simplicity
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	archive, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	pkg, spec, err := nuspec(archive)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repo.storage.PutContent(ctx, path(pkg.Metadata.ID, pkg.Metadata.Version), spec)
-	return repo.storage.PutContent(ctx, path(pkg.Metadata.ID, pkg.Metadata.Version), buf)
+	if err = repo.storage.PutContent(ctx, path(pkg.Metadata.ID, pkg.Metadata.Version), buf); err != nil {
+		return nil, err
+	}
+	if err = repo.storage.PutContent(ctx, fmt.Sprintf("/%s/%s/%s.nuspec", pkg.Metadata.ID, pkg.Metadata.Version, pkg.Metadata.ID), spec); err != nil {
+		// e.g. the quota is exceeded, a package without a .nuspec is not published
+		repo.Delete(ctx, pkg.Metadata.ID, pkg.Metadata.Version)
+		return nil, err
+	}
+	return &model.Package{Type: "nuget", Name: pkg.Metadata.ID, Version: pkg.Metadata.Version}, nil
 }
 
+// Delete the version directory of a package, with the .nupkg and .nuspec
 func (repo *local) Delete(ctx context.Context, id, version string) error {
-	return repo.storage.Delete(ctx, path(id, version))
+	return repo.storage.Delete(ctx, fmt.Sprintf("/%s/%s", id, version))
 }
 
 func (repo *local) Search(ctx context.Context, text string) (io.ReadCloser, error) {
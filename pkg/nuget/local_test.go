@@ -58,7 +58,7 @@ func TestUpload(t *testing.T) {
 	rd := read(t, "xunit.2.4.1.nupkg")
 	defer rd.Close()
 
-	err := repo.Upload(context.TODO(), rd)
+	_, err := repo.Upload(context.TODO(), rd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,64 @@
+package nuget
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/fergusn/muzeum/pkg/mirror"
+	"github.com/sirupsen/logrus"
+)
+
+// MirrorConfig select the upstream packages to mirror
+type MirrorConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	Concurrency int           `yaml:"concurrency"`
+	Packages    []struct {
+		ID       string       `yaml:"id"`
+		Versions VersionRange `yaml:"versions"`
+	} `yaml:"packages"`
+}
+
+// Mirror download the versions of the configured packages into the repository
+func Mirror(ctx context.Context, name string, repo Repository, cfg MirrorConfig) error {
+	found := make(chan string)
+
+	go func() {
+		defer close(found)
+
+		for _, pkg := range cfg.Packages {
+			id := strings.ToLower(pkg.ID)
+
+			rsp := repo.Versions(ctx, id)
+			if rsp.Status > 0 {
+				logrus.Errorf("mirror %s: versions of %s: HTTP %d", name, id, rsp.Status)
+				continue
+			}
+			versions, err := rsp.Unmarshal()
+			rsp.Close()
+			if err != nil {
+				logrus.Errorf("mirror %s: versions of %s: %v", name, id, err)
+				continue
+			}
+
+			for _, v := range versions {
+				if pkg.Versions.Contains(v) {
+					select {
+					case found <- id + "/" + v:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return mirror.Run(ctx, name, cfg.Concurrency, found, func(ctx context.Context, artifact string) error {
+		xs := strings.SplitN(artifact, "/", 2)
+		rd, err := repo.Download(ctx, xs[0], xs[1])
+		if err != nil {
+			return err
+		}
+		return rd.Close()
+	})
+}
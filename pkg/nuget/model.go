@@ -88,7 +88,7 @@ type Metadata struct {
 
 type PackageType struct {
 	Name    string `xml:"name,attr"`
-	Version string `xml:"name,attr"`
+	Version string `xml:"version,attr"`
 }
 
 type Any struct {
@@ -151,7 +151,7 @@ type Reference struct {
 
 type ReferenceGroup struct {
 	TargetFramework string      `xml:"targetFramework,attr"`
-	References      []Reference `xml:-`
+	References      []Reference `xml:"-"`
 }
 
 type ContentFile struct {
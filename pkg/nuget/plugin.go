@@ -1,25 +1,143 @@
 package nuget
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/events"
+	"github.com/fergusn/muzeum/pkg/mirror"
 	"github.com/fergusn/muzeum/pkg/plugins"
+	"github.com/fergusn/muzeum/pkg/upstream"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errMirrorConfiguration = errors.New("NuGet mirror require proxy configuration")
 )
 
 func init() {
 	plugins.Plugins["nuget"] = register
+	plugins.Mirrors["nuget"] = mirrorRepository
+	plugins.Collectors["nuget"] = collectRepository
+	plugins.Retainers["nuget"] = expireRepository
 }
 
-func register(route *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver) error {
+func register(route *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error {
 	var repo Repository
-	if proxy, ok := config["proxy"]; ok {
-		repo, _ = NewRemote(proxy.(string), bucket)
+	if urls, ok := plugins.Endpoints(config["proxy"]); ok {
+		latency, _ := config["latency"].(bool)
+		repo, _ = NewRemote(upstream.NewEndpoints(urls, latency), bucket, client)
+
+		cfg, err := mirrorConfig(config)
+		if err != nil {
+			return err
+		}
+		if cfg.Interval > 0 {
+			go mirror.Schedule(context.Background(), name, cfg.Interval, func(ctx context.Context) error {
+				return Mirror(ctx, name, repo, cfg)
+			})
+		}
 	} else {
+		quota, err := plugins.Quota(name, config, bucket, isPackage)
+		if err != nil {
+			return err
+		}
+		if quota != nil {
+			bucket = quota
+		}
 		repo = NewLocal(bucket)
+
+		if _, ok := config["retention"]; ok {
+			policy, err := retentionConfig(config)
+			if err != nil {
+				return err
+			}
+			go Record(context.Background(), name, bucket, events.Package.Pulled.Receive())
+			if policy.Interval > 0 {
+				go expire(context.Background(), name, bucket, repo, policy)
+			}
+		}
 	}
 
-	server := Server{name, repo}
+	redirect, _ := config["redirect"].(bool)
+	server := Server{name, repo, redirect}
 	server.Mount(route)
 
 	return nil
 }
+
+func mirrorRepository(ctx context.Context, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error {
+	urls, ok := plugins.Endpoints(config["proxy"])
+	if !ok {
+		return errMirrorConfiguration
+	}
+	latency, _ := config["latency"].(bool)
+
+	cfg, err := mirrorConfig(config)
+	if err != nil {
+		return err
+	}
+
+	repo, err := NewRemote(upstream.NewEndpoints(urls, latency), bucket, client)
+	if err != nil {
+		return err
+	}
+	return Mirror(ctx, name, repo, cfg)
+}
+
+func collectRepository(ctx context.Context, name string, bucket driver.StorageDriver, dryRun bool) ([]string, error) {
+	return Collect(ctx, bucket, dryRun)
+}
+
+func expireRepository(ctx context.Context, name string, config map[string]interface{}, bucket driver.StorageDriver, dryRun bool) ([]string, error) {
+	if _, ok := config["proxy"]; ok {
+		return nil, nil
+	}
+	policy, err := retentionConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return Expire(ctx, bucket, NewLocal(bucket), policy, dryRun)
+}
+
+// expire the versions of a hosted repository periodically
+func expire(ctx context.Context, name string, bucket driver.StorageDriver, repo Repository, policy Retention) {
+	for range time.Tick(policy.Interval) {
+		expired, err := Expire(ctx, bucket, repo, policy, false)
+		for _, version := range expired {
+			logrus.Infof("retention %s: deleted %s", name, version)
+		}
+		if err != nil {
+			logrus.Errorf("retention %s: %v", name, err)
+		}
+	}
+}
+
+// isPackage return true for the path of a package, which count toward the quota of a repository
+func isPackage(path string) bool {
+	return strings.HasSuffix(path, ".nupkg")
+}
+
+func retentionConfig(config map[string]interface{}) (policy Retention, err error) {
+	if r, ok := config["retention"]; ok {
+		err = plugins.Decode(r, &policy)
+	}
+	return
+}
+
+func mirrorConfig(config map[string]interface{}) (cfg MirrorConfig, err error) {
+	if m, ok := config["mirror"]; ok {
+		err = plugins.Decode(m, &cfg)
+	}
+	for _, pkg := range cfg.Packages {
+		if err == nil {
+			err = pkg.Versions.Validate()
+		}
+	}
+	return
+}
@@ -4,25 +4,47 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/fergusn/muzeum/pkg/cache"
+	"github.com/fergusn/muzeum/pkg/upstream"
 )
 
-// NewRemote initialize a repository that fetch and cache packages from upstream
-func NewRemote(remoteURL string, storage driver.StorageDriver) (Repository, error) {
-	client, err := NewClient(remoteURL)
-
-	if err != nil {
-		return nil, err
+// NewRemote initialize a repository that fetch and cache packages from equivalent upstream service indices. The service
+// indices are stored, so that cached packages are available when upstream is offline.
+func NewRemote(endpoints *upstream.Endpoints, storage driver.StorageDriver, client *http.Client) (Repository, error) {
+	urls := endpoints.All()
+	if len(urls) == 1 {
+		index := cache.NewStoredResource(client, urls[0], storage, "/index.json")
+		return &remote{newClient(client, index), cache.NewCache(storage), storage}, nil
 	}
 
-	return &remote{client, cache.NewCache(storage)}, nil
+	clients := map[string]Repository{}
+	for i, url := range urls {
+		index := cache.NewStoredResource(client, url, storage, fmt.Sprintf("/index.%d.json", i))
+		clients[url] = newClient(client, index)
+	}
+	return &remote{&failover{endpoints, clients}, cache.NewCache(storage), storage}, nil
 }
 
 type remote struct {
 	Repository
-	cache cache.Cache
+	cache   cache.Cache
+	storage driver.StorageDriver
+}
+
+// Versions read the versions from upstream. When upstream is unavailable, the versions are read from the cached packages.
+func (r *remote) Versions(ctx context.Context, id string) Versions {
+	versions := r.Repository.Versions(ctx, id)
+	if versions.Status == 0 {
+		return versions
+	}
+
+	if xs, err := stored(ctx, r.storage, id); err == nil && len(xs) > 0 {
+		return NewVersions(xs)
+	}
+	return versions
 }
 
 func (r *remote) Download(ctx context.Context, id, version string) (io.ReadCloser, error) {
@@ -0,0 +1,67 @@
+package nuget
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver/testdriver"
+	"github.com/fergusn/muzeum/internal/test"
+	"github.com/fergusn/muzeum/pkg/upstream"
+)
+
+func offline(r *http.Request) (*http.Response, error) {
+	return nil, upstream.ErrOffline
+}
+
+func TestOfflineVersionsReadFromCache(t *testing.T) {
+	s := testdriver.New()
+	s.PutContent(context.TODO(), path("pkgid", "1.2"), []byte{1, 2})
+
+	repo, _ := NewRemote(upstream.NewEndpoints([]string{"https://api.nuget.org/v3/index.json"}, false), s, test.HTTPClient(offline))
+
+	rsp := repo.Versions(context.TODO(), "pkgid")
+	versions, err := rsp.Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 1 || versions[0] != "1.2" {
+		t.Errorf("versions expected [1.2] got %v", versions)
+	}
+}
+
+func TestOfflineDownloadNotCachedIsNotFound(t *testing.T) {
+	repo, _ := NewRemote(upstream.NewEndpoints([]string{"https://api.nuget.org/v3/index.json"}, false), testdriver.New(), test.HTTPClient(offline))
+
+	_, err := repo.Download(context.TODO(), "pkgid", "1.2")
+
+	if err != errOffline {
+		t.Errorf("expected not found while offline, got %v", err)
+	}
+}
+
+func TestDownloadFailoverToNextMirror(t *testing.T) {
+	client := test.HTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "a.example" {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+		}
+		if r.URL.Path == "/v3/index.json" {
+			return &http.Response{StatusCode: 200, Body: read(t, "index.json")}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: read(t, "xunit.2.4.1.nupkg")}, nil
+	})
+
+	endpoints := upstream.NewEndpoints([]string{"https://a.example/v3/index.json", "https://b.example/v3/index.json"}, false)
+	repo, _ := NewRemote(endpoints, testdriver.New(), client)
+
+	rd, err := repo.Download(context.TODO(), "xunit", "2.4.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+
+	if endpoints.Primary() != "https://b.example/v3/index.json" {
+		t.Errorf("failed mirror should be tried last, got %v", endpoints.URLs())
+	}
+}
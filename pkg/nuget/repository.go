@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+
+	"github.com/fergusn/muzeum/pkg/model"
 )
 
 type Versions struct {
@@ -38,7 +40,7 @@ func NewVersions(versions []string) Versions {
 type Repository interface {
 	Versions(ctx context.Context, id string) Versions
 	Download(ctx context.Context, id, version string) (io.ReadCloser, error)
-	Upload(ctx context.Context, nupkg io.Reader) error
+	Upload(ctx context.Context, nupkg io.Reader) (*model.Package, error)
 	Delete(ctx context.Context, id, version string) error
 	Search(ctx context.Context, text string) (io.ReadCloser, error)
 }
@@ -0,0 +1,163 @@
+package nuget
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/events"
+	"github.com/sirupsen/logrus"
+)
+
+// the time a version was pulled is recorded at most once in an interval
+var recordInterval = time.Hour
+
+// Retention is the policy of the versions that are kept in a hosted repository
+type Retention struct {
+	Keep       int           // the last versions of each package, 0 keep all versions
+	Prerelease time.Duration // delete prereleases older than, 0 keep all prereleases
+	Pulled     time.Duration // never delete versions pulled within
+	Interval   time.Duration // apply the policy periodically, disabled when 0
+}
+
+// Enabled return true when the policy delete versions
+func (r Retention) Enabled() bool {
+	return r.Keep > 0 || r.Prerelease > 0
+}
+
+// Expire delete the versions of the packages in storage that are not retained by the policy, with the delete of repo,
+// and return them as id/version. A dry run only report them.
+func Expire(ctx context.Context, storage driver.StorageDriver, repo Repository, policy Retention, dryRun bool) ([]string, error) {
+	if !policy.Enabled() {
+		return nil, nil
+	}
+	ids, err := storage.List(ctx, "/")
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	expired := []string{}
+	for _, dir := range ids {
+		id := strings.TrimPrefix(dir, "/")
+		versions, err := packages(ctx, storage, id)
+		if err != nil {
+			return expired, err
+		}
+
+		for i, version := range versions {
+			old := policy.Keep > 0 && i >= policy.Keep
+			if _, pre := split(version.name); len(pre) > 0 && policy.Prerelease > 0 && version.modTime.Before(now.Add(-policy.Prerelease)) {
+				old = true
+			}
+			if !old || (policy.Pulled > 0 && pulled(ctx, storage, id, version.name).After(now.Add(-policy.Pulled))) {
+				continue
+			}
+
+			expired = append(expired, id+"/"+version.name)
+			if dryRun {
+				continue
+			}
+			if err := repo.Delete(ctx, id, version.name); err != nil {
+				return expired, err
+			}
+		}
+	}
+	return expired, nil
+}
+
+type stat struct {
+	name    string
+	modTime time.Time
+}
+
+// packages return the versions of a package that are stored with a package, the latest version first
+func packages(ctx context.Context, storage driver.StorageDriver, id string) ([]stat, error) {
+	versions, err := stored(ctx, storage, id)
+	if err != nil {
+		return nil, err
+	}
+
+	xs := []stat{}
+	for _, version := range versions {
+		// versions without a package are orphans, see Collect
+		if fi, err := storage.Stat(ctx, path(id, version)); err == nil {
+			xs = append(xs, stat{version, fi.ModTime()})
+		}
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		return compare(xs[i].name, xs[j].name) > 0
+	})
+	return xs, nil
+}
+
+// Record the time the versions of a hosted repository are pulled, from the Pulled events of the repository. Pulls are
+// written to storage on another goroutine, so the downloads that emit the events do not wait for storage.
+func Record(ctx context.Context, name string, storage driver.StorageDriver, pulls <-chan *events.Pulled) {
+	type version struct{ id, version string }
+
+	var (
+		mu      sync.Mutex
+		pending = map[version]time.Time{}
+		wake    = make(chan struct{}, 1)
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for range wake {
+			mu.Lock()
+			batch := pending
+			pending = map[version]time.Time{}
+			mu.Unlock()
+
+			for v, t := range batch {
+				if err := storage.PutContent(ctx, pulledPath(v.id, v.version), []byte(t.UTC().Format(time.RFC3339))); err != nil {
+					logrus.Errorf("retention %s: pull of %s/%s: %v", name, v.id, v.version, err)
+				}
+			}
+		}
+	}()
+
+	recorded := map[version]time.Time{}
+	for pull := range pulls {
+		if pull.Registry != name || pull.Package == nil || pull.Package.Type != "nuget" {
+			continue
+		}
+		v, now := version{pull.Package.Name, pull.Package.Version}, time.Now()
+		if last, ok := recorded[v]; ok && now.Sub(last) < recordInterval {
+			continue
+		}
+		recorded[v] = now
+
+		mu.Lock()
+		pending[v] = now
+		mu.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default: // the writer has not taken the pending pulls yet
+		}
+	}
+	close(wake)
+	<-done
+}
+
+// pulled return the time a version was last pulled, or the zero time
+func pulled(ctx context.Context, storage driver.StorageDriver, id, version string) time.Time {
+	buf, err := storage.GetContent(ctx, pulledPath(id, version))
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, string(buf))
+	return t
+}
+
+func pulledPath(id, version string) string {
+	return fmt.Sprintf("/%s/%s/.pulled", id, version)
+}
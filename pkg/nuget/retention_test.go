@@ -0,0 +1,108 @@
+package nuget
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/fergusn/muzeum/pkg/events"
+	"github.com/fergusn/muzeum/pkg/model"
+)
+
+func TestExpire(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := filesystem.New(filesystem.DriverParameters{RootDirectory: dir, MaxThreads: 10})
+
+	// the versions are stored two days ago, except the last prerelease
+	for _, version := range []string{"1.0.0", "1.1.0", "1.10.0", "2.0.0-beta.1", "2.0.0-beta.2"} {
+		s.PutContent(ctx, path("abcd", version), []byte{1})
+		if version != "2.0.0-beta.2" {
+			old := time.Now().Add(-48 * time.Hour)
+			if err := os.Chtimes(filepath.Join(dir, path("abcd", version)), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.PutContent(ctx, path("efgh", "1.0.0"), []byte{1})
+
+	pulls := make(chan *events.Pulled, 2)
+	pulls <- &events.Pulled{Registry: "test", Package: &model.Package{Type: "nuget", Name: "abcd", Version: "1.0.0"}}
+	pulls <- &events.Pulled{Registry: "other", Package: &model.Package{Type: "nuget", Name: "abcd", Version: "1.1.0"}}
+	close(pulls)
+	Record(ctx, "test", s, pulls)
+
+	// the last 3 versions are kept, except old prereleases, and pulled versions are never deleted
+	policy := Retention{Keep: 3, Prerelease: 24 * time.Hour, Pulled: time.Hour}
+	expected := []string{"abcd/2.0.0-beta.1", "abcd/1.1.0"}
+
+	expired, err := Expire(ctx, s, NewLocal(s), policy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expired, expected) {
+		t.Errorf("expected %v, got %v", expected, expired)
+	}
+	if _, err = s.Stat(ctx, path("abcd", "1.1.0")); err != nil {
+		t.Error("expected dry run to keep the expired versions")
+	}
+
+	if _, err = Expire(ctx, s, NewLocal(s), policy, false); err != nil {
+		t.Fatal(err)
+	}
+	versions, _ := stored(ctx, s, "abcd")
+	sort.Strings(versions)
+	if kept := []string{"1.0.0", "1.10.0", "2.0.0-beta.2"}; !reflect.DeepEqual(versions, kept) {
+		t.Errorf("expected %v to be kept, got %v", kept, versions)
+	}
+}
+
+// blockingDriver block writes until it is released
+type blockingDriver struct {
+	driver.StorageDriver
+	release chan struct{}
+}
+
+func (d blockingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	<-d.release
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func TestRecordDoesNotBlockPulls(t *testing.T) {
+	s := blockingDriver{inmemory.New(), make(chan struct{})}
+	pulls := make(chan *events.Pulled)
+	recorded := make(chan struct{})
+	go func() {
+		Record(context.TODO(), "test", s, pulls)
+		close(recorded)
+	}()
+
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		select {
+		case pulls <- &events.Pulled{Registry: "test", Package: &model.Package{Type: "nuget", Name: "abcd", Version: version}}:
+		case <-time.After(time.Second):
+			t.Fatal("expected pulls received while storage is blocked")
+		}
+	}
+	close(pulls)
+	close(s.release)
+	<-recorded
+
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		if pulled(context.TODO(), s, "abcd", version).IsZero() {
+			t.Errorf("expected pull of %s recorded", version)
+		}
+	}
+}
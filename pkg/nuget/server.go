@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/fergusn/muzeum/pkg/artifact"
 	"github.com/fergusn/muzeum/pkg/events"
 	"github.com/fergusn/muzeum/pkg/model"
 	"github.com/gorilla/mux"
@@ -15,6 +16,7 @@ import (
 type Server struct {
 	name       string
 	repository Repository
+	redirect   bool // redirect downloads to the URL of the storage driver
 }
 
 // Mount the server on a mux router
@@ -22,7 +24,7 @@ func (srv Server) Mount(route *mux.Route) {
 	router := route.Subrouter()
 	router.HandleFunc("/index.json", srv.index(route)).Methods(http.MethodGet)
 
-	router.HandleFunc("/content/{id}/{version}/{file}.nupkg", srv.download).Methods(http.MethodGet)
+	router.HandleFunc("/content/{id}/{version}/{file}.nupkg", srv.download).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/content/{id}/index.json", srv.versions).Methods(http.MethodGet)
 
 	router.HandleFunc("/package/", srv.publish).Methods(http.MethodPut)
@@ -96,10 +98,15 @@ func (srv *Server) download(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Content-Type", "application/octet-stream")
 
-	n, err := io.Copy(w, nupkg)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	n, complete, redirected := int64(0), false, false
+	if srv.redirect {
+		n, complete, redirected = artifact.Redirect(w, r, nupkg)
+	}
+	if !redirected {
+		n, complete = artifact.Serve(w, r, mux.Vars(r)["file"]+".nupkg", nupkg)
+	}
+	// HEAD, not modified, range and failed requests are not pulls
+	if !complete {
 		return
 	}
 
@@ -130,14 +137,23 @@ func (srv *Server) publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = srv.repository.Upload(r.Context(), part)
+	pkg, err := srv.repository.Upload(r.Context(), part)
 
-	if err != nil {
+	if status := artifact.QuotaStatus(err); status > 0 {
+		http.Error(w, err.Error(), status)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
+
+	events.Package.Pushed.Emit(&events.Pushed{
+		Registry: srv.name,
+		Package:  pkg,
+		Location: r.RemoteAddr,
+	})
 }
 
 func (srv *Server) delete(w http.ResponseWriter, r *http.Request) {
@@ -6,11 +6,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
 	"github.com/fergusn/muzeum/pkg/events"
+	"github.com/fergusn/muzeum/pkg/model"
+	"github.com/fergusn/muzeum/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
@@ -42,9 +48,10 @@ func TestDownloadEmitPulledEvent(t *testing.T) {
 		},
 	}
 	pulled := make(chan *events.Pulled)
+	received := events.Package.Pulled.Receive()
 
 	go func() {
-		pulled <- <-events.Package.Pulled.Receive()
+		pulled <- <-received
 	}()
 
 	repo.request("/content/abcd/1.1/abcd.1.1.nupkg")
@@ -55,10 +62,44 @@ func TestDownloadEmitPulledEvent(t *testing.T) {
 	}
 }
 
+func TestDownloadRangeNotPulled(t *testing.T) {
+	mem := inmemory.New()
+	mem.PutContent(context.TODO(), "/abcd/1.1/abcd.1.1.nupkg", []byte("0123456789"))
+	repo := &mockRepository{
+		download: func(ctx context.Context, id, version string) (io.ReadCloser, error) {
+			return storage.Open(ctx, mem, "/abcd/1.1/abcd.1.1.nupkg")
+		},
+	}
+	router := &mux.Router{}
+	srv := Server{"test", repo, false}
+	srv.Mount(router.NewRoute())
+
+	pulled := events.Package.Pulled.Receive()
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/content/abcd/1.1/abcd.1.1.nupkg", nil)
+		req.Header.Set("Range", "bytes=4-")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, req)
+		done <- rsp.Code
+	}()
+
+	select {
+	case ev := <-pulled:
+		t.Errorf("expected no pulled event for a range, got %v", ev)
+	case code := <-done:
+		if code != http.StatusPartialContent {
+			t.Errorf("expected partial content, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected no pulled event for a range")
+	}
+}
+
 type mockRepository struct {
 	versions func(ctx context.Context, id string) Versions
 	download func(ctx context.Context, id, version string) (io.ReadCloser, error)
-	upload   func(ctx context.Context, nupkg io.Reader) error
+	upload   func(ctx context.Context, nupkg io.Reader) (*model.Package, error)
 	delete   func(ctx context.Context, id, version string) error
 	search   func(ctx context.Context, text string) (io.ReadCloser, error)
 }
@@ -69,7 +110,7 @@ func (repo *mockRepository) Versions(ctx context.Context, id string) Versions {
 func (repo *mockRepository) Download(ctx context.Context, id, version string) (io.ReadCloser, error) {
 	return repo.download(ctx, id, version)
 }
-func (repo *mockRepository) Upload(ctx context.Context, nupkg io.Reader) error {
+func (repo *mockRepository) Upload(ctx context.Context, nupkg io.Reader) (*model.Package, error) {
 	return repo.upload(ctx, nupkg)
 }
 func (repo *mockRepository) Delete(ctx context.Context, id, version string) error {
@@ -82,7 +123,7 @@ func (repo *mockRepository) Search(ctx context.Context, text string) (io.ReadClo
 func (repo *mockRepository) request(url string) *httptest.ResponseRecorder {
 	router := &mux.Router{}
 	route := router.NewRoute()
-	srv := Server{"test", repo}
+	srv := Server{"test", repo, false}
 	srv.Mount(route)
 
 	req := httptest.NewRequest(http.MethodGet, url, nil)
@@ -91,3 +132,73 @@ func (repo *mockRepository) request(url string) *httptest.ResponseRecorder {
 
 	return rsp
 }
+
+// signing is a stand-in for a cloud storage driver that return signed URLs
+type signing struct {
+	driver.StorageDriver
+}
+
+func (d signing) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "https://bucket.example.com" + path + "?signature=abcd", nil
+}
+
+func TestDownloadRedirect(t *testing.T) {
+	mem := inmemory.New()
+	mem.PutContent(context.TODO(), "/abcd/1.1/abcd.1.1.nupkg", []byte{1, 2, 3})
+
+	for redirect, expected := range map[bool]int{true: http.StatusTemporaryRedirect, false: http.StatusOK} {
+		router := &mux.Router{}
+		Server{"test", NewLocal(signing{mem}), redirect}.Mount(router.NewRoute())
+
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, httptest.NewRequest(http.MethodHead, "/content/abcd/1.1/abcd.1.1.nupkg", nil))
+
+		if rsp.Code != expected {
+			t.Errorf("redirect %v expected %d, got %d", redirect, expected, rsp.Code)
+		}
+		if redirect && rsp.Header().Get("Location") != "https://bucket.example.com/abcd/1.1/abcd.1.1.nupkg?signature=abcd" {
+			t.Errorf("expected signed url, got %s", rsp.Header().Get("Location"))
+		}
+	}
+}
+
+func TestPublishQuota(t *testing.T) {
+	nupkg, err := ioutil.ReadFile("testdata/xunit.2.4.1.nupkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := inmemory.New()
+
+	for _, test := range []struct {
+		quota    storage.Quota
+		expected int
+	}{
+		{storage.Quota{Bytes: 1 << 20}, http.StatusCreated},
+		{storage.Quota{Bytes: 1 << 10}, http.StatusRequestEntityTooLarge},
+		{storage.Quota{Artifacts: 1}, http.StatusInsufficientStorage},
+	} {
+		quota, err := storage.NewQuotaDriver(context.TODO(), "test", storage.NewDirectoryDriver("test", mem), test.quota, isPackage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quota.PutContent(context.TODO(), path("abcd", "1.1"), []byte{1, 2, 3})
+		router := &mux.Router{}
+		Server{"test", NewLocal(quota), false}.Mount(router.NewRoute())
+
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("package", "xunit.2.4.1.nupkg")
+		part.Write(nupkg)
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPut, "/package/", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, req)
+
+		if rsp.Code != test.expected {
+			t.Errorf("quota %+v expected %d, got %d", test.quota, test.expected, rsp.Code)
+		}
+		quota.Delete(context.TODO(), "/")
+	}
+}
@@ -2,6 +2,7 @@ package nuget
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+
+	"github.com/docker/distribution/registry/storage/driver"
 )
 
 func nuspec(archive *zip.Reader) (*Package, []byte, error) {
@@ -50,6 +53,20 @@ func path(id, version string) string {
 	return fmt.Sprintf("/%s/%s/%s.%s.nupkg", id, version, id, version)
 }
 
+// stored list the versions of package id in storage
+func stored(ctx context.Context, storage driver.StorageDriver, id string) ([]string, error) {
+	path := "/" + id
+	xs, err := storage.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, x := range xs {
+		xs[i] = strings.TrimPrefix(x, path+"/")
+	}
+	return xs, nil
+}
+
 type httpError struct {
 	code    int
 	message string
@@ -58,6 +75,8 @@ type httpError struct {
 var (
 	errNotImplemented      = httpError{http.StatusNotImplemented, "Not Implemented"}
 	errNotFound            = httpError{http.StatusNotFound, "Not Found"}
+	errOffline             = httpError{http.StatusNotFound, "Not Found (upstream offline)"}
+	errUnavailable         = httpError{http.StatusServiceUnavailable, "Service Unavailable (upstream unavailable)"}
 	errInternalServerError = httpError{http.StatusInternalServerError, "Internal Server Error"}
 )
 
@@ -0,0 +1,117 @@
+package nuget
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Validate return an error when the range is not a version or an interval of versions, e.g. [1.0,2.0)
+func (v VersionRange) Validate() error {
+	r := strings.TrimSpace(string(v))
+	if len(r) == 0 || (r[0] != '[' && r[0] != '(') {
+		return nil
+	}
+	if len(r) < 3 || (r[len(r)-1] != ']' && r[len(r)-1] != ')') {
+		return fmt.Errorf("invalid version range %q", string(v))
+	}
+	if inner := r[1 : len(r)-1]; !strings.Contains(inner, ",") && (r[0] != '[' || r[len(r)-1] != ']') {
+		return fmt.Errorf("invalid version range %q, an exact version is [version]", string(v))
+	}
+	return nil
+}
+
+// Contains return true if version is within the range. An empty range contains all versions, and an invalid range,
+// see Validate, contains none.
+func (v VersionRange) Contains(version string) bool {
+	r := strings.TrimSpace(string(v))
+	if len(r) == 0 {
+		return true
+	}
+	if v.Validate() != nil {
+		return false
+	}
+
+	if r[0] != '[' && r[0] != '(' {
+		return compare(version, r) >= 0
+	}
+
+	lower, upper := r[1:len(r)-1], ""
+	if i := strings.Index(lower, ","); i >= 0 {
+		lower, upper = strings.TrimSpace(lower[:i]), strings.TrimSpace(lower[i+1:])
+	} else {
+		return compare(version, lower) == 0
+	}
+
+	if len(lower) > 0 {
+		if c := compare(version, lower); c < 0 || (c == 0 && r[0] == '(') {
+			return false
+		}
+	}
+	if len(upper) > 0 {
+		if c := compare(version, upper); c > 0 || (c == 0 && r[len(r)-1] == ')') {
+			return false
+		}
+	}
+	return true
+}
+
+// compare two NuGet versions, a prerelease version is lower than the release version
+func compare(a, b string) int {
+	a, b = strings.ToLower(strings.SplitN(a, "+", 2)[0]), strings.ToLower(strings.SplitN(b, "+", 2)[0])
+	av, apre := split(a)
+	bv, bpre := split(b)
+
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		if c := compareInt(part(av, i), part(bv, i)); c != 0 {
+			return c
+		}
+	}
+
+	if apre == bpre {
+		return 0
+	} else if len(apre) == 0 {
+		return 1
+	} else if len(bpre) == 0 {
+		return -1
+	}
+
+	ap, bp := strings.Split(apre, "."), strings.Split(bpre, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+		if aerr == nil && berr == nil {
+			if c := compareInt(an, bn); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(ap[i], bp[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(len(ap), len(bp))
+}
+
+func split(version string) ([]string, string) {
+	xs := strings.SplitN(version, "-", 2)
+	if len(xs) == 1 {
+		return strings.Split(xs[0], "."), ""
+	}
+	return strings.Split(xs[0], "."), xs[1]
+}
+
+func part(xs []string, i int) int {
+	if i >= len(xs) {
+		return 0
+	}
+	n, _ := strconv.Atoi(xs[i])
+	return n
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package nuget
+
+import "testing"
+
+func TestVersionRangeContains(t *testing.T) {
+	cases := []struct {
+		rng      VersionRange
+		version  string
+		contains bool
+	}{
+		{"", "1.0.0", true},
+		{"1.0", "1.0.0", true},
+		{"1.0", "0.9.9", false},
+		{"[1.0]", "1.0.0", true},
+		{"[1.0]", "1.0.1", false},
+		{"[1.0,2.0)", "1.5.0", true},
+		{"[1.0,2.0)", "2.0.0", false},
+		{"(1.0,2.0]", "1.0.0", false},
+		{"(1.0,2.0]", "2.0.0", true},
+		{"(,2.0]", "0.1.0", true},
+		{"[2.0,)", "3.1.0", true},
+		{"[2.0,)", "2.0.0-beta", false},
+		{"[1.0,2.0)", "2.0.0-beta", true},
+	}
+
+	for _, c := range cases {
+		if c.rng.Contains(c.version) != c.contains {
+			t.Errorf("range %s contains %s should be %v", c.rng, c.version, c.contains)
+		}
+	}
+}
+
+func TestComparePrerelease(t *testing.T) {
+	if compare("1.0.0-beta.2", "1.0.0-beta.10") >= 0 {
+		t.Error("1.0.0-beta.2 should be lower than 1.0.0-beta.10")
+	}
+	if compare("1.0.0-alpha", "1.0.0") >= 0 {
+		t.Error("prerelease should be lower than release")
+	}
+}
+
+func TestVersionRangeValidate(t *testing.T) {
+	for _, r := range []VersionRange{"", "1.0", "[1.0]", "[1.0,2.0)", "(,2.0]", "(1.0,)"} {
+		if err := r.Validate(); err != nil {
+			t.Errorf("expected %q valid, got %v", r, err)
+		}
+	}
+	for _, r := range []VersionRange{"[", "(", "[]", "[1.0", "(1.0)", "(1.0]"} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("expected %q invalid", r)
+		}
+		if r.Contains("1.0") {
+			t.Errorf("expected invalid range %q to contain no versions", r)
+		}
+	}
+}
+
+func TestMirrorConfigInvalidRange(t *testing.T) {
+	config := map[string]interface{}{"mirror": map[string]interface{}{
+		"packages": []interface{}{map[string]interface{}{"id": "xunit", "versions": "["}},
+	}}
+	if _, err := mirrorConfig(config); err == nil {
+		t.Error("expected invalid range rejected")
+	}
+}
@@ -1,11 +1,98 @@
 package plugins
 
 import (
+	"context"
+	"net/http"
+	"sync"
+
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/fergusn/muzeum/pkg/storage"
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// Plugins are repositories. Requests to upstream repositories must use client.
+	Plugins = map[string]func(router *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error{}
+
+	// Mirrors download the upstream content selected by the plugin mirror configuration into the repository storage
+	Mirrors = map[string]func(ctx context.Context, name string, config map[string]interface{}, bucket driver.StorageDriver, client *http.Client) error{}
+
+	// Snapshots create a named point-in-time copy of the repository metadata in storage, and return the snapshot name
+	Snapshots = map[string]func(ctx context.Context, name string, bucket driver.StorageDriver, snapshot string) (string, error){}
+
+	// Collectors delete the orphaned files of a repository in storage and return their paths, a dry run only report them
+	Collectors = map[string]func(ctx context.Context, name string, bucket driver.StorageDriver, dryRun bool) ([]string, error){}
+
+	// Retainers delete the artifacts of a hosted repository that are not retained by the plugin retention configuration
+	// and return them, a dry run only report them
+	Retainers = map[string]func(ctx context.Context, name string, config map[string]interface{}, bucket driver.StorageDriver, dryRun bool) ([]string, error){}
 )
 
 var (
-	// Plugins are repositories
-	Plugins = map[string]func(router *mux.Route, name string, config map[string]interface{}, bucket driver.StorageDriver) error{}
+	quotas = map[string]*storage.QuotaDriver{}
+	mu     sync.Mutex
 )
+
+// Endpoints read a plugin configuration value that is either a single URL or a list of equivalent URLs
+func Endpoints(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		urls := []string{}
+		for _, x := range v {
+			url, ok := x.(string)
+			if !ok {
+				return nil, false
+			}
+			urls = append(urls, url)
+		}
+		return urls, len(urls) > 0
+	default:
+		return nil, false
+	}
+}
+
+// Decode a plugin configuration value into a struct with yaml tags
+func Decode(value interface{}, v interface{}) error {
+	buf, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(buf, v)
+}
+
+// Quota wrap the storage of a hosted repository with the quota of a plugin configuration, artifact return true for the
+// paths of the artifacts that are counted. Return nil when the configuration has no quota. The storage is returned by
+// Storage for other writers of the repository.
+func Quota(name string, config map[string]interface{}, bucket driver.StorageDriver, artifact func(path string) bool) (*storage.QuotaDriver, error) {
+	q, ok := config["quota"]
+	if !ok {
+		return nil, nil
+	}
+	var quota storage.Quota
+	if err := Decode(q, &quota); err != nil {
+		return nil, err
+	}
+	d, err := storage.NewQuotaDriver(context.Background(), name, bucket, quota, artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	quotas[name] = d
+	return d, nil
+}
+
+// Storage return the storage of repository name with the quota of its plugin, or bucket when it has no quota
+func Storage(name string, bucket driver.StorageDriver) driver.StorageDriver {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if d, ok := quotas[name]; ok {
+		return d
+	}
+	return bucket
+}
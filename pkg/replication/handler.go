@@ -0,0 +1,127 @@
+package replication
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/gorilla/mux"
+)
+
+// File in the storage of a repository
+type File struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Handler is the replication endpoint of the repositories that is used by peers, authenticated by a bearer token:
+// GET /{repository}/files list the files of a repository, and GET and PUT /{repository}/files/{path} read and write a
+// file. bucket return the storage of a repository, or false when the repository does not exist. The internal files of
+// an instance are not replicated.
+func Handler(token string, bucket func(name string) (driver.StorageDriver, bool)) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/{repository}/files", func(w http.ResponseWriter, r *http.Request) {
+		storage, ok := bucket(mux.Vars(r)["repository"])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		files, err := List(r.Context(), storage)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/{repository}/files/{path:.+}", func(w http.ResponseWriter, r *http.Request) {
+		storage, ok := bucket(mux.Vars(r)["repository"])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		path := "/" + mux.Vars(r)["path"]
+		if internal(path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			if err := write(r.Context(), storage, path, r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		rd, err := storage.Reader(r.Context(), path, 0)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rd.Close()
+		w.Header().Add("Content-Type", "application/octet-stream")
+		io.Copy(w, rd)
+	}).Methods(http.MethodGet, http.MethodPut)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// List the files in the storage of a repository that are replicated, sorted by path
+func List(ctx context.Context, storage driver.StorageDriver) ([]File, error) {
+	files := []File{}
+	err := storage.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() && !internal(fi.Path()) {
+			files = append(files, File{fi.Path(), fi.Size(), fi.ModTime()})
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+func write(ctx context.Context, storage driver.StorageDriver, path string, body io.Reader) error {
+	wr, err := storage.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(wr, body); err != nil {
+		wr.Cancel()
+		return err
+	}
+	if err = wr.Commit(); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+// internal return true for the files of an instance that are not replicated: the validators and partial downloads of
+// cached upstream files, and the pulls recorded for retention
+func internal(path string) bool {
+	return strings.HasSuffix(path, ".meta") || strings.HasSuffix(path, ".download") || strings.HasSuffix(path, "/.pulled")
+}
@@ -0,0 +1,157 @@
+package replication
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// failed files are retried with an exponential backoff
+var (
+	minBackoff = 10 * time.Second
+	maxBackoff = time.Hour
+)
+
+// Entry is a file that is not replicated yet
+type Entry struct {
+	Repository string
+	Path       string
+	Since      time.Time // the file was changed, the lag of the replication
+	Attempts   int
+	Next       time.Time // the next attempt
+}
+
+// Queue of the files to replicate, which is persisted to a file so that failed files are retried after a restart
+type Queue struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// OpenQueue read the queue persisted in a file, a queue that does not exist is empty
+func OpenQueue(path string) (*Queue, error) {
+	q := &Queue{path: path, entries: map[string]*Entry{}}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+	if err = json.Unmarshal(buf, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		q.entries[key(e.Repository, e.Path)] = e
+	}
+	return q, nil
+}
+
+// Add a file to replicate, a queued file keep its attempts
+func (q *Queue) Add(repository, path string, since time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.entries[key(repository, path)]; ok {
+		return nil
+	}
+	q.entries[key(repository, path)] = &Entry{Repository: repository, Path: path, Since: since}
+	return q.save()
+}
+
+// Due return the files of a repository that are due to be replicated, the oldest first
+func (q *Queue) Due(repository string, now time.Time) []Entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due := []Entry{}
+	for _, e := range q.entries {
+		if e.Repository == repository && !e.Next.After(now) {
+			due = append(due, *e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Since.Before(due[j].Since)
+	})
+	return due
+}
+
+// Done remove a replicated file
+func (q *Queue) Done(repository, path string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.entries, key(repository, path))
+	return q.save()
+}
+
+// Fail postpone the next attempt of a file
+func (q *Queue) Fail(repository, path string, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.entries[key(repository, path)]
+	if !ok {
+		return nil
+	}
+	backoff := minBackoff << uint(e.Attempts)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	e.Attempts++
+	e.Next = now.Add(backoff)
+	return q.save()
+}
+
+// Lag return the number of files of a repository that are not replicated, and the age of the oldest change
+func (q *Queue) Lag(repository string, now time.Time) (int, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, oldest := 0, now
+	for _, e := range q.entries {
+		if e.Repository == repository {
+			n++
+			if e.Since.Before(oldest) {
+				oldest = e.Since
+			}
+		}
+	}
+	return n, now.Sub(oldest)
+}
+
+// save the queue to a temporary file that replace the queue, q.mu must be held
+func (q *Queue) save() error {
+	entries := []*Entry{}
+	for _, e := range q.entries {
+		entries = append(entries, e)
+	}
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), q.path)
+}
+
+func key(repository, path string) string {
+	return repository + path
+}
@@ -0,0 +1,47 @@
+package replication
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueuePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	q, err := OpenQueue(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add("nuget", "/a", now.Add(-time.Minute))
+	q.Add("nuget", "/b", now)
+	q.Add("debian", "/c", now)
+	q.Fail("nuget", "/a", now)
+
+	q, err = OpenQueue(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due := q.Due("nuget", now); len(due) != 1 || due[0].Path != "/b" {
+		t.Errorf("expected /b due, got %v", due)
+	}
+	if due := q.Due("nuget", now.Add(minBackoff)); len(due) != 2 || due[0].Path != "/a" || due[0].Attempts != 1 {
+		t.Errorf("expected /a retried first, got %v", due)
+	}
+	if n, age := q.Lag("nuget", now); n != 2 || age != time.Minute {
+		t.Errorf("expected 2 files a minute behind, got %d %v", n, age)
+	}
+
+	q.Done("nuget", "/a")
+	q.Done("nuget", "/b")
+	if n, age := q.Lag("nuget", now); n != 0 || age != 0 {
+		t.Errorf("expected no lag, got %d %v", n, age)
+	}
+}
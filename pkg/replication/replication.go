@@ -0,0 +1,241 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/fergusn/muzeum/pkg/events"
+)
+
+var (
+	queued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "replication_queue_length",
+		Help: "The number of files of a repository that are not replicated yet",
+	}, []string{"repository"})
+	lag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "replication_lag_seconds",
+		Help: "The age of the oldest change of a repository that is not replicated yet",
+	}, []string{"repository"})
+)
+
+// Replicator replicate the files of a repository with the same repository of a peer. A replicator push its files to
+// the peer, or pull the files of the peer to catch up. The files that differ are found by comparing the listings of
+// both sides, and are queued until they are replicated. Deletes are not replicated.
+type Replicator struct {
+	name    string
+	storage driver.StorageDriver
+	peer    string
+	token   string
+	pull    bool
+	queue   *Queue
+	client  *http.Client
+	trigger chan struct{}
+}
+
+// NewReplicator of the repository name, peer is the base URL of the replication endpoint of the peer. Requests to the
+// peer use client, see upstream.NewClient.
+func NewReplicator(name string, storage driver.StorageDriver, peer, token string, pull bool, queue *Queue, client *http.Client) *Replicator {
+	return &Replicator{
+		name:    name,
+		storage: storage,
+		peer:    strings.TrimRight(peer, "/"),
+		token:   token,
+		pull:    pull,
+		queue:   queue,
+		client:  client,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Trigger a sync of the replicator, without waiting for it
+func (r *Replicator) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default: // a sync is pending
+	}
+}
+
+// Run sync when triggered and every interval, and retry the failed files, until the context is done
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	retry := time.NewTicker(minBackoff)
+	defer retry.Stop()
+
+	r.Trigger()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.trigger:
+			err = r.Sync(ctx)
+		case <-tick:
+			err = r.Sync(ctx)
+		case <-retry.C:
+			err = r.Retry(ctx)
+		}
+		if err != nil {
+			logrus.Errorf("replication %s: %v", r.name, err)
+		}
+	}
+}
+
+// Sync compare the files with the peer and queue the files that are missing or changed on the receiving side, then
+// replicate the queued files that are due
+func (r *Replicator) Sync(ctx context.Context) error {
+	local, err := List(ctx, r.storage)
+	if err != nil {
+		return err
+	}
+	remote, err := r.list(ctx)
+	if err != nil {
+		return fmt.Errorf("listing of %s: %w", r.peer, err)
+	}
+
+	from, to := local, remote
+	if r.pull {
+		from, to = remote, local
+	}
+	received := map[string]File{}
+	for _, f := range to {
+		received[f.Path] = f
+	}
+	for _, f := range from {
+		if x, ok := received[f.Path]; ok && x.Size == f.Size && !f.ModTime.After(x.ModTime) {
+			continue
+		}
+		if err := r.queue.Add(r.name, f.Path, f.ModTime); err != nil {
+			return err
+		}
+	}
+	return r.Retry(ctx)
+}
+
+// Retry replicate the queued files that are due, the files that fail are retried later
+func (r *Replicator) Retry(ctx context.Context) error {
+	defer r.metrics()
+
+	var failed error
+	for _, e := range r.queue.Due(r.name, time.Now()) {
+		if err := r.replicate(ctx, e.Path); err != nil {
+			logrus.Warnf("replication %s: %s: %v", r.name, e.Path, err)
+			if failed == nil {
+				failed = err
+			}
+			if err = r.queue.Fail(r.name, e.Path, time.Now()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.queue.Done(r.name, e.Path); err != nil {
+			return err
+		}
+	}
+	return failed
+}
+
+func (r *Replicator) metrics() {
+	n, age := r.queue.Lag(r.name, time.Now())
+	queued.WithLabelValues(r.name).Set(float64(n))
+	lag.WithLabelValues(r.name).Set(age.Seconds())
+}
+
+// list the files of the repository on the peer
+func (r *Replicator) list(ctx context.Context) ([]File, error) {
+	res, err := r.do(ctx, http.MethodGet, "/files", nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	files := []File{}
+	if err = json.NewDecoder(res.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// replicate a file to or from the peer, a file that is removed before it is replicated is done
+func (r *Replicator) replicate(ctx context.Context, path string) error {
+	if r.pull {
+		res, err := r.do(ctx, http.MethodGet, "/files"+path, nil, -1)
+		if err == errNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return write(ctx, r.storage, path, res.Body)
+	}
+
+	fi, err := r.storage.Stat(ctx, path)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rd, err := r.storage.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	res, err := r.do(ctx, http.MethodPut, "/files"+path, rd, fi.Size())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+var errNotFound = errors.New("not found")
+
+func (r *Replicator) do(ctx context.Context, method, path string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.peer+"/"+r.name+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	if size >= 0 {
+		req.ContentLength = size
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, errNotFound
+	case res.StatusCode >= 300:
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, req.URL, res.Status)
+	}
+	return res, nil
+}
+
+// Dispatch trigger the replicator of the repository a package is pushed to, until pushes is closed
+func Dispatch(pushes <-chan *events.Pushed, replicators map[string]*Replicator) {
+	for push := range pushes {
+		if r, ok := replicators[push.Registry]; ok && !r.pull {
+			r.Trigger()
+		}
+	}
+}
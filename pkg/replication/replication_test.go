@@ -0,0 +1,185 @@
+package replication
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func peer(name string, storage driver.StorageDriver) *httptest.Server {
+	return httptest.NewServer(Handler("secret", func(repo string) (driver.StorageDriver, bool) {
+		return storage, repo == name
+	}))
+}
+
+func queue(t *testing.T) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenQueue(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, func() { os.RemoveAll(dir) }
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.TODO()
+	local, remote := inmemory.New(), inmemory.New()
+	local.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+	local.PutContent(ctx, "/a/1.0.0/a.nuspec", []byte("spec"))
+	remote.PutContent(ctx, "/b/1.0.0/b.1.0.0.nupkg", []byte("b1"))
+
+	srv := peer("nuget", remote)
+	defer srv.Close()
+	q, cleanup := queue(t)
+	defer cleanup()
+
+	r := NewReplicator("nuget", local, srv.URL+"/", "secret", false, q, http.DefaultClient)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := remote.GetContent(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err != nil || string(buf) != "a1" {
+		t.Errorf("expected package pushed, got %q %v", buf, err)
+	}
+	if _, err := local.Stat(ctx, "/b/1.0.0/b.1.0.0.nupkg"); err == nil {
+		t.Error("expected the files of the peer not pulled by a push")
+	}
+
+	local.PutContent(ctx, "/a/1.0.0/a.nuspec", []byte("changed"))
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := remote.GetContent(ctx, "/a/1.0.0/a.nuspec"); string(buf) != "changed" {
+		t.Errorf("expected changed file pushed, got %q", buf)
+	}
+	if n, _ := q.Lag("nuget", time.Now()); n != 0 {
+		t.Errorf("expected empty queue, got %d", n)
+	}
+}
+
+func TestPushRetried(t *testing.T) {
+	ctx := context.TODO()
+	local, remote := inmemory.New(), inmemory.New()
+	local.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+
+	down := true
+	srv := peer("nuget", remote)
+	defer srv.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down && r.Method == http.MethodPut {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	q, cleanup := queue(t)
+	defer cleanup()
+
+	r := NewReplicator("nuget", local, flaky.URL, "secret", false, q, http.DefaultClient)
+	if err := r.Sync(ctx); err == nil {
+		t.Error("expected push failed")
+	}
+	if due := q.Due("nuget", time.Now().Add(minBackoff)); len(due) != 1 || due[0].Attempts != 1 {
+		t.Fatalf("expected failed file queued, got %v", due)
+	}
+
+	down = false
+	if err := r.Retry(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Stat(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err == nil {
+		t.Error("expected retry postponed")
+	}
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Stat(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err == nil {
+		t.Error("expected queued file not retried before its backoff")
+	}
+
+	q.Fail("nuget", "/a/1.0.0/a.1.0.0.nupkg", time.Now().Add(-maxBackoff))
+	if err := r.Retry(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Stat(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err != nil {
+		t.Errorf("expected file pushed on retry, got %v", err)
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.TODO()
+	local, remote := inmemory.New(), inmemory.New()
+	remote.PutContent(ctx, "/b/1.0.0/b.1.0.0.nupkg", []byte("b1"))
+	local.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+
+	srv := peer("nuget", remote)
+	defer srv.Close()
+	q, cleanup := queue(t)
+	defer cleanup()
+
+	r := NewReplicator("nuget", local, srv.URL, "secret", true, q, http.DefaultClient)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := local.GetContent(ctx, "/b/1.0.0/b.1.0.0.nupkg"); err != nil || string(buf) != "b1" {
+		t.Errorf("expected package pulled, got %q %v", buf, err)
+	}
+	if _, err := remote.Stat(ctx, "/a/1.0.0/a.1.0.0.nupkg"); err == nil {
+		t.Error("expected the local files not pushed by a pull")
+	}
+}
+
+func TestHandlerUnauthorized(t *testing.T) {
+	srv := peer("nuget", inmemory.New())
+	defer srv.Close()
+
+	r := NewReplicator("nuget", inmemory.New(), srv.URL, "wrong", false, nil, http.DefaultClient)
+	if _, err := r.list(context.TODO()); err == nil {
+		t.Error("expected unauthorized")
+	}
+	r = NewReplicator("debian", inmemory.New(), srv.URL, "secret", false, nil, http.DefaultClient)
+	if _, err := r.list(context.TODO()); err != errNotFound {
+		t.Errorf("expected unknown repository not found, got %v", err)
+	}
+}
+
+func TestInternalFilesNotReplicated(t *testing.T) {
+	ctx := context.TODO()
+	local, remote := inmemory.New(), inmemory.New()
+	local.PutContent(ctx, "/a/1.0.0/a.1.0.0.nupkg", []byte("a1"))
+	local.PutContent(ctx, "/a/1.0.0/.pulled", []byte("2020-01-01T00:00:00Z"))
+	local.PutContent(ctx, "/v3/index.json.meta", []byte("{}"))
+	local.PutContent(ctx, "/v3/index.json.download", []byte("partial"))
+	remote.PutContent(ctx, "/b/1.0.0/b.1.0.0.nupkg.meta", []byte("{}"))
+
+	srv := peer("nuget", remote)
+	defer srv.Close()
+	q, cleanup := queue(t)
+	defer cleanup()
+
+	r := NewReplicator("nuget", local, srv.URL, "secret", false, q, http.DefaultClient)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files, err := List(ctx, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "/a/1.0.0/a.1.0.0.nupkg" {
+		t.Errorf("expected only the package replicated, got %v", files)
+	}
+	if _, err = r.do(ctx, http.MethodGet, "/files/b/1.0.0/b.1.0.0.nupkg.meta", nil, -1); err != errNotFound {
+		t.Errorf("expected internal files not served, got %v", err)
+	}
+}
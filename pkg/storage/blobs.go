@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	blobRoot  = "/_blobs"
+	refPrefix = "blob:sha256:"
+	refSize   = int64(len(refPrefix) + sha256.Size*2)
+	leasePath = blobRoot + "/lease"
+
+	// smaller files, e.g. metadata, are stored in place
+	minBlobSize = 4 << 10
+)
+
+var (
+	errAppendBlob = errors.New("can not append to a deduplicated file")
+
+	// ErrBlobsLocked is returned when the blob store is leased by another process, e.g. the server
+	ErrBlobsLocked = errors.New("blob store is locked by another process")
+
+	// the lease of the blob store is renewed every third of its duration
+	leaseDuration = time.Minute
+)
+
+// Blobs is a content-addressable store shared by the repositories of a storage driver. Files written to a repository
+// are stored once as a sha256 blob, and the repository store a reference to the blob in place of the file. Blobs are
+// deleted when the last reference is removed, and Collect repair the reference counts after a failure.
+//
+// References are counted by one process at a time, which hold a lease of the blob store. The lease is taken on the
+// first write and renewed until the process exit, and writes of other processes fail with ErrBlobsLocked until it
+// expires.
+type Blobs struct {
+	storage driver.StorageDriver
+	owner   string
+	mu      sync.Mutex // references are counted under the lock
+	expires time.Time  // the lease of this process expires
+}
+
+// NewBlobs initialize a blob store in storage, which is shared with the repositories
+func NewBlobs(storage driver.StorageDriver) *Blobs {
+	host, _ := os.Hostname()
+	return &Blobs{storage: storage, owner: fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano())}
+}
+
+// Lock take the lease of the blob store, and wait until the lease of another process expires
+func (b *Blobs) Lock(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		err := b.hold(ctx)
+		b.mu.Unlock()
+		if !errors.Is(err, ErrBlobsLocked) {
+			return err
+		}
+		logrus.Warnf("%v, waiting for the lease", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leaseDuration / 3):
+		}
+	}
+}
+
+// hold the lease of the blob store, which is renewed until the process exit, b.mu must be held
+func (b *Blobs) hold(ctx context.Context) error {
+	if time.Now().Before(b.expires) {
+		return nil
+	}
+	renew := b.expires.IsZero()
+	if err := b.lease(ctx); err != nil {
+		return err
+	}
+	if renew {
+		go func() {
+			for range time.Tick(leaseDuration / 3) {
+				b.mu.Lock()
+				if err := b.lease(context.Background()); err != nil {
+					logrus.Errorf("blob store lease: %v", err)
+				}
+				b.mu.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// lease write the lease of this process, unless another process hold an unexpired lease. Storage drivers can not
+// create a file atomically, the lease is read back to detect a concurrent lease. b.mu must be held
+func (b *Blobs) lease(ctx context.Context) error {
+	owner := func() (string, error) {
+		buf, err := b.storage.GetContent(ctx, leasePath)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(string(buf))
+		if len(fields) != 2 {
+			return "", nil
+		}
+		if expires, err := time.Parse(time.RFC3339Nano, fields[1]); err != nil || time.Now().After(expires) {
+			return "", nil
+		}
+		return fields[0], nil
+	}
+
+	holder, err := owner()
+	if err != nil {
+		return err
+	}
+	if len(holder) > 0 && holder != b.owner {
+		return fmt.Errorf("%w: %s", ErrBlobsLocked, holder)
+	}
+
+	expires := time.Now().Add(leaseDuration)
+	if err = b.storage.PutContent(ctx, leasePath, []byte(b.owner+" "+expires.UTC().Format(time.RFC3339Nano))); err != nil {
+		return err
+	}
+	if holder, err = owner(); err != nil {
+		return err
+	} else if holder != b.owner {
+		return fmt.Errorf("%w: %s", ErrBlobsLocked, holder)
+	}
+	b.expires = expires
+	return nil
+}
+
+// Repository return the storage of a repository in a sub-directory, see NewDirectoryDriver, that deduplicate the files
+// in the blob store. Files that were stored before, and files that are not committed, are read in place.
+func (b *Blobs) Repository(name string) driver.StorageDriver {
+	return &deduplicated{directoryDriver{"/" + name, b.storage}, b}
+}
+
+// Collect recount the references to the blobs in all repositories, and delete the blobs that are not referenced.
+// Collect fail with ErrBlobsLocked while another process hold the lease, and the files of this process are not
+// written while blobs are collected. Return the digests of the deleted blobs, which are only reported on a dry run.
+func (b *Blobs) Collect(ctx context.Context, dryRun bool) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.hold(ctx); err != nil {
+		return nil, err
+	}
+
+	refs := map[string]int{}
+	err := b.storage.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if fi.Path() == blobRoot {
+			return driver.ErrSkipDir
+		}
+		if digest, ok := reference(ctx, b.storage, fi); ok {
+			refs[digest]++
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	digests := []string{}
+	err = b.storage.Walk(ctx, blobRoot+"/sha256", func(fi driver.FileInfo) error {
+		if fi.IsDir() && pathpkg.Base(pathpkg.Dir(fi.Path())) != "sha256" {
+			digests = append(digests, pathpkg.Base(fi.Path()))
+			return driver.ErrSkipDir
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, digest := range digests {
+		n := refs[digest]
+		if n == 0 {
+			removed = append(removed, digest)
+		}
+		if dryRun {
+			continue
+		}
+		if n == 0 {
+			err = b.storage.Delete(ctx, blobPath(digest))
+		} else {
+			err = b.storage.PutContent(ctx, blobPath(digest, "refs"), []byte(strconv.Itoa(n)))
+		}
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// store move the committed file at path to the blob with digest, or delete it when the blob exists, and reference the
+// blob at path
+func (b *Blobs) store(ctx context.Context, path, digest string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.hold(ctx); err != nil {
+		return err
+	}
+
+	if _, err := b.storage.Stat(ctx, blobPath(digest, "data")); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+		if err = b.storage.Move(ctx, path, blobPath(digest, "data")); err != nil {
+			return err
+		}
+	}
+	if err := b.count(ctx, digest, 1); err != nil {
+		return err
+	}
+	return b.storage.PutContent(ctx, path, []byte(refPrefix+digest))
+}
+
+// release a reference to a blob, the blob is deleted with the last reference. While another process hold the lease
+// the reference is not released, and the blob is kept until Collect recount its references.
+func (b *Blobs) release(ctx context.Context, digest string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.hold(ctx); errors.Is(err, ErrBlobsLocked) {
+		logrus.Debugf("blob sha256:%s is not released: %v", digest, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := b.count(ctx, digest, -1); err != nil {
+		return err
+	}
+	if n, _ := b.refs(ctx, digest); n > 0 {
+		return nil
+	}
+	return b.storage.Delete(ctx, blobPath(digest))
+}
+
+// count add delta to the references of a blob, b.mu must be held
+func (b *Blobs) count(ctx context.Context, digest string, delta int) error {
+	n, err := b.refs(ctx, digest)
+	if err != nil {
+		return err
+	}
+	return b.storage.PutContent(ctx, blobPath(digest, "refs"), []byte(strconv.Itoa(n+delta)))
+}
+
+func (b *Blobs) refs(ctx context.Context, digest string) (int, error) {
+	buf, err := b.storage.GetContent(ctx, blobPath(digest, "refs"))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(buf))
+}
+
+func blobPath(digest string, file ...string) string {
+	return pathpkg.Join(append([]string{blobRoot, "sha256", digest[:2], digest}, file...)...)
+}
+
+// reference return the digest of the blob that a file reference
+func reference(ctx context.Context, storage driver.StorageDriver, fi driver.FileInfo) (string, bool) {
+	if fi.IsDir() || fi.Size() != refSize {
+		return "", false
+	}
+	buf, err := storage.GetContent(ctx, fi.Path())
+	if err != nil || !strings.HasPrefix(string(buf), refPrefix) {
+		return "", false
+	}
+	digest := strings.TrimPrefix(string(buf), refPrefix)
+	if _, err = hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// deduplicated is the storage of a repository, committed files are replaced with a reference to a blob
+type deduplicated struct {
+	directoryDriver
+	blobs *Blobs
+}
+
+func (d *deduplicated) GetContent(ctx context.Context, path string) ([]byte, error) {
+	digest, ok, err := d.resolve(ctx, path)
+	if err != nil || !ok {
+		return d.directoryDriver.GetContent(ctx, path)
+	}
+	return d.blobs.storage.GetContent(ctx, blobPath(digest, "data"))
+}
+
+func (d *deduplicated) PutContent(ctx context.Context, path string, content []byte) error {
+	wr, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err = wr.Write(content); err != nil {
+		wr.Cancel()
+		return err
+	}
+	if err = wr.Commit(); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+func (d *deduplicated) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	digest, ok, err := d.resolve(ctx, path)
+	if err != nil || !ok {
+		return d.directoryDriver.Reader(ctx, path, offset)
+	}
+	return d.blobs.storage.Reader(ctx, blobPath(digest, "data"), offset)
+}
+
+// Writer write the file in place, and move it to the blob store when it is committed
+func (d *deduplicated) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	digest, ok, err := d.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if ok && append {
+		return nil, errAppendBlob
+	}
+
+	wr, err := d.directoryDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// the reference is replaced by the new file
+		if err = d.blobs.release(ctx, digest); err != nil {
+			wr.Cancel()
+			return nil, err
+		}
+	}
+
+	w := &blobWriter{FileWriter: wr, ctx: ctx, storage: d, path: path}
+	if !append {
+		w.hash = sha256.New()
+	}
+	return w, nil
+}
+
+func (d *deduplicated) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.directoryDriver.Stat(ctx, path)
+	if err != nil {
+		return fi, err
+	}
+	return d.info(ctx, fi)
+}
+
+func (d *deduplicated) Move(ctx context.Context, sourcePath string, destPath string) error {
+	digest, ok, err := d.resolve(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	if err = d.directoryDriver.Move(ctx, sourcePath, destPath); err != nil || !ok {
+		return err
+	}
+	return d.blobs.release(ctx, digest)
+}
+
+// Delete a file or directory, and release the blobs it reference
+func (d *deduplicated) Delete(ctx context.Context, path string) error {
+	fi, err := d.directoryDriver.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	digests := []string{}
+	if fi.IsDir() {
+		err = d.directoryDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+			if digest, ok := reference(ctx, d.directoryDriver, fi); ok {
+				digests = append(digests, digest)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else if digest, ok := reference(ctx, d.directoryDriver, fi); ok {
+		digests = append(digests, digest)
+	}
+
+	if err = d.directoryDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		if err = d.blobs.release(ctx, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deduplicated) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	digest, ok, err := d.resolve(ctx, path)
+	if err != nil || !ok {
+		return d.directoryDriver.URLFor(ctx, path, options)
+	}
+	return d.blobs.storage.URLFor(ctx, blobPath(digest, "data"), options)
+}
+
+func (d *deduplicated) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	return d.directoryDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+		fi, err := d.info(ctx, fi)
+		if err != nil {
+			return err
+		}
+		return f(fi)
+	})
+}
+
+// resolve return the digest of the blob that a file reference, files that are not found are not a reference
+func (d *deduplicated) resolve(ctx context.Context, path string) (string, bool, error) {
+	fi, err := d.directoryDriver.Stat(ctx, path)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	digest, ok := reference(ctx, d.directoryDriver, fi)
+	return digest, ok, nil
+}
+
+// info return the size of the blob that a file reference. A reference to a blob that does not exist is logged and
+// reported with its own size, so that it does not fail the walk of the repository.
+func (d *deduplicated) info(ctx context.Context, fi driver.FileInfo) (driver.FileInfo, error) {
+	digest, ok := reference(ctx, d.directoryDriver, fi)
+	if !ok {
+		return fi, nil
+	}
+	blob, err := d.blobs.storage.Stat(ctx, blobPath(digest, "data"))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		logrus.Warnf("%s reference the missing blob sha256:%s", fi.Path(), digest)
+		return fi, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("blob of %s: %v", fi.Path(), err)
+	}
+	return driver.FileInfoInternal{FileInfoFields: driver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    blob.Size(),
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// blobWriter hash the file as it is written, and store it in the blob store when it is committed. An appended file
+// is hashed when it is committed.
+type blobWriter struct {
+	driver.FileWriter
+	ctx     context.Context
+	storage *deduplicated
+	path    string
+	hash    hash.Hash
+	closed  bool
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.FileWriter.Write(p)
+	if w.hash != nil {
+		w.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+func (w *blobWriter) Commit() error {
+	if err := w.FileWriter.Commit(); err != nil {
+		return err
+	}
+	size := w.FileWriter.Size()
+	w.closed = true
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+	if size < minBlobSize {
+		return nil
+	}
+
+	if w.hash == nil {
+		rd, err := w.storage.directoryDriver.Reader(w.ctx, w.path, 0)
+		if err != nil {
+			return err
+		}
+		w.hash = sha256.New()
+		_, err = io.Copy(w.hash, rd)
+		rd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err := w.storage.blobs.store(w.ctx, w.storage.subpath(w.path), hex.EncodeToString(w.hash.Sum(nil)))
+	if errors.Is(err, ErrBlobsLocked) {
+		// the file is read in place, and is deduplicated when it is written again
+		logrus.Debugf("%s is not deduplicated: %v", w.path, err)
+		return nil
+	}
+	return err
+}
+
+func (w *blobWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.FileWriter.Close()
+}
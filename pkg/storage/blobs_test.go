@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+var blob = bytes.Repeat([]byte("muzeum"), minBlobSize)
+
+func TestBlobsDeduplicate(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	blobs := NewBlobs(mem)
+	archive, security := blobs.Repository("archive"), blobs.Repository("security")
+
+	if err := archive.PutContent(ctx, "/pool/a.deb", blob); err != nil {
+		t.Fatal(err)
+	}
+	wr, _ := security.Writer(ctx, "/pool/a.deb", false)
+	wr.Write(blob)
+	if err := wr.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wr.Close()
+
+	for _, repo := range []driver.StorageDriver{archive, security} {
+		if buf, err := repo.GetContent(ctx, "/pool/a.deb"); err != nil || !bytes.Equal(buf, blob) {
+			t.Errorf("expected content of the blob, got %d bytes %v", len(buf), err)
+		}
+		if fi, err := repo.Stat(ctx, "/pool/a.deb"); err != nil || fi.Size() != int64(len(blob)) || fi.Path() != "/pool/a.deb" {
+			t.Errorf("expected size of the blob, got %v %v", fi, err)
+		}
+		rd, err := repo.Reader(ctx, "/pool/a.deb", 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf, _ := ioutil.ReadAll(rd); !bytes.Equal(buf, blob[6:]) {
+			t.Error("expected content from offset")
+		}
+		rd.Close()
+	}
+
+	if fi, _ := mem.Stat(ctx, "/archive/pool/a.deb"); fi.Size() != refSize {
+		t.Errorf("expected reference in repository, got %d bytes", fi.Size())
+	}
+	if n, _ := blobs.refs(ctx, digest(blob)); n != 2 {
+		t.Errorf("expected 2 references, got %d", n)
+	}
+
+	archive.Delete(ctx, "/pool")
+	if _, err := security.GetContent(ctx, "/pool/a.deb"); err != nil {
+		t.Errorf("expected blob with remaining reference, got %v", err)
+	}
+	security.Delete(ctx, "/pool/a.deb")
+	if _, err := mem.Stat(ctx, blobPath(digest(blob))); err == nil {
+		t.Error("expected blob to be deleted with the last reference")
+	}
+}
+
+func TestBlobsSmallFilesInPlace(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	repo := NewBlobs(mem).Repository("nuget")
+
+	repo.PutContent(ctx, "/index.json", content)
+
+	if buf, err := mem.GetContent(ctx, "/nuget/index.json"); err != nil || !bytes.Equal(buf, content) {
+		t.Errorf("expected small file in place, got %v %v", buf, err)
+	}
+}
+
+func TestBlobsOverwriteReleaseReference(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	blobs := NewBlobs(mem)
+	repo := blobs.Repository("nuget")
+
+	repo.PutContent(ctx, "/a.nupkg", blob)
+	repo.PutContent(ctx, "/b.nupkg", append(blob, 1))
+	if err := repo.Move(ctx, "/b.nupkg", "/a.nupkg"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mem.Stat(ctx, blobPath(digest(blob))); err == nil {
+		t.Error("expected overwritten blob to be deleted")
+	}
+	if buf, _ := repo.GetContent(ctx, "/a.nupkg"); !bytes.Equal(buf, append(blob, 1)) {
+		t.Error("expected moved content")
+	}
+}
+
+func TestBlobsCollect(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	blobs := NewBlobs(mem)
+	repo := blobs.Repository("nuget")
+
+	repo.PutContent(ctx, "/a.nupkg", blob)
+	repo.PutContent(ctx, "/b.nupkg", append(blob, 1))
+	mem.Delete(ctx, "/nuget/b.nupkg") // reference lost without release
+
+	removed, err := blobs.Collect(ctx, true)
+	if err != nil || len(removed) != 1 || removed[0] != digest(append(blob, 1)) {
+		t.Fatalf("expected unreferenced blob, got %v %v", removed, err)
+	}
+	if _, err := mem.Stat(ctx, blobPath(removed[0])); err != nil {
+		t.Error("expected dry run to keep the blob")
+	}
+
+	if _, err = blobs.Collect(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(ctx, blobPath(removed[0])); err == nil {
+		t.Error("expected unreferenced blob to be deleted")
+	}
+	if buf, err := repo.GetContent(ctx, "/a.nupkg"); err != nil || !bytes.Equal(buf, blob) {
+		t.Errorf("expected referenced blob to be kept, got %v", err)
+	}
+}
+
+func digest(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlobsLease(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	server, cli := NewBlobs(mem), NewBlobs(mem)
+
+	large := bytes.Repeat([]byte("a"), minBlobSize)
+	if err := server.Repository("nuget").PutContent(ctx, "/a.nupkg", large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Collect(ctx, false); !errors.Is(err, ErrBlobsLocked) {
+		t.Errorf("expected collect of another process locked, got %v", err)
+	}
+
+	// writes of another process are stored in place
+	if err := cli.Repository("debian").PutContent(ctx, "/b.deb", large); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := mem.GetContent(ctx, "/debian/b.deb"); !bytes.Equal(buf, large) {
+		t.Error("expected file stored in place")
+	}
+	if n, _ := server.refs(ctx, digest(large)); n != 1 {
+		t.Errorf("expected references of the lease holder, got %d", n)
+	}
+
+	// the lease expire when it is not renewed
+	mem.PutContent(ctx, leasePath, []byte("server "+time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)))
+	if _, err := cli.Collect(ctx, false); err != nil {
+		t.Errorf("expected expired lease taken, got %v", err)
+	}
+	if n, _ := cli.refs(ctx, digest(large)); n != 1 {
+		t.Errorf("expected references recounted, got %d", n)
+	}
+}
+
+func TestBlobsMissingBlobWalk(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	archive := NewBlobs(mem).Repository("archive")
+
+	archive.PutContent(ctx, "/pool/a.deb", blob)
+	archive.PutContent(ctx, "/pool/b.deb", append([]byte("b"), blob...))
+	mem.Delete(ctx, blobPath(digest(blob), "data"))
+
+	sizes := map[string]int64{}
+	err := archive.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			sizes[fi.Path()] = fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes["/pool/a.deb"] != refSize || sizes["/pool/b.deb"] != int64(len(blob)+1) {
+		t.Errorf("expected the size of the dangling reference and of the blob, got %v", sizes)
+	}
+}
@@ -66,10 +66,16 @@ func (d directoryDriver) URLFor(ctx context.Context, path string, options map[st
 }
 
 func (d directoryDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
-	return d.inner.Walk(ctx, d.subpath(path), f)
+	return d.inner.Walk(ctx, d.subpath(path), func(fi driver.FileInfo) error {
+		return f(fileInfoDecorator{fi, d.path})
+	})
 }
 
+// subpath return the path in the inner driver, the root is the directory
 func (d directoryDriver) subpath(path string) string {
+	if path == "/" {
+		return d.path
+	}
 	return d.path + path
 }
 
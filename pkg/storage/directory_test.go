@@ -127,6 +127,44 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestWalk(t *testing.T) {
+	tst := testdriver.New()
+	dir := NewDirectoryDriver("qwerty", tst)
+	tst.PutContent(context.TODO(), "/qwerty/abcd/efgh", content)
+
+	paths := []string{}
+	err := dir.Walk(context.TODO(), "/abcd", func(fi driver.FileInfo) error {
+		paths = append(paths, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) != 1 || paths[0] != "/abcd/efgh" {
+		t.Errorf("walk should return paths relative to the directory, got %v", paths)
+	}
+}
+
+func TestWalkRoot(t *testing.T) {
+	tst := testdriver.New()
+	dir := NewDirectoryDriver("qwerty", tst)
+	tst.PutContent(context.TODO(), "/qwerty/abcd/efgh", content)
+
+	paths := []string{}
+	err := dir.Walk(context.TODO(), "/", func(fi driver.FileInfo) error {
+		paths = append(paths, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) != 2 || paths[1] != "/abcd/efgh" {
+		t.Errorf("walk of the root should return the paths in the directory, got %v", paths)
+	}
+}
+
 func assertExists(t *testing.T, dir driver.StorageDriver, path string) {
 	if _, err := dir.GetContent(context.TODO(), path); err != nil {
 		t.Error("directoryDriver should use sub-directory")
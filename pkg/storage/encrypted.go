@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+const (
+	encryptedName = "encrypted"
+
+	// an encrypted file start with a header, followed by chunks that are sealed with a nonce of the prefix and the
+	// index of the chunk. The last chunk is sealed as final, and hold up to a chunk.
+	magic      = "MZENC\x00\x00\x01"
+	keyIDSize  = 4
+	prefixSize = 8
+	headerSize = len(magic) + keyIDSize + prefixSize
+	chunkSize  = 64 << 10
+	tagSize    = 16
+	sealedSize = chunkSize + tagSize
+
+	// files are written to the temporary directory when they are re-encrypted
+	encryptedTemp = "/_encrypted"
+
+	// the headers of up to headersSize files are cached
+	headersSize = 1 << 16
+)
+
+var (
+	errKey        = errors.New("encryption key must be 32 bytes, hex or base64")
+	errUnknownKey = errors.New("file is encrypted with an unknown key")
+	errNoKeys     = errors.New("encryption require a key")
+)
+
+// ParseKey read a 256-bit key, which is 32 bytes or their hex or base64 encoding
+func ParseKey(buf []byte) ([]byte, error) {
+	if len(buf) == 32 {
+		return buf, nil
+	}
+	s := strings.TrimSpace(string(buf))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errKey
+}
+
+// EncryptedDriver encrypt files at rest with AES-256-GCM. Files are encrypted in chunks, so that they are read from an
+// offset, with the first key and are decrypted with the key they were encrypted with. Files that are not encrypted,
+// e.g. stored before encryption was enabled, are read as is. Appending to a file re-encrypt it. The headers of files
+// are cached by their size and modification time, so that Stat and Walk do not read them again.
+type EncryptedDriver struct {
+	driver.StorageDriver
+	keys map[string]cipher.AEAD // by key id
+	id   string                 // the id of the key that encrypt new files
+
+	mu      sync.Mutex
+	headers map[string]cachedHeader // by path
+}
+
+// cachedHeader is the header of a file of a size and modification time, nil when the file is not encrypted
+type cachedHeader struct {
+	size    int64
+	modTime time.Time
+	header  *header
+}
+
+// NewEncryptedDriver wrap inner with encryption, the first key encrypt new files and the other keys decrypt files that
+// were encrypted before the key was rotated
+func NewEncryptedDriver(inner driver.StorageDriver, keys ...[]byte) (*EncryptedDriver, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	d := &EncryptedDriver{StorageDriver: inner, keys: map[string]cipher.AEAD{}, headers: map[string]cachedHeader{}}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := string(sum[:keyIDSize])
+		if i == 0 {
+			d.id = id
+		}
+		d.keys[id] = aead
+	}
+	return d, nil
+}
+
+func (d *EncryptedDriver) Name() string {
+	return encryptedName
+}
+
+func (d *EncryptedDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rd, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+func (d *EncryptedDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	wr, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err = wr.Write(content); err != nil {
+		wr.Cancel()
+		return err
+	}
+	if err = wr.Commit(); err != nil {
+		return err
+	}
+	return wr.Close()
+}
+
+// Reader decrypt a file from the chunk of the offset
+func (d *EncryptedDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := d.header(ctx, path, fi)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	if offset < 0 || offset > plainSize(fi.Size()) {
+		return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: encryptedName}
+	}
+	index := offset / chunkSize
+	if index == 0 {
+		// the first chunk is read with the header, so that a file read from the start is cached by a tiered driver
+		rd, err := d.StorageDriver.Reader(ctx, path, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(ioutil.Discard, rd, int64(headerSize)); err != nil {
+			rd.Close()
+			return nil, err
+		}
+		return h.decrypter(rd, fi.Size(), 0, offset), nil
+	}
+	rd, err := d.StorageDriver.Reader(ctx, path, int64(headerSize)+index*sealedSize)
+	if err != nil {
+		return nil, err
+	}
+	return h.decrypter(rd, fi.Size(), index, offset), nil
+}
+
+// decrypter return a reader of the chunks of a file of size from the chunk index, rd is at the start of the chunk
+func (h *header) decrypter(rd io.ReadCloser, size, index, offset int64) io.ReadCloser {
+	return &decrypter{
+		rd:     rd,
+		header: h,
+		index:  index,
+		last:   (size - int64(headerSize) - tagSize) / sealedSize,
+		size:   size - int64(headerSize),
+		skip:   int(offset % chunkSize),
+	}
+}
+
+// Writer encrypt a file with the first key. An appended file is re-encrypted to a temporary file, which replace the
+// file when it is closed.
+func (d *EncryptedDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	d.forget(path)
+	if append {
+		if fi, err := d.StorageDriver.Stat(ctx, path); err == nil {
+			h, err := d.header(ctx, path, fi)
+			if err != nil {
+				return nil, err
+			}
+			if h == nil {
+				// files that are not encrypted stay as is
+				return d.StorageDriver.Writer(ctx, path, true)
+			}
+			return d.reencrypt(ctx, path)
+		}
+	}
+
+	wr, err := d.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.encrypter(ctx, wr, path, "")
+}
+
+func (d *EncryptedDriver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return fi, err
+	}
+	return d.info(ctx, fi)
+}
+
+func (d *EncryptedDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	d.forget(sourcePath)
+	d.forget(destPath)
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *EncryptedDriver) Delete(ctx context.Context, path string) error {
+	d.forget(path)
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+// URLFor is not supported, the storage serve the encrypted file
+func (d *EncryptedDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", driver.ErrUnsupportedMethod{DriverName: encryptedName}
+}
+
+func (d *EncryptedDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	return d.StorageDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+		if fi.IsDir() && fi.Path() == encryptedTemp {
+			return driver.ErrSkipDir
+		}
+		fi, err := d.info(ctx, fi)
+		if err != nil {
+			return err
+		}
+		return f(fi)
+	})
+}
+
+// Rotate re-encrypt the files that are not encrypted with the first key, and return their number. A file that is
+// written while it is re-encrypted is kept.
+func (d *EncryptedDriver) Rotate(ctx context.Context) (int, error) {
+	files := []driver.FileInfo{}
+	err := d.StorageDriver.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if fi.IsDir() {
+			if fi.Path() == encryptedTemp {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		h, err := d.header(ctx, fi.Path(), fi)
+		if err != nil {
+			return err
+		}
+		if h == nil || h.id != d.id {
+			files = append(files, fi)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, fi := range files {
+		wr, err := d.reencrypt(ctx, fi.Path())
+		if err != nil {
+			return n, err
+		}
+		w := wr.(*encrypter)
+		w.unchanged = fi
+		if err = wr.Commit(); err != nil {
+			return n, err
+		}
+		if err = wr.Close(); err == errChanged {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	d.StorageDriver.Delete(ctx, encryptedTemp)
+	return n, nil
+}
+
+var errChanged = errors.New("file changed while it was re-encrypted")
+
+// reencrypt return a writer of a temporary file with the content of path, which replace the file when it is closed
+func (d *EncryptedDriver) reencrypt(ctx context.Context, path string) (driver.FileWriter, error) {
+	rd, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	temp := make([]byte, 16)
+	if _, err = rand.Read(temp); err != nil {
+		return nil, err
+	}
+	tempPath := encryptedTemp + "/" + hex.EncodeToString(temp)
+	inner, err := d.StorageDriver.Writer(ctx, tempPath, false)
+	if err != nil {
+		return nil, err
+	}
+	wr, err := d.encrypter(ctx, inner, path, tempPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		wr.Cancel()
+		return nil, err
+	}
+	return wr, nil
+}
+
+type header struct {
+	id     string
+	aead   cipher.AEAD
+	prefix []byte
+}
+
+// header return the header of an encrypted file, or nil when the file is not encrypted. The header is read from the
+// storage unless it is cached for the size and modification time of the file.
+func (d *EncryptedDriver) header(ctx context.Context, path string, fi driver.FileInfo) (*header, error) {
+	if fi.Size() < int64(headerSize)+tagSize {
+		return nil, nil
+	}
+	d.mu.Lock()
+	c, ok := d.headers[path]
+	d.mu.Unlock()
+	if ok && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.header, nil
+	}
+
+	h, err := d.readHeader(ctx, path)
+	if err != nil || fi.ModTime().IsZero() {
+		return h, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.headers) >= headersSize {
+		for p := range d.headers {
+			delete(d.headers, p)
+			break
+		}
+	}
+	d.headers[path] = cachedHeader{fi.Size(), fi.ModTime(), h}
+	return h, nil
+}
+
+// forget the cached header of a file that is written
+func (d *EncryptedDriver) forget(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.headers, path)
+}
+
+// readHeader read the header of an encrypted file, or return nil when the file is not encrypted
+func (d *EncryptedDriver) readHeader(ctx context.Context, path string) (*header, error) {
+	rd, err := d.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	buf := make([]byte, headerSize)
+	if _, err = io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(buf, []byte(magic)) {
+		return nil, nil
+	}
+	id := string(buf[len(magic) : len(magic)+keyIDSize])
+	aead, ok := d.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, errUnknownKey)
+	}
+	return &header{id, aead, buf[len(magic)+keyIDSize:]}, nil
+}
+
+// info return the size of the content of an encrypted file
+func (d *EncryptedDriver) info(ctx context.Context, fi driver.FileInfo) (driver.FileInfo, error) {
+	if fi.IsDir() {
+		return fi, nil
+	}
+	h, err := d.header(ctx, fi.Path(), fi)
+	if err != nil || h == nil {
+		return fi, err
+	}
+	return driver.FileInfoInternal{FileInfoFields: driver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    plainSize(fi.Size()),
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// encrypter write the header of a new file with a random prefix
+func (d *EncryptedDriver) encrypter(ctx context.Context, wr driver.FileWriter, path, tempPath string) (driver.FileWriter, error) {
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		wr.Cancel()
+		return nil, err
+	}
+	if _, err := wr.Write([]byte(magic + d.id + string(prefix))); err != nil {
+		wr.Cancel()
+		return nil, err
+	}
+	return &encrypter{
+		FileWriter: wr,
+		ctx:        ctx,
+		storage:    d,
+		path:       path,
+		tempPath:   tempPath,
+		header:     &header{d.id, d.keys[d.id], prefix},
+	}, nil
+}
+
+// plainSize return the size of the content of an encrypted file
+func plainSize(size int64) int64 {
+	size -= int64(headerSize)
+	chunks := (size-tagSize)/sealedSize + 1
+	return size - chunks*tagSize
+}
+
+func nonce(prefix []byte, index int64) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], uint32(index))
+	return n
+}
+
+func final(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encrypter seal the content in chunks as it is written, the last chunk is sealed when the file is committed or closed
+type encrypter struct {
+	driver.FileWriter
+	ctx       context.Context
+	storage   *EncryptedDriver
+	path      string
+	tempPath  string          // replace path when it is closed
+	unchanged driver.FileInfo // the file is only replaced when it is unchanged
+	header    *header
+	index     int64
+	buf       []byte
+	size      int64
+	sealed    bool
+	cancelled bool
+}
+
+func (w *encrypter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > chunkSize {
+		if err := w.seal(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[chunkSize:]
+	}
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *encrypter) Size() int64 {
+	return w.size
+}
+
+func (w *encrypter) Commit() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	return w.FileWriter.Commit()
+}
+
+func (w *encrypter) Cancel() error {
+	w.cancelled = true
+	return w.FileWriter.Cancel()
+}
+
+func (w *encrypter) Close() error {
+	if w.cancelled {
+		return w.FileWriter.Close()
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+	defer w.storage.forget(w.path)
+	if len(w.tempPath) == 0 {
+		return nil
+	}
+
+	if w.unchanged != nil {
+		fi, err := w.storage.StorageDriver.Stat(w.ctx, w.path)
+		if err != nil || fi.Size() != w.unchanged.Size() || !fi.ModTime().Equal(w.unchanged.ModTime()) {
+			w.storage.StorageDriver.Delete(w.ctx, w.tempPath)
+			return errChanged
+		}
+	}
+	return w.storage.StorageDriver.Move(w.ctx, w.tempPath, w.path)
+}
+
+// finish seal the last chunk
+func (w *encrypter) finish() error {
+	if w.sealed {
+		return nil
+	}
+	w.sealed = true
+	return w.seal(w.buf, true)
+}
+
+func (w *encrypter) seal(chunk []byte, last bool) error {
+	_, err := w.FileWriter.Write(w.header.aead.Seal(nil, nonce(w.header.prefix, w.index), chunk, final(last)))
+	w.index++
+	return err
+}
+
+// decrypter open the chunks of an encrypted file as they are read
+type decrypter struct {
+	rd     io.ReadCloser
+	header *header
+	index  int64 // of the next chunk
+	last   int64
+	size   int64 // of the chunks
+	skip   int
+	buf    []byte
+}
+
+func (r *decrypter) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.index > r.last {
+			// the file is read to the end, so that it is cached by a tiered driver
+			io.Copy(ioutil.Discard, r.rd)
+			return 0, io.EOF
+		}
+		n := sealedSize
+		if r.index == r.last {
+			n = int(r.size - r.last*sealedSize)
+		}
+		sealed := make([]byte, n)
+		if _, err := io.ReadFull(r.rd, sealed); err != nil {
+			return 0, err
+		}
+		chunk, err := r.header.aead.Open(sealed[:0], nonce(r.header.prefix, r.index), sealed, final(r.index == r.last))
+		if err != nil {
+			return 0, err
+		}
+		r.index++
+		r.buf = chunk[r.skip:]
+		r.skip = 0
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decrypter) Close() error {
+	return r.rd.Close()
+}
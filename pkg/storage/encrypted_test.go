@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestEncryptedReadWrite(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	encrypted, err := NewEncryptedDriver(mem, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 10, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+		if err := encrypted.PutContent(ctx, "/pool/a.deb", content); err != nil {
+			t.Fatal(err)
+		}
+		if raw, _ := mem.GetContent(ctx, "/pool/a.deb"); size > 0 && bytes.Contains(raw, content[:size/2]) {
+			t.Errorf("expected %d bytes encrypted at rest", size)
+		}
+		if fi, err := encrypted.Stat(ctx, "/pool/a.deb"); err != nil || fi.Size() != int64(size) {
+			t.Errorf("expected size %d, got %v %v", size, fi, err)
+		}
+
+		for _, offset := range []int{0, size / 2, size} {
+			rd, err := encrypted.Reader(ctx, "/pool/a.deb", int64(offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf, err := ioutil.ReadAll(rd); err != nil || !bytes.Equal(buf, content[offset:]) {
+				t.Errorf("size %d expected content from offset %d, got %d bytes %v", size, offset, len(buf), err)
+			}
+			rd.Close()
+		}
+	}
+}
+
+func TestEncryptedAppend(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	encrypted, _ := NewEncryptedDriver(mem, key1)
+
+	content := bytes.Repeat([]byte("muzeum"), chunkSize/4)
+	wr, _ := encrypted.Writer(ctx, "/upload", false)
+	wr.Write(content[:chunkSize])
+	wr.Close()
+
+	wr, err := encrypted.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wr.Size() != chunkSize {
+		t.Errorf("expected size of the appended file, got %d", wr.Size())
+	}
+	wr.Write(content[chunkSize:])
+	wr.Commit()
+	wr.Close()
+
+	if buf, err := encrypted.GetContent(ctx, "/upload"); err != nil || !bytes.Equal(buf, content) {
+		t.Errorf("expected appended content, got %d bytes %v", len(buf), err)
+	}
+	if files, _ := mem.List(ctx, encryptedTemp); len(files) > 0 {
+		t.Errorf("expected no temporary files, got %v", files)
+	}
+}
+
+func TestEncryptedRotate(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	mem.PutContent(ctx, "/plain", []byte("stored before encryption was enabled"))
+	old, _ := NewEncryptedDriver(mem, key1)
+	old.PutContent(ctx, "/old", []byte("encrypted with the old key"))
+
+	current, _ := NewEncryptedDriver(mem, key2)
+	if _, err := current.GetContent(ctx, "/old"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("expected unknown key, got %v", err)
+	}
+
+	rotated, _ := NewEncryptedDriver(mem, key2, key1)
+	if buf, err := rotated.GetContent(ctx, "/old"); err != nil || string(buf) != "encrypted with the old key" {
+		t.Errorf("expected content decrypted with the old key, got %q %v", buf, err)
+	}
+	n, err := rotated.Rotate(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 files rotated, got %d %v", n, err)
+	}
+
+	for path, content := range map[string]string{"/plain": "stored before encryption was enabled", "/old": "encrypted with the old key"} {
+		if buf, err := current.GetContent(ctx, path); err != nil || string(buf) != content {
+			t.Errorf("expected %s encrypted with the new key, got %q %v", path, buf, err)
+		}
+	}
+	if n, _ = rotated.Rotate(ctx); n != 0 {
+		t.Errorf("expected rotated files to be kept, got %d", n)
+	}
+	if _, err = current.URLFor(ctx, "/old", nil); err == nil {
+		t.Error("expected encrypted files to be served")
+	} else if _, ok := err.(driver.ErrUnsupportedMethod); !ok {
+		t.Errorf("expected unsupported method, got %v", err)
+	}
+}
+
+// readsDriver count the readers that are opened
+type readsDriver struct {
+	driver.StorageDriver
+	reads int
+}
+
+func (d *readsDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.reads++
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func TestEncryptedStatHeaderCached(t *testing.T) {
+	ctx := context.TODO()
+	inner := &readsDriver{StorageDriver: inmemory.New()}
+	encrypted, _ := NewEncryptedDriver(inner, key1)
+	encrypted.PutContent(ctx, "/pool/a.deb", []byte("muzeum"))
+
+	for i := 0; i < 3; i++ {
+		if fi, err := encrypted.Stat(ctx, "/pool/a.deb"); err != nil || fi.Size() != 6 {
+			t.Fatalf("expected size of the content, got %v", err)
+		}
+	}
+	encrypted.Walk(ctx, "/", func(fi driver.FileInfo) error { return nil })
+	if inner.reads != 1 {
+		t.Errorf("expected the header read once, got %d reads", inner.reads)
+	}
+
+	encrypted.PutContent(ctx, "/pool/a.deb", []byte("muzeum muzeum"))
+	if fi, err := encrypted.Stat(ctx, "/pool/a.deb"); err != nil || fi.Size() != 13 {
+		t.Errorf("expected size of the written content, got %v", err)
+	}
+}
+
+func TestEncryptedTiered(t *testing.T) {
+	ctx := context.TODO()
+	backend, cache := inmemory.New(), inmemory.New()
+	encrypted, _ := NewEncryptedDriver(NewTieredDriver(backend, cache, 1<<20), key1)
+
+	content := bytes.Repeat([]byte("muzeum"), chunkSize/4)
+	encrypted.PutContent(ctx, "/pool/a.deb", content)
+	other, _ := NewEncryptedDriver(backend, key1)
+	other.PutContent(ctx, "/pool/b.deb", content)
+	if buf, err := encrypted.GetContent(ctx, "/pool/b.deb"); err != nil || !bytes.Equal(buf, content) {
+		t.Fatalf("expected content, got %d bytes %v", len(buf), err)
+	}
+
+	// written and read files are cached as they are stored
+	for _, path := range []string{"/pool/a.deb", "/pool/b.deb"} {
+		stored, _ := backend.GetContent(ctx, path)
+		if buf, err := cache.GetContent(ctx, cacheFiles+path); err != nil || !bytes.Equal(buf, stored) {
+			t.Errorf("expected %s cached encrypted, got %d bytes %v", path, len(buf), err)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, encoded := range []string{
+		string(key1),
+		"0101010101010101010101010101010101010101010101010101010101010101\n",
+		"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=",
+	} {
+		if key, err := ParseKey([]byte(encoded)); err != nil || !bytes.Equal(key, key1) {
+			t.Errorf("expected key from %q, got %v", encoded, err)
+		}
+	}
+	if _, err := ParseKey([]byte("short")); err == nil {
+		t.Error("expected invalid key")
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+var errSeek = errors.New("seek before start of file")
+
+// File is a file in a storage driver that can seek, i.e. to serve byte ranges. The file is read from the driver at
+// the current offset on the first read after a seek.
+type File struct {
+	ctx     context.Context
+	storage driver.StorageDriver
+	info    driver.FileInfo
+	offset  int64
+	rd      io.ReadCloser
+}
+
+// Open a file in storage for reading
+func Open(ctx context.Context, storage driver.StorageDriver, path string) (*File, error) {
+	fi, err := storage.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, driver.PathNotFoundError{Path: path, DriverName: storage.Name()}
+	}
+	return &File{ctx: ctx, storage: storage, info: fi}, nil
+}
+
+// Path of the file in storage
+func (f *File) Path() string {
+	return f.info.Path()
+}
+
+// Size of the file when it was opened
+func (f *File) Size() int64 {
+	return f.info.Size()
+}
+
+// ModTime of the file when it was opened
+func (f *File) ModTime() time.Time {
+	return f.info.ModTime()
+}
+
+// ETag is a strong validator of the file, derived from its modification time and size
+func (f *File) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, f.info.ModTime().UnixNano(), f.info.Size())
+}
+
+// URLFor return a URL of the storage driver to read the file directly, see driver.StorageDriver
+func (f *File) URLFor(options map[string]interface{}) (string, error) {
+	return f.storage.URLFor(f.ctx, f.info.Path(), options)
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.rd == nil {
+		rd, err := f.storage.Reader(f.ctx, f.info.Path(), f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.rd = rd
+	}
+	n, err := f.rd.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek set the offset of the next read, the reader of the driver is reopened when the offset change
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return f.offset, errSeek
+	}
+	if offset != f.offset && f.rd != nil {
+		f.rd.Close()
+		f.rd = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) Close() error {
+	if f.rd == nil {
+		return nil
+	}
+	err := f.rd.Close()
+	f.rd = nil
+	return err
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/testdriver"
+)
+
+func TestOpenNotFound(t *testing.T) {
+	if _, err := Open(context.TODO(), testdriver.New(), "/abcd"); err == nil {
+		t.Fatal("expected error for missing file")
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		t.Errorf("expected path not found, got %v", err)
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	tst := testdriver.New()
+	dir := NewDirectoryDriver("qwerty", tst)
+	dir.PutContent(context.TODO(), "/abcd", content)
+
+	f, err := Open(context.TODO(), dir, "/abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Size() != int64(len(content)) {
+		t.Errorf("expected size %d got %d", len(content), f.Size())
+	}
+
+	buf := make([]byte, 1)
+	if _, err = io.ReadFull(f, buf); err != nil || buf[0] != 1 {
+		t.Errorf("expected first byte, got %v %v", buf, err)
+	}
+
+	if _, err = f.Seek(-2, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || len(rest) != 2 || rest[0] != 3 {
+		t.Errorf("expected last two bytes, got %v %v", rest, err)
+	}
+
+	if _, err = f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected error seeking before start")
+	}
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a write would exceed the quota of a repository
+	ErrQuotaExceeded = errors.New("repository quota exceeded")
+	// ErrQuotaTooLarge is returned when an upload is larger than the quota of a repository
+	ErrQuotaTooLarge = errors.New("upload larger than the repository quota")
+
+	usedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "repository_used_bytes",
+		Help: "The bytes stored in a repository with a quota",
+	}, []string{"repository"})
+	usedArtifacts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "repository_used_artifacts",
+		Help: "The artifacts stored in a repository with a quota",
+	}, []string{"repository"})
+	quotaBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "repository_quota_bytes",
+		Help: "The byte quota of a repository, 0 is unlimited",
+	}, []string{"repository"})
+	quotaArtifacts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "repository_quota_artifacts",
+		Help: "The artifact quota of a repository, 0 is unlimited",
+	}, []string{"repository"})
+)
+
+// Quota limit the bytes and the number of artifacts stored in a repository, a limit of 0 is unlimited
+type Quota struct {
+	Bytes     int64
+	Artifacts int64
+}
+
+// QuotaDriver is the storage of a repository that enforce a quota. Usage is counted when the driver is created, and
+// is tracked as files are written and deleted. Writes that would exceed the quota fail with ErrQuotaExceeded, and
+// files larger than the quota fail with ErrQuotaTooLarge.
+type QuotaDriver struct {
+	driver.StorageDriver
+	name     string
+	quota    Quota
+	artifact func(path string) bool
+
+	mu        sync.Mutex
+	bytes     int64
+	artifacts int64
+}
+
+// NewQuotaDriver wrap the storage of a repository with a quota, artifact return true for the paths of artifacts that
+// are counted
+func NewQuotaDriver(ctx context.Context, name string, inner driver.StorageDriver, quota Quota, artifact func(path string) bool) (*QuotaDriver, error) {
+	d := &QuotaDriver{StorageDriver: inner, name: name, quota: quota, artifact: artifact}
+	bytes, artifacts, err := d.usage(ctx, "/")
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	quotaBytes.WithLabelValues(name).Set(float64(quota.Bytes))
+	quotaArtifacts.WithLabelValues(name).Set(float64(quota.Artifacts))
+	d.add(bytes, artifacts, false)
+	return d, nil
+}
+
+// Usage return the bytes and the number of artifacts stored
+func (d *QuotaDriver) Usage() (int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bytes, d.artifacts
+}
+
+// Check return an error when an upload of size bytes would exceed the quota, or when no artifacts can be added
+func (d *QuotaDriver) Check(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.quota.Bytes > 0 && size > d.quota.Bytes {
+		return ErrQuotaTooLarge
+	}
+	if d.quota.Bytes > 0 && d.bytes+size > d.quota.Bytes {
+		return ErrQuotaExceeded
+	}
+	if d.quota.Artifacts > 0 && d.artifacts >= d.quota.Artifacts {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (d *QuotaDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if d.quota.Bytes > 0 && int64(len(content)) > d.quota.Bytes {
+		return ErrQuotaTooLarge
+	}
+	size, artifacts, err := d.replaced(ctx, path)
+	if err != nil {
+		return err
+	}
+	bytes := int64(len(content)) - size
+	if err = d.add(bytes, artifacts, true); err != nil {
+		return err
+	}
+	if err = d.StorageDriver.PutContent(ctx, path, content); err != nil {
+		d.add(-bytes, -artifacts, false)
+		return err
+	}
+	return nil
+}
+
+// Writer count the bytes as they are written, a new artifact is counted when the writer is created
+func (d *QuotaDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	size, artifacts, err := d.replaced(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if append {
+		size = 0
+	}
+	if err = d.add(-size, artifacts, true); err != nil {
+		return nil, err
+	}
+	wr, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		d.add(size, -artifacts, false)
+		return nil, err
+	}
+	return &quotaWriter{FileWriter: wr, storage: d, artifacts: artifacts}, nil
+}
+
+func (d *QuotaDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	fi, err := d.StorageDriver.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	size, artifacts, err := d.replaced(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	if d.artifact(sourcePath) && !fi.IsDir() {
+		artifacts--
+	}
+	if err = d.add(-size, artifacts, artifacts > 0); err != nil {
+		return err
+	}
+	if err = d.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		d.add(size, -artifacts, false)
+		return err
+	}
+	return nil
+}
+
+func (d *QuotaDriver) Delete(ctx context.Context, path string) error {
+	bytes, artifacts, err := d.usage(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err = d.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	d.add(-bytes, -artifacts, false)
+	return nil
+}
+
+// usage return the bytes and artifacts of a file or directory
+func (d *QuotaDriver) usage(ctx context.Context, path string) (int64, int64, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var bytes, artifacts int64
+	count := func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			bytes += fi.Size()
+			if d.artifact(fi.Path()) {
+				artifacts++
+			}
+		}
+		return nil
+	}
+	if fi.IsDir() {
+		err = d.StorageDriver.Walk(ctx, path, count)
+	} else {
+		err = count(fi)
+	}
+	return bytes, artifacts, err
+}
+
+// replaced return the size of the file at path that is replaced by a write, and 1 when a new artifact is written
+func (d *QuotaDriver) replaced(ctx context.Context, path string) (int64, int64, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		if d.artifact(path) {
+			return 0, 1, nil
+		}
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), 0, nil
+}
+
+// add to the usage, an increase that exceed the quota fail when check is true
+func (d *QuotaDriver) add(bytes, artifacts int64, check bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if check {
+		if bytes > 0 && d.quota.Bytes > 0 && d.bytes+bytes > d.quota.Bytes {
+			return ErrQuotaExceeded
+		}
+		if artifacts > 0 && d.quota.Artifacts > 0 && d.artifacts+artifacts > d.quota.Artifacts {
+			return ErrQuotaExceeded
+		}
+	}
+	d.bytes += bytes
+	d.artifacts += artifacts
+	usedBytes.WithLabelValues(d.name).Set(float64(d.bytes))
+	usedArtifacts.WithLabelValues(d.name).Set(float64(d.artifacts))
+	return nil
+}
+
+// quotaWriter count the bytes as they are written, a cancelled file is not counted
+type quotaWriter struct {
+	driver.FileWriter
+	storage   *QuotaDriver
+	artifacts int64
+	written   int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if quota := w.storage.quota.Bytes; quota > 0 && w.written+int64(len(p)) > quota {
+		return 0, ErrQuotaTooLarge
+	}
+	if err := w.storage.add(int64(len(p)), 0, true); err != nil {
+		return 0, err
+	}
+	n, err := w.FileWriter.Write(p)
+	w.storage.add(int64(n-len(p)), 0, false)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *quotaWriter) Cancel() error {
+	w.storage.add(-w.written, -w.artifacts, false)
+	w.written, w.artifacts = 0, 0
+	return w.FileWriter.Cancel()
+}
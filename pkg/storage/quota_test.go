@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func isDeb(path string) bool {
+	return strings.HasSuffix(path, ".deb")
+}
+
+func TestQuotaUsage(t *testing.T) {
+	ctx := context.TODO()
+	mem := inmemory.New()
+	mem.PutContent(ctx, "/pool/a.deb", []byte("aaaa"))
+	mem.PutContent(ctx, "/dists/Release", []byte("rr"))
+
+	quota, err := NewQuotaDriver(ctx, "test", mem, Quota{}, isDeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsage(t, quota, 6, 1)
+
+	quota.PutContent(ctx, "/pool/a.deb", []byte("aa"))
+	assertUsage(t, quota, 4, 1)
+
+	wr, _ := quota.Writer(ctx, "/incoming/b.deb", false)
+	wr.Write([]byte("bbb"))
+	wr.Commit()
+	wr.Close()
+	assertUsage(t, quota, 7, 2)
+
+	quota.Move(ctx, "/incoming/b.deb", "/pool/a.deb")
+	assertUsage(t, quota, 5, 1)
+
+	wr, _ = quota.Writer(ctx, "/pool/c.deb", false)
+	wr.Write([]byte("ccc"))
+	wr.Cancel()
+	assertUsage(t, quota, 5, 1)
+
+	quota.Delete(ctx, "/pool")
+	assertUsage(t, quota, 2, 0)
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	ctx := context.TODO()
+	quota, _ := NewQuotaDriver(ctx, "test", inmemory.New(), Quota{Bytes: 10, Artifacts: 1}, isDeb)
+
+	if err := quota.PutContent(ctx, "/pool/a.deb", []byte("aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := quota.PutContent(ctx, "/pool/b.deb", []byte("b")); err != ErrQuotaExceeded {
+		t.Errorf("expected artifacts exceeded, got %v", err)
+	}
+	if err := quota.PutContent(ctx, "/pool/a.deb", []byte("aaaaaaaa")); err != nil {
+		t.Errorf("expected artifact replaced, got %v", err)
+	}
+	if err := quota.PutContent(ctx, "/Release", []byte("rrr")); err != ErrQuotaExceeded {
+		t.Errorf("expected bytes exceeded, got %v", err)
+	}
+	if err := quota.PutContent(ctx, "/Release", make([]byte, 11)); err != ErrQuotaTooLarge {
+		t.Errorf("expected too large, got %v", err)
+	}
+
+	wr, _ := quota.Writer(ctx, "/Release", false)
+	if _, err := wr.Write([]byte("rrr")); err != ErrQuotaExceeded {
+		t.Errorf("expected bytes exceeded, got %v", err)
+	}
+	wr.Cancel()
+	assertUsage(t, quota, 8, 1)
+
+	if err := quota.Check(3); err != ErrQuotaExceeded {
+		t.Errorf("expected full repository, got %v", err)
+	}
+	quota.Delete(ctx, "/pool/a.deb")
+	if err := quota.Check(3); err != nil {
+		t.Errorf("expected space after delete, got %v", err)
+	}
+}
+
+func assertUsage(t *testing.T, quota *QuotaDriver, bytes, artifacts int64) {
+	t.Helper()
+	if b, a := quota.Usage(); b != bytes || a != artifacts {
+		t.Errorf("expected %d bytes of %d artifacts, got %d bytes of %d artifacts", bytes, artifacts, b, a)
+	}
+}
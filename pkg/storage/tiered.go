@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+const (
+	tieredName = "tiered"
+
+	// committed files are cached in files, and are written to partial until they are complete
+	cacheFiles   = "/files"
+	cachePartial = "/partial"
+)
+
+// NewTieredDriver wrap a slow backend, e.g. object storage, with a cache on local disk that is bounded to size bytes.
+// Files are read from the cache when present, and are cached when they are written or read from the start. Writes go
+// through to the backend, and the least recently used files are evicted from the cache. Metadata, i.e. Stat, List and
+// Walk, is read from the backend, which must not be written by other drivers while files are cached.
+func NewTieredDriver(backend, cache driver.StorageDriver, size int64) driver.StorageDriver {
+	d := &tieredDriver{
+		backend: backend,
+		cache:   cache,
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		filling: map[string]int64{},
+	}
+	d.load(context.Background())
+	return d
+}
+
+type tieredDriver struct {
+	backend driver.StorageDriver
+	cache   driver.StorageDriver
+	size    int64
+
+	mu      sync.Mutex // the cache is written under the lock
+	used    int64
+	lru     *list.List // of *cachedFile, the most recently used first
+	entries map[string]*list.Element
+	filling map[string]int64 // the token of the fill of a path, a fill is discarded when the path is written
+	token   int64
+}
+
+type cachedFile struct {
+	path string
+	size int64
+}
+
+func (d *tieredDriver) Name() string {
+	return tieredName
+}
+
+func (d *tieredDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if d.hit(path) {
+		if buf, err := d.cache.GetContent(ctx, cacheFiles+path); err == nil {
+			return buf, nil
+		}
+		d.invalidate(ctx, path)
+	}
+
+	buf, err := d.backend.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	d.put(ctx, path, buf)
+	return buf, nil
+}
+
+func (d *tieredDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	d.invalidate(ctx, path)
+	if err := d.backend.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	d.put(ctx, path, content)
+	return nil
+}
+
+// Reader read a cached file from the cache, or from the backend. A file that is read from the start is cached when it
+// is read to the end.
+func (d *tieredDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if d.hit(path) {
+		if rd, err := d.cache.Reader(ctx, cacheFiles+path, offset); err == nil {
+			return rd, nil
+		}
+		d.invalidate(ctx, path)
+	}
+
+	rd, err := d.backend.Reader(ctx, path, offset)
+	if err != nil || offset > 0 {
+		return rd, err
+	}
+	return &fillReader{rd, d.fill(ctx, path)}, nil
+}
+
+// Writer write through to the backend, a new file is cached when it is committed
+func (d *tieredDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	d.invalidate(ctx, path)
+	wr, err := d.backend.Writer(ctx, path, append)
+	if err != nil || append {
+		return wr, err
+	}
+	return &fillWriter{wr, d.fill(ctx, path)}, nil
+}
+
+func (d *tieredDriver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	return d.backend.Stat(ctx, path)
+}
+
+func (d *tieredDriver) List(ctx context.Context, path string) ([]string, error) {
+	return d.backend.List(ctx, path)
+}
+
+func (d *tieredDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	d.invalidate(ctx, sourcePath)
+	d.invalidate(ctx, destPath)
+	return d.backend.Move(ctx, sourcePath, destPath)
+}
+
+func (d *tieredDriver) Delete(ctx context.Context, path string) error {
+	d.invalidate(ctx, path)
+	return d.backend.Delete(ctx, path)
+}
+
+func (d *tieredDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return d.backend.URLFor(ctx, path, options)
+}
+
+func (d *tieredDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	return d.backend.Walk(ctx, path, f)
+}
+
+// load the files cached before, the oldest files are evicted first. Partial files are deleted.
+func (d *tieredDriver) load(ctx context.Context) {
+	d.cache.Delete(ctx, cachePartial)
+
+	files := []driver.FileInfo{}
+	err := d.cache.Walk(ctx, cacheFiles, func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			files = append(files, fi)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		log.Printf("Unable to load the storage cache: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	for _, fi := range files {
+		path := strings.TrimPrefix(fi.Path(), cacheFiles)
+		d.entries[path] = d.lru.PushBack(&cachedFile{path, fi.Size()})
+		d.used += fi.Size()
+	}
+	d.evict(ctx, 0)
+}
+
+// hit return true when a file is cached, and mark it as recently used
+func (d *tieredDriver) hit(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[path]
+	if ok {
+		d.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+// put a file in the cache
+func (d *tieredDriver) put(ctx context.Context, path string, content []byte) {
+	f := d.fill(ctx, path)
+	f.write(content)
+	f.commit()
+}
+
+// fill return a writer of a file to the cache, a path is filled once at a time
+func (d *tieredDriver) fill(ctx context.Context, path string) *fill {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f := &fill{ctx: ctx, storage: d, path: path}
+	if _, ok := d.filling[path]; ok {
+		return f
+	}
+	if _, ok := d.entries[path]; ok {
+		return f
+	}
+
+	d.token++
+	f.token = d.token
+	f.partial = cachePartial + "/" + strconv.FormatInt(f.token, 10)
+	wr, err := d.cache.Writer(ctx, f.partial, false)
+	if err != nil {
+		return f
+	}
+	f.wr = wr
+	d.filling[path] = f.token
+	return f
+}
+
+// commit a filled file to the cache, unless the path was written while it was filled
+func (d *tieredDriver) commit(f *fill, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filling[f.path] != f.token {
+		d.cache.Delete(f.ctx, f.partial)
+		return
+	}
+	delete(d.filling, f.path)
+
+	d.evict(f.ctx, size)
+	if err := d.cache.Move(f.ctx, f.partial, cacheFiles+f.path); err != nil {
+		log.Printf("Unable to cache %s: %v", f.path, err)
+		d.cache.Delete(f.ctx, f.partial)
+		return
+	}
+	d.entries[f.path] = d.lru.PushFront(&cachedFile{f.path, size})
+	d.used += size
+}
+
+// cancel a fill
+func (d *tieredDriver) cancel(f *fill) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filling[f.path] == f.token {
+		delete(d.filling, f.path)
+	}
+}
+
+// invalidate the cached files of a file or directory, and the fills in progress
+func (d *tieredDriver) invalidate(ctx context.Context, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dir := strings.TrimRight(path, "/")
+	within := func(p string) bool {
+		return p == path || strings.HasPrefix(p, dir+"/")
+	}
+	found := false
+	for p, e := range d.entries {
+		if within(p) {
+			d.lru.Remove(e)
+			delete(d.entries, p)
+			d.used -= e.Value.(*cachedFile).size
+			found = true
+		}
+	}
+	for p := range d.filling {
+		if within(p) {
+			delete(d.filling, p)
+		}
+	}
+	if found {
+		d.cache.Delete(ctx, cacheFiles+dir)
+	}
+}
+
+// evict the least recently used files until size bytes can be cached, d.mu must be held
+func (d *tieredDriver) evict(ctx context.Context, size int64) {
+	for d.used+size > d.size && d.lru.Len() > 0 {
+		e := d.lru.Back()
+		file := e.Value.(*cachedFile)
+		d.lru.Remove(e)
+		delete(d.entries, file.path)
+		d.used -= file.size
+		d.cache.Delete(ctx, cacheFiles+file.path)
+	}
+}
+
+// fill write a file to the cache as it is read or written, files larger than the cache are discarded
+type fill struct {
+	ctx     context.Context
+	storage *tieredDriver
+	path    string
+	partial string
+	token   int64
+	wr      driver.FileWriter
+}
+
+func (f *fill) write(p []byte) {
+	if f.wr == nil {
+		return
+	}
+	if _, err := f.wr.Write(p); err != nil || f.wr.Size() > f.storage.size {
+		f.cancel()
+	}
+}
+
+func (f *fill) commit() {
+	if f.wr == nil {
+		return
+	}
+	wr := f.wr
+	f.wr = nil
+	if err := wr.Commit(); err != nil {
+		wr.Cancel()
+		f.storage.cancel(f)
+		return
+	}
+	if err := wr.Close(); err != nil {
+		f.storage.cancel(f)
+		f.storage.cache.Delete(f.ctx, f.partial)
+		return
+	}
+	f.storage.commit(f, wr.Size())
+}
+
+func (f *fill) cancel() {
+	if f.wr == nil {
+		return
+	}
+	f.wr.Cancel()
+	f.wr = nil
+	f.storage.cancel(f)
+}
+
+// fillReader cache a file when it is read to the end
+type fillReader struct {
+	io.ReadCloser
+	fill *fill
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.fill.write(p[:n])
+	if err == io.EOF {
+		r.fill.commit()
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	r.fill.cancel()
+	return r.ReadCloser.Close()
+}
+
+// fillWriter cache a file when it is committed to the backend
+type fillWriter struct {
+	driver.FileWriter
+	fill *fill
+}
+
+func (w *fillWriter) Write(p []byte) (int, error) {
+	n, err := w.FileWriter.Write(p)
+	w.fill.write(p[:n])
+	return n, err
+}
+
+func (w *fillWriter) Cancel() error {
+	w.fill.cancel()
+	return w.FileWriter.Cancel()
+}
+
+func (w *fillWriter) Commit() error {
+	if err := w.FileWriter.Commit(); err != nil {
+		w.fill.cancel()
+		return err
+	}
+	w.fill.commit()
+	return nil
+}
+
+func (w *fillWriter) Close() error {
+	w.fill.cancel()
+	return w.FileWriter.Close()
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestTieredWriteThrough(t *testing.T) {
+	ctx := context.TODO()
+	backend, cache := inmemory.New(), inmemory.New()
+	tiered := NewTieredDriver(backend, cache, 1024)
+
+	if err := tiered.PutContent(ctx, "/pool/a.deb", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	wr, _ := tiered.Writer(ctx, "/pool/b.deb", false)
+	wr.Write([]byte("b"))
+	if err := wr.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wr.Close()
+
+	for path, content := range map[string]string{"/pool/a.deb": "a", "/pool/b.deb": "b"} {
+		if buf, err := backend.GetContent(ctx, path); err != nil || string(buf) != content {
+			t.Errorf("expected %s in backend, got %q %v", path, buf, err)
+		}
+		if buf, err := cache.GetContent(ctx, cacheFiles+path); err != nil || string(buf) != content {
+			t.Errorf("expected %s in cache, got %q %v", path, buf, err)
+		}
+	}
+
+	// reads are served from the cache
+	backend.PutContent(ctx, "/pool/a.deb", []byte("stale"))
+	rd, err := tiered.Reader(ctx, "/pool/a.deb", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadAll(rd); string(buf) != "a" {
+		t.Errorf("expected cached content, got %q", buf)
+	}
+	rd.Close()
+
+	tiered.Delete(ctx, "/pool")
+	if _, err := cache.Stat(ctx, cacheFiles+"/pool/a.deb"); err == nil {
+		t.Error("expected deleted files to be evicted from the cache")
+	}
+	if _, err := tiered.GetContent(ctx, "/pool/a.deb"); err == nil {
+		t.Error("expected deleted file not found")
+	}
+}
+
+func TestTieredReadFill(t *testing.T) {
+	ctx := context.TODO()
+	backend, cache := inmemory.New(), inmemory.New()
+	tiered := NewTieredDriver(backend, cache, 1024)
+	backend.PutContent(ctx, "/pool/a.deb", []byte("muzeum"))
+
+	rd, _ := tiered.Reader(ctx, "/pool/a.deb", 2)
+	ioutil.ReadAll(rd)
+	rd.Close()
+	rd, _ = tiered.Reader(ctx, "/pool/a.deb", 0)
+	rd.Read(make([]byte, 2))
+	rd.Close()
+	if _, err := cache.Stat(ctx, cacheFiles+"/pool/a.deb"); err == nil {
+		t.Error("expected partial reads not cached")
+	}
+
+	rd, _ = tiered.Reader(ctx, "/pool/a.deb", 0)
+	ioutil.ReadAll(rd)
+	rd.Close()
+	if buf, err := cache.GetContent(ctx, cacheFiles+"/pool/a.deb"); err != nil || string(buf) != "muzeum" {
+		t.Errorf("expected file read to the end to be cached, got %q %v", buf, err)
+	}
+	if files, _ := cache.List(ctx, cachePartial); len(files) > 0 {
+		t.Errorf("expected no partial files, got %v", files)
+	}
+
+	rd, _ = tiered.Reader(ctx, "/pool/a.deb", 2)
+	if buf, _ := ioutil.ReadAll(rd); string(buf) != "zeum" {
+		t.Errorf("expected cached content from offset, got %q", buf)
+	}
+	rd.Close()
+}
+
+func TestTieredEvict(t *testing.T) {
+	ctx := context.TODO()
+	backend, cache := inmemory.New(), inmemory.New()
+	tiered := NewTieredDriver(backend, cache, 10)
+
+	tiered.PutContent(ctx, "/a", bytes.Repeat([]byte("a"), 4))
+	tiered.PutContent(ctx, "/b", bytes.Repeat([]byte("b"), 4))
+	tiered.GetContent(ctx, "/a")
+	tiered.PutContent(ctx, "/c", bytes.Repeat([]byte("c"), 4))
+	tiered.PutContent(ctx, "/large", bytes.Repeat([]byte("l"), 11))
+
+	expected := map[string]bool{"/a": true, "/b": false, "/c": true, "/large": false}
+	for path, cached := range expected {
+		if _, err := cache.Stat(ctx, cacheFiles+path); (err == nil) != cached {
+			t.Errorf("expected %s cached %v, got %v", path, cached, err)
+		}
+		if _, err := backend.Stat(ctx, path); err != nil {
+			t.Errorf("expected %s in backend, got %v", path, err)
+		}
+	}
+
+	// the cache is loaded when the driver is created
+	reloaded := NewTieredDriver(backend, cache, 4).(*tieredDriver)
+	if reloaded.used != 4 || len(reloaded.entries) != 1 {
+		t.Errorf("expected files evicted to the size of the cache, got %d bytes of %d files", reloaded.used, len(reloaded.entries))
+	}
+}
+
+func TestTieredFillInvalidated(t *testing.T) {
+	ctx := context.TODO()
+	backend, cache := inmemory.New(), inmemory.New()
+	tiered := NewTieredDriver(backend, cache, 1024)
+	backend.PutContent(ctx, "/a", []byte("old"))
+
+	rd, _ := tiered.Reader(ctx, "/a", 0)
+	tiered.PutContent(ctx, "/a", []byte("new"))
+	ioutil.ReadAll(rd)
+	rd.Close()
+
+	var content []byte
+	if err := cache.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			content, _ = cache.GetContent(ctx, fi.Path())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new" {
+		t.Errorf("expected the written file cached, got %q", content)
+	}
+}
@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream repository after repeated failures, until a probe succeed
+var ErrCircuitOpen = errors.New("upstream repository is unavailable")
+
+const (
+	closed   = "closed"
+	open     = "open"
+	halfOpen = "half-open"
+)
+
+var (
+	requests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_request_duration_seconds",
+		Help: "The duration of requests to upstream repositories",
+	}, []string{"registry", "result"})
+
+	circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_circuit_open",
+		Help: "1 when requests to the upstream repository fail fast, 0 otherwise",
+	}, []string{"registry"})
+
+	circuits   = map[string]*circuit{}
+	circuitsMu sync.Mutex
+)
+
+// Health of an upstream repository
+type Health struct {
+	State    string  `json:"state"`
+	Failures int     `json:"failures"` // consecutive failures
+	Requests uint64  `json:"requests"`
+	Errors   uint64  `json:"errors"`
+	Latency  float64 `json:"latency"` // moving average in seconds
+}
+
+// circuit track the health of an upstream and open after consecutive failures. Once open, a request is let through
+// as a probe every probe interval, and the circuit close when it succeed.
+type circuit struct {
+	name      string
+	threshold int
+	probe     time.Duration
+	health    Health
+	opened    time.Time
+	mu        sync.Mutex
+}
+
+func newCircuit(name string, threshold int, probe time.Duration) *circuit {
+	c := &circuit{name: name, threshold: threshold, probe: probe, health: Health{State: closed}}
+	circuitOpen.WithLabelValues(name).Set(0)
+
+	circuitsMu.Lock()
+	circuits[name] = c
+	circuitsMu.Unlock()
+
+	return c
+}
+
+// allow return true if a request can be sent upstream
+func (c *circuit) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.health.State {
+	case open:
+		if time.Since(c.opened) < c.probe {
+			return false
+		}
+		c.health.State = halfOpen
+		return true
+	case halfOpen:
+		return false // a probe is in flight
+	default:
+		return true
+	}
+}
+
+func (c *circuit) done(failed bool, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.health.Requests++
+	c.health.Latency = 0.8*c.health.Latency + 0.2*latency.Seconds()
+
+	if !failed {
+		c.health.Failures = 0
+		c.health.State = closed
+		circuitOpen.WithLabelValues(c.name).Set(0)
+		return
+	}
+
+	c.health.Errors++
+	c.health.Failures++
+	if c.health.State == halfOpen || c.health.Failures >= c.threshold {
+		c.health.State = open
+		c.opened = time.Now()
+		circuitOpen.WithLabelValues(c.name).Set(1)
+	}
+}
+
+// cancel a request that was not completed, a cancelled probe let the next request probe
+func (c *circuit) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.health.State == halfOpen {
+		c.health.State = open
+	}
+}
+
+// Circuits return the health of every upstream repository
+func Circuits() map[string]Health {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	health := map[string]Health{}
+	for name, c := range circuits {
+		c.mu.Lock()
+		health[name] = c.health
+		c.mu.Unlock()
+	}
+	return health
+}
+
+type circuitTransport struct {
+	circuit *circuit
+	next    http.RoundTripper
+}
+
+func (t circuitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.circuit.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	start := time.Now()
+	rsp, err := t.next.RoundTrip(r)
+
+	// requests cancelled by the client are not upstream failures
+	if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+		t.circuit.cancel()
+		return rsp, err
+	}
+
+	failed := err != nil || rsp.StatusCode >= http.StatusInternalServerError
+
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	requests.WithLabelValues(t.circuit.name, result).Observe(time.Since(start).Seconds())
+
+	t.circuit.done(failed, time.Since(start))
+	return rsp, err
+}
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitOpenAfterFailures(t *testing.T) {
+	next := &failingTransport{failures: 10}
+	client := &http.Client{Transport: circuitTransport{newCircuit("circuit.test", 2, time.Minute), next}}
+
+	for i := 0; i < 5; i++ {
+		client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+	}
+
+	if next.count != 2 {
+		t.Errorf("expected requests to fail fast after 2 failures, got %d upstream requests", next.count)
+	}
+	if Circuits()["circuit.test"].State != open {
+		t.Errorf("expected open circuit, got %s", Circuits()["circuit.test"].State)
+	}
+}
+
+func TestCircuitCloseAfterProbe(t *testing.T) {
+	next := &failingTransport{failures: 2}
+	client := &http.Client{Transport: circuitTransport{newCircuit("probe.test", 2, time.Millisecond), next}}
+
+	client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+	client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+	time.Sleep(2 * time.Millisecond)
+
+	rsp, err := client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+	if Circuits()["probe.test"].State != closed {
+		t.Errorf("expected closed circuit after probe, got %s", Circuits()["probe.test"].State)
+	}
+}
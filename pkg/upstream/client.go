@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	defaultConnectTimeout  = 30 * time.Second
+	defaultReadTimeout     = time.Minute
+	defaultRetries         = 2
+	defaultBackoff         = time.Second
+	defaultCircuitFailures = 5
+	defaultCircuitProbe    = 30 * time.Second
+)
+
+var (
+	errCA = errors.New("no certificates found in upstream CA bundle")
+)
+
+// Config of the requests to the upstream of a repository
+type Config struct {
+	// NotFoundTTL is the time upstream 404 responses are cached, 0 disable negative caching
+	NotFoundTTL time.Duration `yaml:"notfoundttl"`
+
+	// ConnectTimeout is the time to establish a connection, default 30s
+	ConnectTimeout time.Duration `yaml:"connecttimeout"`
+	// ReadTimeout is the time to wait for the response headers, and between reads of the response body, default 1m
+	ReadTimeout time.Duration `yaml:"readtimeout"`
+
+	// Retries is the number of retries of network errors and 5xx responses, default 2. Use -1 to disable retries.
+	Retries int `yaml:"retries"`
+	// Backoff is the wait before the first retry, it doubles for every retry. Default 1s.
+	Backoff time.Duration `yaml:"backoff"`
+
+	// CircuitFailures is the number of consecutive failures that open the circuit, default 5. Use -1 to disable.
+	CircuitFailures int `yaml:"circuitfailures"`
+	// CircuitProbe is the wait before a request probe an open circuit, default 30s
+	CircuitProbe time.Duration `yaml:"circuitprobe"`
+
+	// HTTPProxy is the URL of a proxy for upstream requests, default to the HTTP_PROXY and HTTPS_PROXY environment
+	HTTPProxy string `yaml:"httpproxy"`
+
+	// CA is a PEM bundle of certificates trusted in addition to the system certificates
+	CA string `yaml:"ca"`
+	// Certificate and Key are the PEM client certificate used to authenticate to upstream
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
+}
+
+// NewClient creates the http client used for requests to the upstream of repository name
+func NewClient(name string, cfg Config) (*http.Client, error) {
+	base, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = latencyTransport{timeoutTransport{base.ResponseHeaderTimeout, base}}
+
+	retries, backoff := cfg.Retries, cfg.Backoff
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if retries > 0 {
+		transport = retryTransport{retries, backoff, transport}
+	}
+
+	failures, probe := cfg.CircuitFailures, cfg.CircuitProbe
+	if failures == 0 {
+		failures = defaultCircuitFailures
+	}
+	if probe == 0 {
+		probe = defaultCircuitProbe
+	}
+	if failures > 0 {
+		transport = circuitTransport{newCircuit(name, failures, probe), transport}
+	}
+
+	if cfg.NotFoundTTL > 0 {
+		transport = notFoundTransport{newNotFoundCache(name, cfg.NotFoundTTL), transport}
+	}
+
+	return &http.Client{
+		Transport: offlineTransport{name, transport},
+	}, nil
+}
+
+func newTransport(cfg Config) (*http.Transport, error) {
+	connect, read := cfg.ConnectTimeout, cfg.ReadTimeout
+	if connect == 0 {
+		connect = defaultConnectTimeout
+	}
+	if read == 0 {
+		read = defaultReadTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connect,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   connect,
+		ResponseHeaderTimeout: read,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if len(cfg.HTTPProxy) > 0 {
+		proxy, err := url.Parse(cfg.HTTPProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if len(cfg.CA) > 0 || len(cfg.Certificate) > 0 {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(cfg.CA) > 0 {
+		pem, err := ioutil.ReadFile(os.ExpandEnv(cfg.CA))
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errCA
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.Certificate) > 0 {
+		crt, err := tls.LoadX509KeyPair(os.ExpandEnv(cfg.Certificate), os.ExpandEnv(cfg.Key))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{crt}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,113 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cooldown is the time a failed endpoint is tried after the other endpoints
+const cooldown = time.Minute
+
+var (
+	latencies   = map[string]float64{}
+	latenciesMu sync.RWMutex
+)
+
+// Endpoints are equivalent upstream URLs of a repository, e.g. mirrors of a Debian archive
+type Endpoints struct {
+	urls    []string
+	latency bool
+	failed  map[string]time.Time
+	mu      sync.Mutex
+}
+
+// NewEndpoints creates Endpoints for urls. When latency is true, endpoints are ordered by response latency instead of the configured order.
+func NewEndpoints(urls []string, latency bool) *Endpoints {
+	return &Endpoints{
+		urls:    urls,
+		latency: latency,
+		failed:  map[string]time.Time{},
+	}
+}
+
+// URLs return the endpoints in the order they should be tried. Endpoints that recently failed are tried last.
+func (e *Endpoints) URLs() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	healthy := func(u string) bool {
+		return now.Sub(e.failed[u]) > cooldown
+	}
+
+	xs := append([]string{}, e.urls...)
+	sort.SliceStable(xs, func(i, j int) bool {
+		if hi, hj := healthy(xs[i]), healthy(xs[j]); hi != hj {
+			return hi
+		}
+		if e.latency {
+			return latency(xs[i]) < latency(xs[j])
+		}
+		return false
+	})
+	return xs
+}
+
+// All return the endpoints in the configured order
+func (e *Endpoints) All() []string {
+	return e.urls
+}
+
+// Primary return the first endpoint to try
+func (e *Endpoints) Primary() string {
+	return e.URLs()[0]
+}
+
+// Failed mark an endpoint as failed, it will be tried last for a while
+func (e *Endpoints) Failed(u string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.failed[u] = time.Now()
+}
+
+// latency return the average response latency of the host of u. Hosts without requests have no latency, so that they are tried.
+func latency(u string) float64 {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return 0
+	}
+
+	latenciesMu.RLock()
+	defer latenciesMu.RUnlock()
+
+	return latencies[parsed.Host]
+}
+
+// latencyTransport record the average time to response headers per host
+type latencyTransport struct {
+	next http.RoundTripper
+}
+
+func (t latencyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rsp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return rsp, err
+	}
+
+	elapsed := time.Since(start).Seconds()
+
+	latenciesMu.Lock()
+	if avg, ok := latencies[r.URL.Host]; ok {
+		latencies[r.URL.Host] = 0.8*avg + 0.2*elapsed
+	} else {
+		latencies[r.URL.Host] = elapsed
+	}
+	latenciesMu.Unlock()
+
+	return rsp, err
+}
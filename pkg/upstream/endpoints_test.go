@@ -0,0 +1,26 @@
+package upstream
+
+import "testing"
+
+func TestEndpointsFailedTriedLast(t *testing.T) {
+	e := NewEndpoints([]string{"http://a.example/ubuntu", "http://b.example/ubuntu"}, false)
+
+	e.Failed("http://a.example/ubuntu")
+
+	if e.Primary() != "http://b.example/ubuntu" {
+		t.Errorf("expected failed endpoint to be tried last, got %v", e.URLs())
+	}
+}
+
+func TestEndpointsOrderByLatency(t *testing.T) {
+	latenciesMu.Lock()
+	latencies["slow.example"] = 2
+	latencies["fast.example"] = 0.1
+	latenciesMu.Unlock()
+
+	e := NewEndpoints([]string{"http://slow.example/ubuntu", "http://fast.example/ubuntu"}, true)
+
+	if e.Primary() != "http://fast.example/ubuntu" {
+		t.Errorf("expected fastest endpoint first, got %v", e.URLs())
+	}
+}
@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	notFound   = map[string]*notFoundCache{}
+	notFoundMu sync.Mutex
+)
+
+// notFoundCache remember upstream 404 responses by URL until they expire, the URL include the host of the upstream
+// and the query
+type notFoundCache struct {
+	ttl     time.Duration
+	expires map[string]time.Time
+	mu      sync.Mutex
+}
+
+func newNotFoundCache(name string, ttl time.Duration) *notFoundCache {
+	c := &notFoundCache{ttl: ttl, expires: map[string]time.Time{}}
+
+	notFoundMu.Lock()
+	notFound[name] = c
+	notFoundMu.Unlock()
+
+	return c
+}
+
+func (c *notFoundCache) get(u string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.expires[u]
+	if ok && time.Now().After(expires) {
+		delete(c.expires, u)
+		return false
+	}
+	return ok
+}
+
+func (c *notFoundCache) add(u string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.expires) > 10000 {
+		for p, expires := range c.expires {
+			if now.After(expires) {
+				delete(c.expires, p)
+			}
+		}
+	}
+	c.expires[u] = now.Add(c.ttl)
+}
+
+func (c *notFoundCache) purge(prefix string) (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for u := range c.expires {
+		if parsed, err := url.Parse(u); err == nil && strings.HasPrefix(parsed.Path, prefix) {
+			delete(c.expires, u)
+			n++
+		}
+	}
+	return
+}
+
+// Purge forget the upstream 404 responses of repository name for paths starting with prefix, an empty prefix purge all.
+// It return the number of URLs purged.
+func Purge(name, prefix string) int {
+	notFoundMu.Lock()
+	c, ok := notFound[name]
+	notFoundMu.Unlock()
+
+	if !ok {
+		return 0
+	}
+	return c.purge(prefix)
+}
+
+type notFoundTransport struct {
+	cache *notFoundCache
+	next  http.RoundTripper
+}
+
+func (t notFoundTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet {
+		return t.next.RoundTrip(r)
+	}
+
+	if t.cache.get(r.URL.String()) {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    r,
+		}, nil
+	}
+
+	rsp, err := t.next.RoundTrip(r)
+	if err == nil && rsp.StatusCode == http.StatusNotFound {
+		t.cache.add(r.URL.String())
+	}
+	return rsp, err
+}
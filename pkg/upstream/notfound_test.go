@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+type countingTransport struct {
+	status int
+	count  int
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.count++
+	return &http.Response{StatusCode: t.status, Body: http.NoBody}, nil
+}
+
+func TestNotFoundIsCached(t *testing.T) {
+	next := &countingTransport{status: http.StatusNotFound}
+	client := &http.Client{Transport: notFoundTransport{newNotFoundCache("notfound.test", time.Minute), next}}
+
+	for i := 0; i < 3; i++ {
+		rsp, err := client.Get("https://api.nuget.org/v3-flatcontainer/abc/index.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rsp.StatusCode)
+		}
+	}
+
+	if next.count != 1 {
+		t.Errorf("expected 1 upstream request, got %d", next.count)
+	}
+}
+
+func TestNotFoundExpire(t *testing.T) {
+	next := &countingTransport{status: http.StatusNotFound}
+	client := &http.Client{Transport: notFoundTransport{newNotFoundCache("notfound.test", time.Nanosecond), next}}
+
+	client.Get("https://api.nuget.org/v3-flatcontainer/abc/index.json")
+	time.Sleep(time.Millisecond)
+	client.Get("https://api.nuget.org/v3-flatcontainer/abc/index.json")
+
+	if next.count != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", next.count)
+	}
+}
+
+func TestPurgeNotFound(t *testing.T) {
+	next := &countingTransport{status: http.StatusNotFound}
+	client := &http.Client{Transport: notFoundTransport{newNotFoundCache("purge.test", time.Minute), next}}
+
+	client.Get("https://api.nuget.org/v3-flatcontainer/abc/index.json")
+	client.Get("https://api.nuget.org/v3-flatcontainer/def/index.json")
+
+	if n := Purge("purge.test", "/v3-flatcontainer/abc/"); n != 1 {
+		t.Errorf("expected 1 path purged, got %d", n)
+	}
+
+	client.Get("https://api.nuget.org/v3-flatcontainer/abc/index.json")
+	client.Get("https://api.nuget.org/v3-flatcontainer/def/index.json")
+
+	if next.count != 3 {
+		t.Errorf("expected purged path requested from upstream, got %d requests", next.count)
+	}
+}
+
+func TestNotFoundByHostAndQuery(t *testing.T) {
+	next := &countingTransport{status: http.StatusNotFound}
+	client := &http.Client{Transport: notFoundTransport{newNotFoundCache("query.test", time.Minute), next}}
+
+	client.Get("https://azuresearch-usnc.nuget.org/query?q=abc")
+	client.Get("https://azuresearch-usnc.nuget.org/query?q=def")
+	client.Get("http://archive.ubuntu.com/ubuntu/pool/main/h/hello/hello_2.10-2_amd64.deb")
+	client.Get("http://mirror.example.com/ubuntu/pool/main/h/hello/hello_2.10-2_amd64.deb")
+
+	if next.count != 4 {
+		t.Errorf("expected every search and mirror requested, got %d requests", next.count)
+	}
+	if n := Purge("query.test", "/query"); n != 2 {
+		t.Errorf("expected searches purged by path, got %d", n)
+	}
+}
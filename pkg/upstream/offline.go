@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrOffline is returned for requests to an upstream repository while it is offline
+var ErrOffline = errors.New("upstream repository is offline")
+
+var (
+	global  bool
+	offline = map[string]bool{}
+	mu      sync.RWMutex
+)
+
+// SetOffline switch the upstream of repository name offline or back online
+func SetOffline(name string, value bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	offline[name] = value
+}
+
+// SetGlobalOffline switch all upstream repositories offline or back online
+func SetGlobalOffline(value bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	global = value
+}
+
+// Offline return true when the upstream of repository name, or all upstream repositories, are offline
+func Offline(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return global || offline[name]
+}
+
+// Status return the global switch and the switch of every repository
+func Status() (bool, map[string]bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	repos := map[string]bool{}
+	for name, value := range offline {
+		repos[name] = value
+	}
+	return global, repos
+}
+
+type offlineTransport struct {
+	name string
+	next http.RoundTripper
+}
+
+func (t offlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if Offline(t.name) {
+		return nil, ErrOffline
+	}
+	return t.next.RoundTrip(r)
+}
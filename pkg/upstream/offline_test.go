@@ -0,0 +1,33 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestOfflineRepositoryFailFast(t *testing.T) {
+	SetOffline("offline.test", true)
+	defer SetOffline("offline.test", false)
+
+	client, _ := NewClient("offline.test", Config{})
+	_, err := client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+
+	if !errors.Is(err, ErrOffline) {
+		t.Errorf("expected ErrOffline, got %v", err)
+	}
+}
+
+func TestGlobalOfflineApplyToAllRepositories(t *testing.T) {
+	SetGlobalOffline(true)
+	defer SetGlobalOffline(false)
+
+	if !Offline("online.test") {
+		t.Error("repository should be offline when global offline is set")
+	}
+
+	transport := offlineTransport{"online.test", nil}
+	if _, err := transport.RoundTrip(&http.Request{}); err != ErrOffline {
+		t.Errorf("expected ErrOffline, got %v", err)
+	}
+}
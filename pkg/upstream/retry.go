@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"net/http"
+	"time"
+)
+
+type retryTransport struct {
+	retries int
+	backoff time.Duration
+	next    http.RoundTripper
+}
+
+// RoundTrip retry idempotent requests on network errors and 5xx responses, with exponential backoff
+func (t retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || (r.Body != nil && r.Body != http.NoBody) {
+		return t.next.RoundTrip(r)
+	}
+
+	backoff := t.backoff
+	for i := 0; ; i++ {
+		rsp, err := t.next.RoundTrip(r)
+		if i == t.retries || (err == nil && rsp.StatusCode < http.StatusInternalServerError) {
+			return rsp, err
+		}
+		if err == nil {
+			rsp.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type failingTransport struct {
+	failures int
+	err      error
+	count    int
+}
+
+func (t *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.count++
+	if t.count <= t.failures {
+		if t.err != nil {
+			return nil, t.err
+		}
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestRetryServerError(t *testing.T) {
+	next := &failingTransport{failures: 2}
+	client := &http.Client{Transport: retryTransport{2, time.Millisecond, next}}
+
+	rsp, err := client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusOK || next.count != 3 {
+		t.Errorf("expected 200 after 3 requests, got %d after %d", rsp.StatusCode, next.count)
+	}
+}
+
+func TestRetryNetworkErrorGiveUp(t *testing.T) {
+	next := &failingTransport{failures: 5, err: errors.New("connection reset")}
+	client := &http.Client{Transport: retryTransport{2, time.Millisecond, next}}
+
+	if _, err := client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease"); err == nil {
+		t.Error("expected error after retries")
+	}
+	if next.count != 3 {
+		t.Errorf("expected 3 requests, got %d", next.count)
+	}
+}
+
+func TestNoRetryClientError(t *testing.T) {
+	next := &countingTransport{status: http.StatusNotFound}
+	client := &http.Client{Transport: retryTransport{2, time.Millisecond, next}}
+
+	client.Get("http://archive.ubuntu.com/ubuntu/dists/bionic/InRelease")
+
+	if next.count != 1 {
+		t.Errorf("expected 1 request, got %d", next.count)
+	}
+}
+
+func TestInvalidCABundle(t *testing.T) {
+	if _, err := NewClient("ca.test", Config{CA: "/does/not/exist.pem"}); err == nil {
+		t.Error("expected error for missing CA bundle")
+	}
+}
@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutStalledBody(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: timeoutTransport{50 * time.Millisecond, http.DefaultTransport}}
+	rsp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(rsp.Body)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("expected an error reading a stalled body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of a stalled body did not time out")
+	}
+}
+
+func TestTimeoutBodyRead(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: timeoutTransport{200 * time.Millisecond, http.DefaultTransport}}
+	rsp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	buf, err := ioutil.ReadAll(rsp.Body)
+	if err != nil || string(buf) != "chunkchunkchunk" {
+		t.Errorf("expected the body, got %q %v", buf, err)
+	}
+}